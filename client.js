@@ -1,6 +1,6 @@
 const version = {
-    major: 0,
-    minor: 5,
+    major: 2,
+    minor: 0,
     patch: 0
 }
 
@@ -54,6 +54,16 @@ const messageTypes = {
     }
 }
 
+/**
+ * @typedef Transport
+ * @type {Object}
+ * @property {String} kind - "WebSocket" or "EventSource"
+ * @property {Number} readyState
+ * @property {Number} OPEN
+ * @property {function(Uint8Array): void} send
+ * @property {function(Number): void} close
+ */
+
 let websocket
 let flaggons = []
 /** @type Map<Number, string> */
@@ -99,100 +109,183 @@ function fromBytes(highByte, lowByte) {
     return highByte * 256 + lowByte
 }
 
-/** Connect to a grog barrel web socket
+/** Connect to a grog barrel server, falling back to server sent events
+ *  when a web socket can not be opened
  * @param {string} url - url of a grog barrel server
- * @returns WebSocket
+ * @returns Transport
  */
 function connect(url) {
+    /** @type Transport */
+    const transport = {
+        kind: "WebSocket",
+        readyState: 0,
+        OPEN: 1,
+        send: () => { throw "Attempting to send on unopened transport"; },
+        close: () => { },
+    };
+
+    let opened = false;
     let socket = new WebSocket(`ws://${url}`);
     socket.binaryType = "arraybuffer";
 
     socket.addEventListener("open", () => {
+        opened = true;
+        transport.readyState = transport.OPEN;
+        transport.send = (msg) => socket.send(msg);
+        transport.close = (code) => socket.close(code);
+
         log.clear();
         log.appendln("Opened Connection " + new Date());
         log.appendln("-------");
         let name = Math.random().toString();
-        sendAnnounce(socket, name)
+        socket.send(buildAnnounce(name));
     });
     socket.addEventListener("message", (e) => {
-        log.appendln("recieved message " + new Date());
-
-
-        const data = new Uint8Array(e.data);
-        const msgType = data[0];
-        const msg = data.subarray(1);
-
-        switch (msgType) {
-            case messageTypes.EMPTY:
-                break;
-            case messageTypes.ANNOUNCE:
-                parseAnnounce(msg, activeClients);
-                updateClients(activeClients);
-                break;
-            case messageTypes.STATUS:
-                let statuses = parseStatus(msg);
-                updateStatuses(statuses, activeClients);
-                break;
-            case messageTypes.ERROR:
-                log.append("An Error Occured: ")
-
-                let error = new TextDecoder().decode(msg);
-
-                log.appendln(error);
-                log.appendln("closing connection");
-                break;
-            default:
-                console.error("Recieved unknown message type:", msgType);
+        handleMessage(new Uint8Array(e.data));
+    });
+    socket.addEventListener("error", () => {
+        if (!opened) {
+            console.warn("Unable to open web socket, falling back to server sent events");
+            connectEventSource(url, transport);
         }
     });
     socket.addEventListener("close", () => {
-        log.appendln("-------\nClosed Connection " + new Date());
+        if (opened) {
+            transport.readyState = 3;
+            log.appendln("-------\nClosed Connection " + new Date());
+        }
     });
 
-    return socket
+    return transport
 }
 
-/** Send an announce message to a grog barrel server
- * @param {WebSocket} socket
+/** Connect to a grog barrel server using server sent events and POST requests
+ * @param {string} url - url of a grog barrel server
+ * @param {Transport} transport - transport to open
+ */
+async function connectEventSource(url, transport) {
+    const base = `${location.protocol}//${url}`;
+    const name = Math.random().toString();
+
+    const resp = await fetch(base + "/session", { method: "POST", body: buildAnnounce(name) });
+    if (!resp.ok) {
+        log.appendln("An Error Occured: " + await resp.text());
+        return
+    }
+    const session = encodeURIComponent(await resp.text());
+
+    const events = new EventSource(`${base}/events?session=${session}`);
+    events.addEventListener("open", () => {
+        transport.kind = "EventSource";
+        transport.readyState = transport.OPEN;
+        log.clear();
+        log.appendln("Opened Connection (EventSource) " + new Date());
+        log.appendln("-------");
+    });
+    events.addEventListener("message", (e) => {
+        const data = Uint8Array.from(atob(e.data), (c) => c.charCodeAt(0));
+        handleMessage(data);
+    });
+    events.addEventListener("error", () => {
+        // EventSource reconnects on its own, the session waits 30 seconds for the stream to reattach
+        if (events.readyState != EventSource.CLOSED) {
+            log.appendln("Reconnecting " + new Date());
+        } else if (transport.readyState == transport.OPEN) {
+            transport.readyState = 3;
+            log.appendln("-------\nClosed Connection " + new Date());
+        }
+    });
+
+    transport.send = (msg) => {
+        fetch(`${base}/status?session=${session}`, { method: "POST", body: msg });
+    };
+    transport.close = () => {
+        events.close();
+        transport.readyState = 3;
+        fetch(`${base}/session?session=${session}`, { method: "DELETE" });
+        log.appendln("-------\nClosed Connection " + new Date());
+    };
+}
+
+/** Handle a message from a grog barrel server
+ * @param {Uint8Array} data - the recieved message
+ */
+function handleMessage(data) {
+    log.appendln("recieved message " + new Date());
+
+    const msgType = data[0];
+    const msg = data.subarray(1);
+
+    switch (msgType) {
+        case messageTypes.EMPTY:
+            break;
+        case messageTypes.ANNOUNCE:
+            let spectators = parseAnnounce(msg, activeClients);
+            log.appendln("spectators: " + spectators);
+            updateClients(activeClients);
+            break;
+        case messageTypes.STATUS:
+            let statuses = parseStatus(msg);
+            updateStatuses(statuses, activeClients);
+            break;
+        case messageTypes.ERROR:
+            log.append("An Error Occured: ")
+
+            let error = new TextDecoder().decode(msg);
+
+            log.appendln(error);
+            log.appendln("closing connection");
+            break;
+        default:
+            console.error("Recieved unknown message type:", msgType);
+    }
+}
+
+/** Build an announce message for a grog barrel server
  * @param {string} name - the name to register the client as
+ * @returns Uint8Array
  */
-function sendAnnounce(socket, name) {
+function buildAnnounce(name) {
     // PERF: reuse encoder instance
     const encoder = new TextEncoder();
+    const encodedName = encoder.encode(name);
 
-    const msg = new Uint8Array(3 + name.length);
+    const msg = new Uint8Array(3 + encodedName.length);
     msg.set([version.major, version.minor, version.patch]);
-    msg.set(encoder.encode(name), 3);
+    msg.set(encodedName, 3);
 
-    socket.send(msg);
+    return msg
 }
 
 /** Handle recieving an announce message
  *  @param {Uint8Array} data - the recieved data
  *  @param {Map<Number, String>} clients - client map to update
+ *  @returns Number - the number of spectators
  */
 function parseAnnounce(data, clients) {
     // PERF: reuse decoder instance
     const decoder = new TextDecoder("utf-8");
-    let numClients = data[0];
+    let numClients = fromBytes(data[0], data[1]);
     clients.clear();
 
     console.debug(data);
 
-    let pos = 1;
+    let pos = 2;
     for (let clientNum = 0; clientNum < numClients; clientNum++) {
-        let id = data[pos];
-        pos++;
+        let id = fromBytes(data[pos], data[pos + 1]);
+        pos += 2;
         let strLen = data[pos];
         pos++;
         let name = decoder.decode(data.subarray(pos, pos + strLen))
         clients.set(id, name);
         pos += strLen;
     };
+
+    return fromBytes(data[pos], data[pos + 1]);
 }
 
 /** Send a state message to a grog barrel server
- * @param {WebSocket} socket
+ * @param {Transport} socket
  * @param {Number} offset
  * @param {Number} state
  */
@@ -210,14 +303,15 @@ function sendStatus(socket, offset, state) {
  * @param {Uint8Array} data - the recieved data
  */
 function parseStatus(data) {
-    let numUsers = data.length / 4;
+    let numUsers = fromBytes(data[0], data[1]);
     let statuses = [];
     for (let i = 0; i < numUsers; i++) {
+        const start = 2 + 5 * i;
         /** @type StatusMsg */
         let msg = {
-            id: data[4 * i + 3],
-            state: data[4 * i + 2],
-            offset: fromBytes(data[4 * i], data[4 * i + 1])
+            id: fromBytes(data[start + 3], data[start + 4]),
+            state: data[start + 2],
+            offset: fromBytes(data[start], data[start + 1])
         };
         statuses.push(msg);
     }
@@ -10,7 +10,7 @@ from time import sleep
 import datetime as dt
 from typing import Iterable, TypedDict
 
-VERSION = {"Major": 1, "Minor": 5, "Patch": 0}
+VERSION = {"Major": 2, "Minor": 0, "Patch": 0}
 VERSION_STRING = "v" + ".".join(
     map(str, [VERSION["Major"], VERSION["Minor"], VERSION["Patch"]])
 )
@@ -131,11 +131,11 @@ def connect(
                     state["last_info"] = "recieved serverAnnounce"
                     state["clients"].clear()
 
-                    num_clients = buf[1]
-                    pos = 2
+                    num_clients = int.from_bytes(buf[1:3])
+                    pos = 3
                     for _ in range(num_clients):
-                        client_id = buf[pos]
-                        pos += 1
+                        client_id = int.from_bytes(buf[pos : pos + 2])
+                        pos += 2
                         name_length = buf[pos]
                         pos += 1
                         name = buf[pos : pos + name_length].decode()
@@ -148,19 +148,19 @@ def connect(
                 case MessageType.STATUS:
                     state["last_info"] = "recieved serverStatus"
 
-                    offset = 2
-                    if recieved - offset < buf[2]:
+                    offset = 3
+                    if recieved - offset < 5 * int.from_bytes(buf[1:3]):
                         print("short read", file=sys.stderr)
-                    n = (recieved - offset) // 4
+                    n = (recieved - offset) // 5
                     print("n:", n, file=sys.stderr)
                     for i in range(n):
-                        start = 4 * i + offset
+                        start = 5 * i + offset
                         client_time = int.from_bytes(buf[start : start + 2])
                         try:
                             client_state = PlayerState(buf[start + 2])
                         except ValueError:
                             client_state = PlayerState.UNKNOWN
-                        client_id = buf[start + 3]
+                        client_id = int.from_bytes(buf[start + 3 : start + 5])
                         # FIXME: random clients sometimes get added
                         state["clients"].setdefault(
                             client_id,
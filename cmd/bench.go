@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/server"
+)
+
+// A synthetic client measuring how long its statuses take to come back from the room
+type benchClient struct {
+	name string
+	lock sync.Mutex
+	id   int // -1 until the client appears in an announcement
+	seq  uint16
+	// send times of statuses that have not been observed yet
+	sent      map[uint16]time.Time
+	latencies []time.Duration
+	frames    int
+	observed  int
+	dropped   int
+	errors    int
+}
+
+type benchTotals struct {
+	connected int
+	failed    int
+	sent      int
+	frames    int
+	observed  int
+	dropped   int
+	pending   int
+	errors    int
+	latencies []time.Duration
+}
+
+func (c *benchClient) onAnnounce(msg grog.ServerAnnounceMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frames++
+	for _, announced := range msg.Clients {
+		if announced.Name == c.name {
+			c.id = int(announced.Id)
+		}
+	}
+}
+
+func (c *benchClient) onStatus(msg grog.ServerStatusMessage) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frames++
+	for _, status := range msg.Statuses {
+		if int(status.Id) != c.id {
+			continue
+		}
+		sentAt, ok := c.sent[status.Offset]
+		if !ok {
+			continue
+		}
+		c.latencies = append(c.latencies, now.Sub(sentAt))
+		c.observed++
+		// statuses sent before the observed one were superseded without being seen
+		for seq := range c.sent {
+			if seq < status.Offset {
+				c.dropped++
+			}
+			if seq <= status.Offset {
+				delete(c.sent, seq)
+			}
+		}
+	}
+}
+
+func (c *benchClient) send(conn *client.Client) error {
+	c.lock.Lock()
+	c.seq++
+	seq := c.seq
+	c.sent[seq] = time.Now()
+	c.lock.Unlock()
+
+	return conn.SendStatus(seq, grog.PLAYING_STATUS)
+}
+
+// Run a client until ctx is done, sending statuses every interval
+func (c *benchClient) run(ctx context.Context, conn *client.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.Done():
+			c.lock.Lock()
+			c.errors++
+			c.lock.Unlock()
+			return
+		case <-ticker.C:
+			if err := c.send(conn); err != nil {
+				c.lock.Lock()
+				c.errors++
+				c.lock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(int(float64(len(sorted))*p), len(sorted)-1)]
+}
+
+// Fetch statistics from a server started with -stats
+func fetchStats(addr string) (server.Stats, error) {
+	var stats server.Stats
+	resp, err := http.Get("http://" + addr + "/debug/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("stats responded with %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
+
+// Spawn synthetic clients across rooms and report latency and allocation statistics
+func bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	numClients := flags.Int("clients", 16, "number of synthetic clients")
+	numRooms := flags.Int("rooms", 1, "number of rooms to spread clients across")
+	interval := flags.Duration("interval", 1*time.Second, "time between statuses sent by each client")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send statuses")
+	transport := flags.String("transport", "ws", "transport to connect with (ws, unix, both)")
+	addr := flags.String("addr", "", "address of the http server to benchmark (default start an in-process server)")
+	baseDir := flags.String("b", "/tmp/grogbarrel", "base directory of the socket server to benchmark")
+	concurrency := flags.Int("concurrency", 64, "maximum number of concurrent dials")
+	loglvl := flags.String("l", "error", "log level (debug, info, warn, error)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *numClients < 1 || *numRooms < 1 || *concurrency < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	logger := newLogger(*loglvl, os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	inProcess := *addr == ""
+	if inProcess {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Error("Unable to listen", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		srv := http.Server{Handler: server.New(newLogger("error", io.Discard))}
+		go srv.Serve(ln)
+		defer srv.Close()
+		*addr = ln.Addr().String()
+
+		if *transport != "ws" {
+			dir, err := os.MkdirTemp("", "grogbench")
+			if err != nil {
+				logger.Error("Unable to create socket directory", slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+			defer os.RemoveAll(dir)
+			*baseDir = dir
+
+			sockServer := server.NewSockServer(dir, newLogger("error", io.Discard))
+			go sockServer.Run(ctx)
+			for range 100 {
+				if _, err := os.Stat(filepath.Join(dir, "join.sock")); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	var before server.Stats
+	var statsErr error
+	if inProcess {
+		before = server.ReadStats()
+	} else {
+		before, statsErr = fetchStats(*addr)
+	}
+
+	clients := make([]*benchClient, *numClients)
+	conns := make([]*client.Client, *numClients)
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	dialStart := time.Now()
+	for i := range *numClients {
+		c := &benchClient{name: fmt.Sprintf("bench-%d", i), id: -1, sent: make(map[uint16]time.Time)}
+		clients[i] = c
+
+		cfg := client.Config{
+			Transport: client.WEBSOCKET_TRANSPORT,
+			Addr:      *addr,
+			Room:      fmt.Sprintf("bench-%d", i%*numRooms),
+			Name:      c.name,
+			Logger:    logger,
+		}
+		if *transport == "unix" || (*transport == "both" && i%2 == 1) {
+			cfg.Transport = client.UNIX_TRANSPORT
+			cfg.Addr = *baseDir
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			conn, err := client.Dial(ctx, cfg, client.Handler{
+				OnAnnounce: c.onAnnounce,
+				OnStatus:   c.onStatus,
+			})
+			if err != nil {
+				logger.Warn("Failed to connect", slog.String("client", c.name), slog.String("err", err.Error()))
+				return
+			}
+			conns[i] = conn
+		}()
+	}
+	wg.Wait()
+	dialTime := time.Since(dialStart)
+
+	runCtx, stop := context.WithTimeout(ctx, *duration)
+	defer stop()
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clients[i].run(runCtx, conn, *interval)
+		}()
+	}
+	wg.Wait()
+	// let in flight statuses arrive
+	time.Sleep(min(*interval, 2*time.Second))
+
+	var after server.Stats
+	if inProcess {
+		after = server.ReadStats()
+	} else if statsErr == nil {
+		after, statsErr = fetchStats(*addr)
+	}
+
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	totals := benchTotals{}
+	for i, c := range clients {
+		if conns[i] == nil {
+			totals.failed++
+			continue
+		}
+		totals.connected++
+		c.lock.Lock()
+		totals.sent += int(c.seq)
+		totals.frames += c.frames
+		totals.observed += c.observed
+		totals.dropped += c.dropped
+		totals.pending += len(c.sent)
+		totals.errors += c.errors
+		totals.latencies = append(totals.latencies, c.latencies...)
+		c.lock.Unlock()
+	}
+	slices.Sort(totals.latencies)
+
+	fmt.Printf("clients:     %d across %d rooms over %s\n", *numClients, *numRooms, *transport)
+	fmt.Printf("connections: %d succeeded, %d failed in %s\n", totals.connected, totals.failed, dialTime.Truncate(time.Millisecond))
+	fmt.Printf("statuses:    %d sent, %d observed, %d dropped, %d unobserved at exit\n",
+		totals.sent, totals.observed, totals.dropped, totals.pending)
+	fmt.Printf("frames:      %d recieved, %d connection errors\n", totals.frames, totals.errors)
+	fmt.Printf("latency:     p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(totals.latencies, 0.5).Truncate(time.Microsecond),
+		percentile(totals.latencies, 0.9).Truncate(time.Microsecond),
+		percentile(totals.latencies, 0.99).Truncate(time.Microsecond),
+		percentile(totals.latencies, 1).Truncate(time.Microsecond),
+	)
+
+	if statsErr != nil {
+		fmt.Println("server:      statistics unavailable, start the server with -stats:", statsErr)
+		return
+	}
+	label := "server:     "
+	if inProcess {
+		label = "in-process: "
+	}
+	fmt.Printf("%s %d rooms, %d connections, %d goroutines\n", label, after.Rooms, after.Connections, after.Goroutines)
+	fmt.Printf("allocations: %d bytes, %d objects, heap in use %d bytes, %d gc cycles (%s paused)\n",
+		after.TotalAlloc-before.TotalAlloc,
+		after.Mallocs-before.Mallocs,
+		after.HeapInuse,
+		after.NumGC-before.NumGC,
+		time.Duration(after.PauseTotal-before.PauseTotal),
+	)
+	if inProcess {
+		fmt.Println("             in-process allocations include the synthetic clients")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/player"
+)
+
+// Flags shared by subcommands that connect to a room
+type clientFlags struct {
+	name      *string
+	room      *string
+	transport *string
+	addr      *string
+	baseDir   *string
+	loglvl    *string
+	updates   *time.Duration
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		name:      flags.String("n", "", "client name"),
+		room:      flags.String("r", "", "room name"),
+		transport: flags.String("transport", "ws", "transport to connect with (ws, unix)"),
+		addr:      flags.String("addr", "localhost:8080", "address of the http server"),
+		baseDir:   flags.String("b", "/tmp/grogbarrel", "base directory of the socket server"),
+		loglvl:    flags.String("l", "warn", "log level (debug, info, warn, error)"),
+		updates:   flags.Duration("update-interval", 0, "preferred interval of the room's statuses (default the server's)"),
+	}
+}
+
+// Build a reconnecting client config from parsed flags, exiting on invalid flags
+func (f *clientFlags) config(flags *flag.FlagSet, logOutput io.Writer) client.Config {
+	if *f.name == "" || *f.room == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg := client.Config{
+		Addr:      *f.addr,
+		Room:      *f.room,
+		Name:      *f.name,
+		Reconnect: true,
+		Interval:  *f.updates,
+		Logger:    newLogger(*f.loglvl, logOutput),
+	}
+	switch *f.transport {
+	case "ws":
+		cfg.Transport = client.WEBSOCKET_TRANSPORT
+	case "unix":
+		cfg.Transport = client.UNIX_TRANSPORT
+		cfg.Addr = *f.baseDir
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown transport:", *f.transport)
+		os.Exit(2)
+	}
+
+	return cfg
+}
+
+// Flags shared by subcommands that bridge a media player to a room
+type bridgeFlags struct {
+	leader    *string
+	tolerance *uint
+	interval  *time.Duration
+}
+
+func addBridgeFlags(flags *flag.FlagSet) *bridgeFlags {
+	return &bridgeFlags{
+		leader:    flags.String("follow", "", "name of the member to follow (default lowest id)"),
+		tolerance: flags.Uint("tolerance", 2, "seconds the player may drift from the leader before seeking"),
+		interval:  flags.Duration("interval", 1*time.Second, "how often the player is polled"),
+	}
+}
+
+func (f *bridgeFlags) bridge(p player.Player, logger *slog.Logger) *player.Bridge {
+	return &player.Bridge{
+		Player:    p,
+		Leader:    *f.leader,
+		Tolerance: uint16(min(*f.tolerance, 65535)),
+		Interval:  *f.interval,
+		Logger:    logger,
+	}
+}
@@ -5,35 +5,93 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/jpappel/grog_barrel/pkg/cluster"
 	"github.com/jpappel/grog_barrel/pkg/server"
 	"github.com/jpappel/grog_barrel/pkg/util"
 )
 
-func main() {
-	port := flag.Int("port", 8080, "port to listen on")
-	hostname := flag.String("hostname", "localhost", "hostname to listen on")
-	loglvl := flag.String("l", "warn", "log level (debug, info, warn, error)")
-	socksrv := flag.Bool("sockserver", false, "EXPERIMENTAL: enable unix socket server")
-	sockBaseDir := flag.String("sock-base-dir", "/tmp/grogbarrel", "base directory for socket server")
+// Define a flag for an octal file mode
+func fileModeFlag(name string, value fs.FileMode, usage string) *fs.FileMode {
+	mode := new(fs.FileMode)
+	*mode = value
+	flag.Func(name, fmt.Sprintf("%s (default %#o)", usage, value), func(s string) error {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return err
+		} else if m > 0777 {
+			return errors.New("mode must be at most 0777")
+		}
+		*mode = fs.FileMode(m)
+		return nil
+	})
+	return mode
+}
 
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, "Options:")
-		flag.PrintDefaults()
-		fmt.Fprintln(os.Stderr, "grogbarrel", util.ServerVersion.String())
+// Sort listeners passed by systemd into the http and join.sock listeners.
+//
+// Listeners are matched by their name in LISTEN_FDNAMES ("http" or "join"),
+// otherwise the first stream socket is used for http and the first unix socket for join.sock.
+func activationListeners(logger *slog.Logger) (net.Listener, *net.UnixListener) {
+	listeners, err := util.ActivationListeners()
+	if err != nil {
+		logger.Error("Failed to use socket activated listeners", slog.String("err", err.Error()))
+		panic(err)
 	}
-	flag.Parse()
 
+	var httpLn net.Listener
+	var joinLn *net.UnixListener
+	for _, l := range listeners {
+		unixLn, isUnix := l.Listener.(*net.UnixListener)
+		switch {
+		case l.Name == "join" && isUnix:
+			joinLn = unixLn
+		case l.Name == "http":
+			httpLn = l.Listener
+		case isUnix && joinLn == nil:
+			joinLn = unixLn
+		case !isUnix && httpLn == nil:
+			httpLn = l.Listener
+		default:
+			logger.Warn("Ignoring unused socket activated listener",
+				slog.String("name", l.Name),
+				slog.String("addr", l.Listener.Addr().String()),
+			)
+			l.Listener.Close()
+		}
+	}
+
+	return httpLn, joinLn
+}
+
+// Remove the contents of a socket directory except for keep
+func removeSockDir(dir string, keep string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != keep {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// Create a logger for a log level (debug, info, warn, error)
+func newLogger(loglvl string, w io.Writer) *slog.Logger {
 	loggerOpts := new(slog.HandlerOptions)
-	switch *loglvl {
+	switch loglvl {
 	case "debug":
 		loggerOpts.Level = slog.LevelDebug
 		loggerOpts.AddSource = true
@@ -44,23 +102,201 @@ func main() {
 	case "error":
 		loggerOpts.Level = slog.LevelError
 	default:
-		panic(fmt.Sprintf("Unkown log level %s", *loglvl))
+		panic(fmt.Sprintf("Unkown log level %s", loglvl))
+	}
+	return slog.New(slog.NewTextHandler(w, loggerOpts))
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "join":
+			join(os.Args[2:])
+			return
+		case "mpv":
+			mpv(os.Args[2:])
+			return
+		case "vlc":
+			vlc(os.Args[2:])
+			return
+		case "mpris":
+			mpris(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "vectors":
+			vectors(os.Args[2:])
+			return
+		}
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, loggerOpts))
+
+	serve()
+}
+
+func serve() {
+	port := flag.Int("port", 8080, "port to listen on")
+	hostname := flag.String("hostname", "localhost", "hostname to listen on")
+	loglvl := flag.String("l", "warn", "log level (debug, info, warn, error)")
+	socksrv := flag.Bool("sockserver", false, "EXPERIMENTAL: enable unix socket server")
+	sockBaseDir := flag.String("sock-base-dir", "/tmp/grogbarrel", "base directory for socket server")
+	sockDirMode := fileModeFlag("sock-dir-mode", 0755, "permissions of the socket server base directory")
+	stats := flag.Bool("stats", false, "serve room and allocation statistics on /debug/stats")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "time to wait for clients to disconnect when shutting down")
+	snapshotFile := flag.String("snapshot", "", "persist rooms to this file and restore them on start")
+	snapshotInterval := flag.Duration("snapshot-interval", 30*time.Second, "how often rooms are persisted")
+	redisUrl := flag.String("redis", "", "share rooms with other instances through redis (redis://[:password@]host:port[/db])")
+	redisPrefix := flag.String("redis-prefix", "grogbarrel:", "prefix of the keys stored in redis")
+	var webhooks []server.Webhook
+	flag.Func("webhook", "POST room events to a url (url[,secret=SECRET][,events=EVENT+EVENT]), may be repeated",
+		func(spec string) error {
+			hook, err := server.ParseWebhook(spec)
+			if err != nil {
+				return err
+			}
+			webhooks = append(webhooks, hook)
+			return nil
+		})
+	moderatorToken := flag.String("moderator-token", "", "token permitted to kick, ban and mute members of every room")
+	recordDir := flag.String("record-dir", "", "record every room's frames to a file in this directory")
+	sockRoomDirMode := fileModeFlag("sock-room-dir-mode", 0775, "permissions of the socket server room directories")
+	flag.Func("room-acl", "restrict a room to users and groups (room=user,@group,...), may be repeated",
+		func(spec string) error {
+			name, acl, err := server.ParseRoomACL(spec)
+			if err != nil {
+				return err
+			}
+			server.Rooms.SetACL(name, acl)
+			return nil
+		})
+	flag.Func("room-auto-pause", "pause a room while a member loads longer than a threshold (room=threshold[,stalls=N][,wait=DURATION]), may be repeated",
+		func(spec string) error {
+			name, policy, err := server.ParseRoomAutoPause(spec)
+			if err != nil {
+				return err
+			}
+			server.Rooms.SetAutoPause(name, policy)
+			return nil
+		})
+	flag.Func("tick-rate", "how often rooms send statuses, adaptive with idle (interval[,idle=DURATION]) (default 1s)",
+		func(spec string) error {
+			rate, err := server.ParseTickRate(spec)
+			if err != nil {
+				return err
+			}
+			server.Rooms.DefaultTickRate = rate
+			return nil
+		})
+	flag.Func("room-tick-rate", "how often a room sends statuses (room=interval[,idle=DURATION]), may be repeated",
+		func(spec string) error {
+			name, rate, err := server.ParseRoomTickRate(spec)
+			if err != nil {
+				return err
+			}
+			server.Rooms.SetTickRate(name, rate)
+			return nil
+		})
+
+	flag.Func("heartbeat", "how often members are pinged, then marked stale and evicted when silent (interval[,stale=DURATION][,evict=DURATION], 0 disables) (default 15s,stale=30s,evict=1m)",
+		func(spec string) error {
+			policy, err := server.ParseHeartbeat(spec)
+			if err != nil {
+				return err
+			}
+			server.Rooms.Heartbeat = policy
+			return nil
+		})
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s join [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s mpv [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s vlc [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s mpris [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s replay [options] RECORDING\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s bench [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s vectors\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "grogbarrel", util.ServerVersion.String())
+	}
+	flag.Parse()
+
+	logger := newLogger(*loglvl, os.Stdout)
 
 	addr := fmt.Sprintf("%s:%d", *hostname, *port)
 
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0755); err != nil {
+			logger.Error("Unable to create record directory", slog.String("err", err.Error()))
+			panic(err)
+		}
+		server.Rooms.SetRecordDir(*recordDir)
+	}
+
+	// the backend outlives baseCtx so members can leave during shutdown
+	backendCtx, cancelBackend := context.WithCancel(context.Background())
+	defer cancelBackend()
+	if *redisUrl != "" {
+		ctx, cancel := context.WithTimeout(backendCtx, 10*time.Second)
+		backend, err := cluster.DialRedis(ctx, *redisUrl, *redisPrefix, logger)
+		cancel()
+		if err != nil {
+			logger.Error("Unable to connect to redis", slog.String("err", err.Error()))
+			panic(err)
+		}
+		defer backend.Close()
+		go backend.Run(backendCtx)
+		server.Rooms.Backend = backend
+	}
+
+	server.Rooms.ModeratorToken = *moderatorToken
+
+	var hooks *server.Webhooks
+	if len(webhooks) > 0 {
+		hooks = server.NewWebhooks(webhooks, logger)
+		server.Rooms.Webhooks = hooks
+		go hooks.Run(backendCtx)
+	}
+
+	if *snapshotFile != "" {
+		server.Rooms.Store = server.FileStore{Path: *snapshotFile}
+		if err := server.Rooms.Restore(logger); err != nil {
+			logger.Error("Unable to restore rooms", slog.String("err", err.Error()))
+			panic(err)
+		}
+	}
+
 	baseCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if *socksrv {
+	httpLn, joinLn := activationListeners(logger)
+	if joinLn != nil {
+		*socksrv = true
+		*sockBaseDir = filepath.Dir(joinLn.Addr().String())
+		logger.Info("Using socket activated join socket",
+			slog.String("sockAddr", joinLn.Addr().String()),
+		)
+	}
+
+	if *socksrv && joinLn != nil {
+		// the socket and its directory belong to systemd
+		defer removeSockDir(*sockBaseDir, filepath.Base(joinLn.Addr().String()))
+	} else if *socksrv {
 		pid := os.Getpid()
 		if _, err := os.Stat(*sockBaseDir); errors.Is(err, fs.ErrNotExist) {
-			err := os.Mkdir(*sockBaseDir, 0755)
+			err := os.Mkdir(*sockBaseDir, *sockDirMode)
 			if err != nil && errors.Is(err, fs.ErrExist) {
 				logger.Error("Error occured while creating base dir")
 				panic(err)
 			}
+			// mkdir is subject to the umask
+			if err := os.Chmod(*sockBaseDir, *sockDirMode); err != nil {
+				panic(err)
+			}
 
 			file, err := os.Create(*sockBaseDir + "/pid")
 			if err != nil {
@@ -75,16 +311,47 @@ func main() {
 			}
 		}
 		defer os.RemoveAll(*sockBaseDir)
+	}
 
+	// the socket server outlives baseCtx so its clients can be told about the shutdown
+	sockCtx, cancelSock := context.WithCancel(context.Background())
+	defer cancelSock()
+	sockDone := make(chan struct{})
+	if *socksrv {
 		logger.Info("Starting socket server")
 		sockServer := server.NewSockServer(*sockBaseDir, logger)
-		go sockServer.Run(baseCtx)
+		sockServer.RoomDirMode = *sockRoomDirMode
+		sockServer.Listener = joinLn
+		go func() {
+			sockServer.Run(sockCtx)
+			close(sockDone)
+		}()
+	} else {
+		close(sockDone)
+	}
+
+	if *snapshotFile != "" {
+		go server.Rooms.RunSnapshots(baseCtx, *snapshotInterval, logger)
 	}
 
-	srv := http.Server{Addr: addr, Handler: server.New(logger)}
+	mux := server.New(logger)
+	if *stats {
+		mux.HandleFunc("/debug/stats", server.StatsHandler)
+		if hooks != nil {
+			mux.HandleFunc("/debug/webhooks", hooks.DeliveriesHandler)
+		}
+	}
+	srv := http.Server{Addr: addr, Handler: mux}
 	go func() {
-		logger.Info("Starting server", slog.String("bindAddress", addr))
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed && err != nil {
+		var err error
+		if httpLn != nil {
+			logger.Info("Starting server", slog.String("bindAddress", httpLn.Addr().String()))
+			err = srv.Serve(httpLn)
+		} else {
+			logger.Info("Starting server", slog.String("bindAddress", addr))
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed && err != nil {
 			logger.Error("Server error", slog.String("err", err.Error()))
 		}
 	}()
@@ -92,12 +359,21 @@ func main() {
 	<-baseCtx.Done()
 
 	logger.Info("Shutting down server")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
 
+	// notify members and wait for them to leave, then close the listeners
+	if err := server.Rooms.Shutdown(ctx); err != nil {
+		logger.Warn("Clients still connected after shutdown timeout", slog.String("err", err.Error()))
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Error("Error shutting down server", slog.String("err", err.Error()))
-	} else {
+	}
+	cancelSock()
+	select {
+	case <-sockDone:
 		logger.Info("Server shutdown succesfully")
+	case <-ctx.Done():
+		logger.Error("Socket server did not stop before shutdown timeout")
 	}
 }
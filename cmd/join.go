@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+const seekStep = 5
+
+// A room member as seen by the terminal client
+type member struct {
+	id     uint16
+	name   string
+	status grog.ClientStatusMessage
+	seen   bool // a status has been recieved for the member
+	muted  bool // the room ignores the member's statuses
+	stale  bool // the member missed heartbeats
+}
+
+// State shared between the terminal and the client's read goroutine
+type joinState struct {
+	sync.Mutex
+	name       string
+	room       string
+	addr       string
+	members    []*member
+	spectators uint16
+	queue      grog.QueueMessage
+	ready      grog.ReadyMessage
+	countdown  time.Time // local time play starts after a ready check, zero without a countdown
+	pause      grog.PauseMessage
+	resumePlay bool // the local player was playing when the room paused
+	selected   int
+	connected  bool
+	info       string
+	err        string
+
+	// simulated local player
+	state   grog.PlayerState
+	offset  float64
+	updated time.Time
+}
+
+// Current local offset in seconds
+func (s *joinState) position(now time.Time) float64 {
+	if s.state == grog.PLAYING_STATUS {
+		return s.offset + now.Sub(s.updated).Seconds()
+	}
+	return s.offset
+}
+
+func (s *joinState) setState(state grog.PlayerState, now time.Time) {
+	s.offset = s.position(now)
+	s.updated = now
+	s.state = state
+}
+
+func (s *joinState) seek(offset float64, now time.Time) {
+	s.offset = min(max(offset, 0), 65535)
+	s.updated = now
+}
+
+func (s *joinState) status(now time.Time) grog.ClientStatusMessage {
+	return grog.ClientStatusMessage{
+		Offset:      uint16(s.position(now)),
+		PlayerState: s.state,
+	}
+}
+
+func (s *joinState) onAnnounce(msg grog.ServerAnnounceMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	members := make([]*member, 0, len(msg.Clients))
+	for _, c := range msg.Clients {
+		m := &member{
+			id:    c.Id,
+			name:  c.Name,
+			muted: slices.Contains(msg.Muted, c.Id),
+			stale: slices.Contains(msg.Stale, c.Id),
+		}
+		// keep statuses of members that are still present
+		i := slices.IndexFunc(s.members, func(old *member) bool {
+			return old.id == c.Id && old.name == c.Name
+		})
+		if i >= 0 {
+			m.status, m.seen = s.members[i].status, s.members[i].seen
+		}
+		members = append(members, m)
+	}
+	slices.SortFunc(members, func(a, b *member) int { return int(a.id) - int(b.id) })
+
+	s.members = members
+	s.spectators = msg.Spectators
+	s.selected = min(s.selected, max(len(members)-1, 0))
+	s.info = "recieved serverAnnounce"
+}
+
+func (s *joinState) onStatus(msg grog.ServerStatusMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, status := range msg.Statuses {
+		// statuses for members missing from the last announce are ignored
+		i := slices.IndexFunc(s.members, func(m *member) bool { return m.id == status.Id })
+		if i >= 0 {
+			s.members[i].status = status
+			s.members[i].seen = true
+		}
+	}
+	s.info = "recieved serverStatus"
+}
+
+func (s *joinState) onQueue(msg grog.QueueMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the simulated player opens the new item from the start
+	if msg.Current != s.queue.Current {
+		s.seek(0, time.Now())
+	}
+	s.queue = msg
+	s.info = "recieved queue"
+}
+
+func (s *joinState) onReady(msg grog.ReadyMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.ready = msg
+	s.countdown = time.Time{}
+	s.info = "recieved ready check"
+}
+
+func (s *joinState) onCountdown(msg grog.CountdownMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the local clock may differ from the server's, start relative to when the countdown arrived
+	s.ready = grog.ReadyMessage{}
+	s.countdown = time.Now().Add(time.Duration(msg.Remaining) * time.Millisecond)
+	s.info = "recieved countdown"
+}
+
+func (s *joinState) onPause(msg grog.PauseMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if msg.Paused && s.state == grog.PLAYING_STATUS {
+		s.setState(grog.PAUSED_STATUS, now)
+		s.resumePlay = true
+	} else if !msg.Paused && s.resumePlay {
+		s.setState(grog.PLAYING_STATUS, now)
+		s.resumePlay = false
+	}
+	s.pause = msg
+	s.info = "recieved pause"
+}
+
+// Start playing once the countdown ends
+func (s *joinState) startCountdown(now time.Time) {
+	if s.countdown.IsZero() || now.Before(s.countdown) {
+		return
+	}
+	s.setState(grog.PLAYING_STATUS, s.countdown)
+	s.countdown = time.Time{}
+}
+
+// Parse a queue item of the form title,location[,duration]
+func parseQueueItem(spec string) (grog.QueueItem, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || len(parts[0]) > 255 || len(parts[1]) > 65535 {
+		return grog.QueueItem{}, fmt.Errorf("invalid queue item %q", spec)
+	}
+	item := grog.QueueItem{Title: parts[0], Location: parts[1]}
+	if len(parts) == 3 {
+		duration, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return item, fmt.Errorf("invalid queue item duration %q", parts[2])
+		}
+		item.Duration = uint16(duration)
+	}
+	return item, nil
+}
+
+func formatOffset(seconds int) string {
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%d:%02d:%02d", sign, seconds/3600, seconds/60%60, seconds%60)
+}
+
+func (s *joinState) render(w io.Writer, cols int, rows int) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.startCountdown(now)
+	b := new(strings.Builder)
+
+	left := fmt.Sprintf("%s [%s]", s.name, s.room)
+	right := "Offline " + now.Format(time.TimeOnly)
+	if s.connected {
+		right = "Online " + now.Format(time.TimeOnly)
+	}
+	fmt.Fprintf(b, "%s%*s\n\n", left, max(cols-len(left), len(right)+1), right)
+
+	fmt.Fprintf(b, "%d Members, %d Spectators\n", len(s.members), s.spectators)
+	local := s.position(now)
+	for i, m := range s.members {
+		cursor := "  "
+		if i == s.selected {
+			cursor = "> "
+		}
+		flags := ""
+		if m.muted {
+			flags = " muted"
+		}
+		if m.stale {
+			flags += " stale"
+		}
+		if !m.seen {
+			fmt.Fprintf(b, "%s#%-5d %-20.20s %-8s%s\n", cursor, m.id, m.name, "-", flags)
+			continue
+		}
+		status := m.status
+		diff := int(status.Offset) - int(local)
+		fmt.Fprintf(b, "%s#%-5d %-20.20s %-8s %s (%+ds)%s\n", cursor, m.id, m.name,
+			status.PlayerState,
+			formatOffset(int(status.Offset)), diff, flags,
+		)
+	}
+	if int(s.queue.Current) < len(s.queue.Items) {
+		item := s.queue.Items[s.queue.Current]
+		fmt.Fprintf(b, "\nQueue %d/%d: %s (%s)\n", s.queue.Current+1, len(s.queue.Items), item.Title, item.Location)
+	} else if len(s.queue.Items) > 0 {
+		fmt.Fprintf(b, "\nQueue finished\n")
+	}
+	if s.ready.Active {
+		waiting := make([]string, 0, len(s.ready.Waiting))
+		for _, id := range s.ready.Waiting {
+			waiting = append(waiting, fmt.Sprintf("#%d", id))
+		}
+		fmt.Fprintf(b, "\nReady check, waiting on %s\n", strings.Join(waiting, " "))
+	} else if !s.countdown.IsZero() {
+		fmt.Fprintf(b, "\nStarting in %.1fs\n", s.countdown.Sub(now).Seconds())
+	}
+	if s.pause.Paused {
+		fmt.Fprintf(b, "\nPaused while #%d loads\n", s.pause.Id)
+	}
+	if s.err != "" {
+		fmt.Fprintf(b, "\nError: %s\n", s.err)
+	}
+
+	body := b.String()
+	footer := fmt.Sprintf("local: %s %s\n", s.state, formatOffset(int(local))) +
+		"[space] play/pause  [b] loading  [</>] seek  [j/k] select  [enter] jump to member  [n] next  [c/x] ready check  [r] ready  [q] quit\n" +
+		fmt.Sprintf("| grogbarrel %s | %s : %s", util.ServerVersion.String(), s.addr, s.info)
+
+	padding := max(rows-strings.Count(body, "\n")-strings.Count(footer, "\n")-1, 1)
+
+	fmt.Fprint(w, "\033[H\033[2J", body, strings.Repeat("\n", padding), footer)
+}
+
+// Keys that start, cancel or answer the room's ready check
+var readyKeys = map[byte]grog.ReadyOp{
+	'c': grog.READY_START,
+	'x': grog.READY_CANCEL,
+	'r': grog.READY_DONE,
+}
+
+// Read keypresses from r, translating arrow keys into their vi equivalents
+func readKeys(r io.Reader, keys chan<- byte) {
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			if buf[i] == '\033' && i+2 < n && buf[i+1] == '[' {
+				switch buf[i+2] {
+				case 'A':
+					keys <- 'k'
+				case 'B':
+					keys <- 'j'
+				case 'C':
+					keys <- '>'
+				case 'D':
+					keys <- '<'
+				}
+				i += 2
+				continue
+			}
+			keys <- buf[i]
+		}
+	}
+}
+
+// Apply a keypress to the local player, returning false to quit
+func (s *joinState) handleKey(key byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	switch key {
+	case 'q':
+		return false
+	case ' ':
+		if s.state == grog.PLAYING_STATUS {
+			s.setState(grog.PAUSED_STATUS, now)
+		} else {
+			s.setState(grog.PLAYING_STATUS, now)
+		}
+	case 'b':
+		if s.state == grog.LOADING_STATUS {
+			s.setState(grog.PAUSED_STATUS, now)
+		} else {
+			s.setState(grog.LOADING_STATUS, now)
+		}
+	case '<', ',':
+		s.seek(s.position(now)-seekStep, now)
+	case '>', '.':
+		s.seek(s.position(now)+seekStep, now)
+	case 'k':
+		s.selected = max(s.selected-1, 0)
+	case 'j':
+		s.selected = min(s.selected+1, max(len(s.members)-1, 0))
+	case '\r', '\n', 's':
+		if s.selected < len(s.members) && s.members[s.selected].seen {
+			m := s.members[s.selected]
+			s.seek(float64(m.status.Offset), now)
+			s.setState(m.status.PlayerState, now)
+		}
+	}
+	return true
+}
+
+// Join a room as an interactive terminal client
+func join(args []string) {
+	flags := flag.NewFlagSet("join", flag.ExitOnError)
+	clientFlags := addClientFlags(flags)
+	logFile := flags.String("log", "", "file to write logs to")
+	spectate := flags.Bool("spectate", false, "watch the room without joining it")
+	var enqueue []grog.QueueItem
+	flags.Func("queue", "add an item to the room's queue (title,location[,duration seconds]), may be repeated",
+		func(spec string) error {
+			item, err := parseQueueItem(spec)
+			if err != nil {
+				return err
+			}
+			enqueue = append(enqueue, item)
+			return nil
+		})
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s join [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	logOutput := io.Discard
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to open log file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logOutput = f
+	}
+	cfg := clientFlags.config(flags, logOutput)
+	cfg.Spectate = *spectate
+
+	state := &joinState{
+		name:    cfg.Name,
+		room:    cfg.Room,
+		addr:    cfg.Addr,
+		state:   grog.PAUSED_STATUS,
+		updated: time.Now(),
+	}
+	redraw := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case redraw <- struct{}{}:
+		default:
+		}
+	}
+	logger := cfg.Logger
+	handler := client.Handler{
+		OnAnnounce: func(msg grog.ServerAnnounceMessage) {
+			state.onAnnounce(msg)
+			notify()
+		},
+		OnStatus: func(msg grog.ServerStatusMessage) {
+			state.onStatus(msg)
+			notify()
+		},
+		OnQueue: func(msg grog.QueueMessage) {
+			state.onQueue(msg)
+			notify()
+		},
+		OnReady: func(msg grog.ReadyMessage) {
+			state.onReady(msg)
+			notify()
+		},
+		OnCountdown: func(msg grog.CountdownMessage) {
+			state.onCountdown(msg)
+			notify()
+		},
+		OnPause: func(msg grog.PauseMessage) {
+			state.onPause(msg)
+			notify()
+		},
+		OnError: func(msg string) {
+			state.Lock()
+			state.err = msg
+			state.Unlock()
+			notify()
+		},
+		OnReconnect: func() {
+			state.Lock()
+			state.info = "reconnected"
+			state.Unlock()
+			notify()
+		},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	c, err := client.Dial(ctx, cfg, handler)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to join room:", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+	state.Lock()
+	state.connected = true
+	state.info = "Succesfully connected to " + cfg.Transport.String() + " server"
+	state.Unlock()
+
+	stdin := int(os.Stdin.Fd())
+	if restore, err := makeRaw(stdin); err == nil {
+		defer restore()
+	} else {
+		logger.Warn("Unable to enter raw mode, keys must be followed by enter",
+			slog.String("err", err.Error()),
+		)
+	}
+	fmt.Print("\033[?25l")
+	defer fmt.Print("\033[?25h\n")
+
+	keys := make(chan byte, 16)
+	go readKeys(os.Stdin, keys)
+
+	// members recieve statuses in reply to their own
+	statusTicker := time.NewTicker(grog.ClampTick(cfg.Interval))
+	defer statusTicker.Stop()
+	renderTicker := time.NewTicker(250 * time.Millisecond)
+	defer renderTicker.Stop()
+
+	sendStatus := func() {
+		state.Lock()
+		now := time.Now()
+		state.startCountdown(now)
+		status := state.status(now)
+		state.Unlock()
+		if err := c.SendStatus(status.Offset, status.PlayerState); err != nil {
+			logger.Debug("Unable to send status", slog.String("err", err.Error()))
+		}
+	}
+	sendStatus()
+	for _, item := range enqueue {
+		if err := c.SendQueue(grog.ClientQueueMessage{Op: grog.QUEUE_ADD, Item: item}); err != nil {
+			logger.Warn("Unable to add to queue", slog.String("err", err.Error()))
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.Done():
+			state.Lock()
+			state.connected = false
+			state.Unlock()
+			cols, rows := 80, 24
+			if w, h, err := termSize(int(os.Stdout.Fd())); err == nil {
+				cols, rows = w, h
+			}
+			state.render(os.Stdout, cols, rows)
+			fmt.Fprintln(os.Stderr, "\nDisconnected:", c.Err())
+			return
+		case key, ok := <-keys:
+			if !ok || !state.handleKey(key) {
+				return
+			} else if key == 'n' {
+				if err := c.SendQueue(grog.ClientQueueMessage{Op: grog.QUEUE_ADVANCE}); err != nil {
+					logger.Debug("Unable to advance queue", slog.String("err", err.Error()))
+				}
+			} else if op, ok := readyKeys[key]; ok {
+				if err := c.SendReady(op); err != nil {
+					logger.Debug("Unable to send ready check", slog.String("err", err.Error()))
+				}
+			}
+			sendStatus()
+		case <-statusTicker.C:
+			sendStatus()
+		case <-renderTicker.C:
+		case <-redraw:
+		}
+
+		cols, rows := 80, 24
+		if w, h, err := termSize(int(os.Stdout.Fd())); err == nil {
+			cols, rows = w, h
+		}
+		state.render(os.Stdout, cols, rows)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jpappel/grog_barrel/pkg/player"
+)
+
+// Synchronize an MPRIS capable player with a room
+func mpris(args []string) {
+	flags := flag.NewFlagSet("mpris", flag.ExitOnError)
+	clientFlags := addClientFlags(flags)
+	bus := flags.String("bus", "", "dbus address (default $DBUS_SESSION_BUS_ADDRESS)")
+	playerName := flags.String("player", "", "MPRIS name of the player, e.g. vlc (default first player on the bus)")
+	bridgeFlags := addBridgeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mpris [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg := clientFlags.config(flags, os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	p, err := player.DialMpris(ctx, *bus, *playerName)
+	if err != nil {
+		cfg.Logger.Error("Unable to connect to MPRIS player", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	defer p.Close()
+	cfg.Logger.Info("Connected to MPRIS player", slog.String("player", p.Name))
+
+	bridge := bridgeFlags.bridge(p, cfg.Logger)
+	if err := bridge.Run(ctx, cfg); err != nil {
+		cfg.Logger.Error("Bridge stopped", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jpappel/grog_barrel/pkg/player"
+)
+
+// Synchronize an mpv instance with a room
+func mpv(args []string) {
+	flags := flag.NewFlagSet("mpv", flag.ExitOnError)
+	clientFlags := addClientFlags(flags)
+	socket := flags.String("socket", "", "path of mpv's --input-ipc-server socket")
+	bridgeFlags := addBridgeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mpv -socket PATH [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *socket == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cfg := clientFlags.config(flags, os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	p, err := player.DialMpv(ctx, *socket)
+	if err != nil {
+		cfg.Logger.Error("Unable to connect to mpv", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	defer p.Close()
+
+	bridge := bridgeFlags.bridge(p, cfg.Logger)
+	if err := bridge.Run(ctx, cfg); err != nil {
+		cfg.Logger.Error("Bridge stopped", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/server"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+// Describe a record for the replay timeline, malformed records are reported as ErrInvalidRecording
+func describeRecord(record grog.Record) (string, error) {
+	data := record.Data
+	invalid := fmt.Errorf("%w: malformed %s record", grog.ErrInvalidRecording, record.Kind)
+	switch record.Kind {
+	case grog.JOIN_RECORD, grog.LEAVE_RECORD:
+		if len(data) < 2 {
+			return "invalid", invalid
+		}
+		return fmt.Sprintf("#%d %s", binary.BigEndian.Uint16(data), data[2:]), nil
+	case grog.STATUS_RECORD:
+		if len(data) != 5 {
+			return "invalid", invalid
+		}
+		return fmt.Sprintf("#%d %s %d", binary.BigEndian.Uint16(data[3:]), grog.PlayerState(data[2]), binary.BigEndian.Uint16(data)), nil
+	case grog.ANNOUNCE_RECORD:
+		if len(data) == 0 {
+			return "invalid", invalid
+		}
+		msg, err := grog.ParseServerAnnounce(data[1:])
+		if err != nil {
+			return "invalid", invalid
+		}
+		return fmt.Sprint(msg.Clients), nil
+	case grog.SERVER_STATUS_RECORD:
+		if len(data) == 0 {
+			return "invalid", invalid
+		}
+		msg, err := grog.ParseServerStatus(data[1:])
+		if err != nil {
+			return "invalid", invalid
+		}
+		return fmt.Sprint(msg.Statuses), nil
+	default:
+		return fmt.Sprintf("%x", data), nil
+	}
+}
+
+// Wait for the room to build a new announcement and compare it to a recorded one
+func checkAnnounce(room *grog.Room, lastAnnounce int, recorded []byte, logger *slog.Logger) int {
+	updates := false
+	for range 10 {
+		if lastAnnounce, updates = room.Check(lastAnnounce); updates {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if announcement := room.Messages.Announcements(); !bytes.Equal(announcement, recorded) {
+		logger.Warn("Replayed announcement differs from recording",
+			slog.String("recorded", fmt.Sprintf("%x", recorded)),
+			slog.String("replayed", fmt.Sprintf("%x", announcement)),
+		)
+	}
+	return lastAnnounce
+}
+
+// Replay a recording into a fresh room, optionally serving it to live clients
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "playback speed, 0 replays without delays")
+	serve := flags.Bool("serve", false, "serve the replayed room to live clients")
+	port := flags.Int("port", 8080, "port to listen on when serving")
+	hostname := flags.String("hostname", "localhost", "hostname to listen on when serving")
+	loglvl := flags.String("l", "warn", "log level (debug, info, warn, error)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [options] RECORDING\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	logger := newLogger(*loglvl, os.Stderr)
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		logger.Error("Unable to open recording", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	defer f.Close()
+	reader, err := grog.NewRecordReader(f)
+	if err != nil {
+		logger.Error("Unable to read recording", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	room := grog.NewRoom(reader.RoomName, logger)
+	if *serve {
+		server.Rooms.Register(room)
+		addr := fmt.Sprintf("%s:%d", *hostname, *port)
+		srv := http.Server{Addr: addr, Handler: server.New(logger)}
+		go func() {
+			logger.Info("Starting server", slog.String("bindAddress", addr))
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed && err != nil {
+				logger.Error("Server error", slog.String("err", err.Error()))
+				cancel()
+			}
+		}()
+		defer srv.Close()
+	}
+
+	// recorded ids may differ from replayed ones when live clients have joined
+	ids := make(map[uint16]uint16)
+	clients := make(map[uint16]grog.Client)
+	lastAnnounce := 0
+
+	var start, prev time.Time
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			logger.Error("Unable to read record", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		if start.IsZero() {
+			start, prev = record.Time, record.Time
+		}
+		if *speed > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(float64(record.Time.Sub(prev)) / *speed)):
+			}
+		}
+		prev = record.Time
+		description, err := describeRecord(record)
+		fmt.Printf("%10s %-13s %s\n", record.Time.Sub(start).Truncate(time.Millisecond),
+			record.Kind, description)
+		if err != nil {
+			logger.Warn("Skipping record", slog.String("err", err.Error()))
+			continue
+		}
+
+		data := record.Data
+		switch record.Kind {
+		case grog.JOIN_RECORD:
+			if len(data) < 2 {
+				continue
+			}
+			recordedId := binary.BigEndian.Uint16(data)
+			client := grog.Client{
+				Name:    string(data[2:]),
+				Addr:    fmt.Sprintf("replay/%d", recordedId),
+				Version: util.ServerVersion,
+			}
+			id, err := room.Join(client)
+			if err != nil {
+				logger.Warn("Unable to replay join", slog.String("err", err.Error()))
+				continue
+			}
+			ids[recordedId] = id
+			clients[recordedId] = client
+		case grog.LEAVE_RECORD:
+			if len(data) != 2 {
+				continue
+			}
+			recordedId := binary.BigEndian.Uint16(data)
+			if id, ok := ids[recordedId]; ok {
+				room.Leave(id)
+				delete(ids, recordedId)
+				delete(clients, recordedId)
+			}
+		case grog.STATUS_RECORD:
+			if len(data) != 5 {
+				continue
+			}
+			recordedId := binary.BigEndian.Uint16(data[3:])
+			if id, ok := ids[recordedId]; ok {
+				room.Update(clients[recordedId], grog.ClientStatusMessage{
+					Offset:      binary.BigEndian.Uint16(data),
+					PlayerState: grog.PlayerState(data[2]),
+					Id:          id,
+				})
+			}
+		case grog.ANNOUNCE_RECORD:
+			// announcements are only deterministic without live clients
+			if !*serve {
+				lastAnnounce = checkAnnounce(room, lastAnnounce, data, logger)
+			}
+		}
+	}
+
+	if *serve {
+		logger.Info("Finished replay, serving until interrupted")
+		<-ctx.Done()
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoTerm = errors.New("terminal control is not supported on this platform")
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errNoTerm
+}
+
+func termSize(fd int) (int, int, error) {
+	return 0, 0, errNoTerm
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jpappel/grog_barrel/pkg/conformance"
+)
+
+// Check the grog parsers against the golden vectors and print them as json
+func vectors(args []string) {
+	fs := flag.NewFlagSet("vectors", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s vectors\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Print the protocol conformance vectors as json")
+	}
+	fs.Parse(args)
+
+	for _, v := range conformance.Vectors {
+		if err := conformance.Check(v); err != nil {
+			fmt.Fprintln(os.Stderr, "Vector failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := conformance.WriteJSON(os.Stdout, conformance.Vectors); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
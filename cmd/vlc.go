@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jpappel/grog_barrel/pkg/player"
+)
+
+// Synchronize a VLC instance with a room
+func vlc(args []string) {
+	flags := flag.NewFlagSet("vlc", flag.ExitOnError)
+	clientFlags := addClientFlags(flags)
+	vlcAddr := flags.String("vlc-addr", "localhost:9090", "address of VLC's http interface")
+	password := flags.String("password", os.Getenv("VLC_PASSWORD"), "password of VLC's http interface (default $VLC_PASSWORD)")
+	bridgeFlags := addBridgeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s vlc [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg := clientFlags.config(flags, os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	p := player.NewVlc(*vlcAddr, *password)
+	defer p.Close()
+
+	bridge := bridgeFlags.bridge(p, cfg.Logger)
+	if err := bridge.Run(ctx, cfg); err != nil {
+		cfg.Logger.Error("Bridge stopped", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+}
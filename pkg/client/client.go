@@ -0,0 +1,485 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+type Transport byte
+
+const (
+	WEBSOCKET_TRANSPORT Transport = iota
+	UNIX_TRANSPORT
+)
+
+var ErrClosed error = errors.New("client is closed")
+var ErrUnknownMessage error = errors.New("unknown message type")
+var ErrSpectator error = errors.New("spectators cannot send statuses")
+
+// Error message sent by a grogbarrel server
+type ServerError struct {
+	Msg string
+}
+
+// Sent by a server before it stops, members can resume once it restarts
+const SHUTDOWN_MESSAGE = "Server shutting down"
+
+type Config struct {
+	Transport Transport
+	// host:port of the http server, or the socket server's base directory
+	Addr string
+	Room string
+	Name string
+	// redial with backoff after the connection drops.
+	// Errors sent by the server, such as a full room or a ban, are not retried.
+	Reconnect  bool
+	MaxBackoff time.Duration
+	// token from a previous connection for rejoining with the same id
+	Resume string
+	// watch the room without joining it, statuses cannot be sent
+	Spectate bool
+	// preferred interval of the room's statuses, the server's default when 0
+	Interval time.Duration
+	// how often unix socket members and spectators send a heartbeat, web sockets answer the server's pings instead.
+	// grog.DefaultHeartbeat's interval when 0.
+	Heartbeat time.Duration
+	Logger    *slog.Logger
+}
+
+// Callbacks for messages recieved from the server, nil callbacks are ignored.
+// Callbacks are run on the client's read goroutine and should not block.
+type Handler struct {
+	OnAnnounce func(grog.ServerAnnounceMessage)
+	OnStatus   func(grog.ServerStatusMessage)
+	OnQueue    func(grog.QueueMessage)
+	OnReady    func(grog.ReadyMessage)
+	// called once every member is ready, play starts msg.Remaining milliseconds after it is recieved
+	OnCountdown func(grog.CountdownMessage)
+	// called when the room pauses for a loading member and when it resumes
+	OnPause func(grog.PauseMessage)
+	OnError func(string)
+	// called after the client reconnects
+	OnReconnect func()
+}
+
+type Client struct {
+	cfg     Config
+	handler Handler
+	logger  *slog.Logger
+
+	conn     conn
+	connLock sync.Mutex
+
+	token     string
+	tokenLock sync.Mutex
+
+	// room statuses rebuilt from status deltas since v2.5
+	statuses   map[uint16]grog.ClientStatusMessage
+	seq        uint32 // sequence of statuses, 0 asks the server for a keyframe
+	statusLock sync.Mutex
+
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+}
+
+// A framed connection to a grogbarrel server
+type conn interface {
+	// Read a complete server message including its type
+	ReadFrame() ([]byte, error)
+	WriteFrame([]byte) error
+	Close() error
+}
+
+func (e ServerError) Error() string {
+	return "server error: " + e.Msg
+}
+
+// Check if the error rejects the client rather than reporting the server stopping
+func (e ServerError) Fatal() bool {
+	return e.Msg != SHUTDOWN_MESSAGE
+}
+
+// Check if an error should stop a reconnecting client
+func fatal(err error) bool {
+	var serverErr ServerError
+	return errors.As(err, &serverErr) && serverErr.Fatal()
+}
+
+func (t Transport) String() string {
+	switch t {
+	case WEBSOCKET_TRANSPORT:
+		return "websocket"
+	case UNIX_TRANSPORT:
+		return "unix"
+	default:
+		return "unknown"
+	}
+}
+
+// Connect to a room and start reading messages.
+//
+// The initial connection is not retried, errors sent by the server during the handshake are returned as a ServerError.
+func Dial(ctx context.Context, cfg Config, handler Handler) (*Client, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = grog.DefaultHeartbeat.Interval
+	}
+	if len(cfg.Name) == 0 || len(cfg.Name) > 255 {
+		return nil, fmt.Errorf("invalid client name %q", cfg.Name)
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		handler: handler,
+		logger: cfg.Logger.With(
+			slog.String("transport", cfg.Transport.String()),
+			slog.String("room", cfg.Room),
+		),
+		done:     make(chan struct{}),
+		token:    cfg.Resume,
+		statuses: make(map[uint16]grog.ClientStatusMessage),
+	}
+
+	var err error
+	c.conn, err = c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.run(runCtx)
+	if cfg.Transport == UNIX_TRANSPORT {
+		go c.heartbeat(runCtx)
+	}
+
+	return c, nil
+}
+
+func (c *Client) dial(ctx context.Context) (conn, error) {
+	announce := grog.ClientAnnounceMessage{Version: util.ServerVersion, Name: c.cfg.Name}
+	token := c.ResumeToken()
+	switch c.cfg.Transport {
+	case WEBSOCKET_TRANSPORT:
+		return dialWebSocket(ctx, c.cfg.Addr, c.cfg.Room, token, c.cfg.Spectate, c.cfg.Interval, announce)
+	case UNIX_TRANSPORT:
+		return dialUnix(ctx, c.cfg.Addr, c.cfg.Room, token, c.cfg.Spectate, c.cfg.Interval, announce)
+	default:
+		return nil, fmt.Errorf("unknown transport %d", c.cfg.Transport)
+	}
+}
+
+// Token for rejoining the room with the same id, empty until the server sends one
+func (c *Client) ResumeToken() string {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	return c.token
+}
+
+// Send the local player's status to the room
+func (c *Client) SendStatus(offset uint16, state grog.PlayerState) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if c.conn == nil {
+		return ErrClosed
+	} else if c.cfg.Spectate {
+		return ErrSpectator
+	}
+	c.statusLock.Lock()
+	msg := grog.ClientStatusAckMessage{
+		ClientStatusMessage: grog.ClientStatusMessage{Offset: offset, PlayerState: state},
+		Ack:                 c.seq,
+	}
+	c.statusLock.Unlock()
+	return c.conn.WriteFrame(msg.WriteBytes(append(make([]byte, 0, 8), byte(grog.STATUS_MSG))))
+}
+
+// Change the room's queue, the new queue is sent to OnQueue
+func (c *Client) SendQueue(msg grog.ClientQueueMessage) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if c.conn == nil {
+		return ErrClosed
+	} else if c.cfg.Spectate {
+		return ErrSpectator
+	}
+	return c.conn.WriteFrame(msg.WriteBytes([]byte{byte(grog.QUEUE_MSG)}))
+}
+
+// Start, cancel or answer the room's ready check, the check is sent to OnReady
+func (c *Client) SendReady(op grog.ReadyOp) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if c.conn == nil {
+		return ErrClosed
+	} else if c.cfg.Spectate {
+		return ErrSpectator
+	}
+	msg := grog.ClientReadyMessage{Op: op}
+	return c.conn.WriteFrame(msg.WriteBytes([]byte{byte(grog.READY_MSG)}))
+}
+
+// Closed when the client stops, either from Close or an unrecoverable error
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// The error that stopped the client, only valid after Done is closed
+func (c *Client) Err() error {
+	return c.err
+}
+
+func (c *Client) Close() error {
+	c.cancel()
+	c.connLock.Lock()
+	var err error
+	if c.conn != nil {
+		err = c.conn.Close()
+	}
+	c.connLock.Unlock()
+	<-c.done
+	return err
+}
+
+// Send a heartbeat every interval so the server doesn't evict an idle member or spectator
+func (c *Client) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.connLock.Lock()
+		if c.conn != nil {
+			if err := c.conn.WriteFrame([]byte{byte(grog.EMPTY_MSG)}); err != nil {
+				c.logger.Debug("Failed to send heartbeat", slog.String("err", err.Error()))
+			}
+		}
+		c.connLock.Unlock()
+	}
+}
+
+// Read messages until the connection fails, reconnecting if enabled
+func (c *Client) run(ctx context.Context) {
+	defer close(c.done)
+
+	backoff := 500 * time.Millisecond
+	for {
+		err := c.readLoop()
+
+		c.connLock.Lock()
+		c.conn.Close()
+		c.conn = nil
+		c.connLock.Unlock()
+
+		if ctx.Err() != nil {
+			c.err = ErrClosed
+			return
+		} else if !c.cfg.Reconnect || fatal(err) {
+			c.err = err
+			return
+		}
+		c.logger.Warn("Connection lost, reconnecting", slog.String("err", err.Error()))
+
+		for {
+			select {
+			case <-ctx.Done():
+				c.err = ErrClosed
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, c.cfg.MaxBackoff)
+
+			conn, err := c.dial(ctx)
+			if fatal(err) {
+				c.err = err
+				return
+			} else if err != nil {
+				c.logger.Warn("Failed to reconnect", slog.String("err", err.Error()))
+				continue
+			}
+
+			c.connLock.Lock()
+			c.conn = conn
+			c.connLock.Unlock()
+			// the new connection starts from a keyframe
+			c.statusLock.Lock()
+			c.seq = 0
+			c.statusLock.Unlock()
+			backoff = 500 * time.Millisecond
+			c.logger.Info("Reconnected")
+			if c.handler.OnReconnect != nil {
+				c.handler.OnReconnect()
+			}
+			break
+		}
+	}
+}
+
+func (c *Client) readLoop() error {
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return err
+		} else if err := c.dispatch(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Parse a frame and hand it to the handler
+func (c *Client) dispatch(frame []byte) error {
+	if len(frame) == 0 {
+		return grog.ErrShortMessage
+	}
+
+	switch grog.MessageType(frame[0]) {
+	case grog.EMPTY_MSG:
+	case grog.ANNOUNCE_MSG:
+		msg, err := grog.ParseServerAnnounce(frame[1:])
+		if err != nil {
+			return err
+		}
+		c.pruneStatuses(msg)
+		if c.handler.OnAnnounce != nil {
+			c.handler.OnAnnounce(msg)
+		}
+	case grog.STATUS_MSG:
+		msg, err := grog.ParseServerStatus(frame[1:])
+		if err != nil {
+			return err
+		}
+		if c.handler.OnStatus != nil {
+			c.handler.OnStatus(msg)
+		}
+	case grog.DELTA_MSG:
+		delta, err := grog.ParseStatusDelta(frame[1:])
+		if err != nil {
+			return err
+		}
+		msg, ok := c.applyDelta(delta)
+		if ok && c.handler.OnStatus != nil {
+			c.handler.OnStatus(msg)
+		}
+	case grog.QUEUE_MSG:
+		msg, err := grog.ParseQueue(frame[1:])
+		if err != nil {
+			return err
+		}
+		if c.handler.OnQueue != nil {
+			c.handler.OnQueue(msg)
+		}
+	case grog.READY_MSG:
+		msg, err := grog.ParseReady(frame[1:])
+		if err != nil {
+			return err
+		}
+		if c.handler.OnReady != nil {
+			c.handler.OnReady(msg)
+		}
+	case grog.COUNTDOWN_MSG:
+		msg, err := grog.ParseCountdown(frame[1:])
+		if err != nil {
+			return err
+		}
+		if c.handler.OnCountdown != nil {
+			c.handler.OnCountdown(msg)
+		}
+	case grog.PAUSE_MSG:
+		msg, err := grog.ParsePause(frame[1:])
+		if err != nil {
+			return err
+		}
+		if c.handler.OnPause != nil {
+			c.handler.OnPause(msg)
+		}
+	case grog.RESUME_MSG:
+		msg, err := grog.ParseResume(frame[1:])
+		if err != nil {
+			return err
+		}
+		c.tokenLock.Lock()
+		c.token = msg.Token
+		c.tokenLock.Unlock()
+	case grog.ERROR_MSG:
+		if c.handler.OnError != nil {
+			c.handler.OnError(string(frame[1:]))
+		}
+		return ServerError{string(frame[1:])}
+	default:
+		c.logger.Warn("Recieved unknown message type", slog.Int("type", int(frame[0])))
+		return ErrUnknownMessage
+	}
+
+	return nil
+}
+
+// Apply a status delta to the room's statuses.
+// A delta based on statuses the client never applied is dropped and the next status asks for a keyframe.
+func (c *Client) applyDelta(delta grog.StatusDeltaMessage) (grog.ServerStatusMessage, bool) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+
+	if delta.Keyframe() {
+		clear(c.statuses)
+	} else if c.seq == 0 || delta.Base > c.seq {
+		c.logger.Debug("Missed status delta, requesting keyframe",
+			slog.Int("base", int(delta.Base)),
+			slog.Int("seq", int(c.seq)),
+		)
+		c.seq = 0
+		return grog.ServerStatusMessage{}, false
+	}
+	for _, status := range delta.Statuses {
+		c.statuses[status.Id] = status
+	}
+	c.seq = delta.Seq
+
+	msg := grog.ServerStatusMessage{Statuses: make([]grog.ClientStatusMessage, 0, len(c.statuses))}
+	for _, status := range c.statuses {
+		msg.Statuses = append(msg.Statuses, status)
+	}
+	slices.SortFunc(msg.Statuses, func(a, b grog.ClientStatusMessage) int { return int(a.Id) - int(b.Id) })
+	return msg, true
+}
+
+// Drop the statuses of members that left the room, deltas don't include them
+func (c *Client) pruneStatuses(msg grog.ServerAnnounceMessage) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+
+	members := make(map[uint16]bool, len(msg.Clients))
+	for _, client := range msg.Clients {
+		members[client.Id] = true
+	}
+	for id := range c.statuses {
+		if !members[id] {
+			delete(c.statuses, id)
+		}
+	}
+}
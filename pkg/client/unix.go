@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+type unixConn struct {
+	conn   *net.UnixConn
+	reader *bufio.Reader
+}
+
+// Negotiate a client socket over baseDir/join.sock then connect to it
+func dialUnix(ctx context.Context, baseDir string, room string, token string, spectate bool, interval time.Duration, announce grog.ClientAnnounceMessage) (*unixConn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", baseDir+"/join.sock")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	buf := make([]byte, 1024)
+	if _, err := c.Write(announce.WriteBytes(nil)); err != nil {
+		return nil, err
+	}
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	} else if grog.MessageType(buf[0]) == grog.ERROR_MSG {
+		return nil, ServerError{string(buf[1:n])}
+	} else if n != 1 || grog.MessageType(buf[0]) != grog.EMPTY_MSG {
+		return nil, fmt.Errorf("unexpected response to clientAnnounce: %v", buf[:n])
+	}
+
+	if token != "" {
+		room += "\x00" + token
+	}
+	if spectate {
+		room += "\x00spectate"
+	}
+	if interval > 0 {
+		room += "\x00interval=" + strconv.FormatInt(interval.Milliseconds(), 10)
+	}
+	if _, err := c.Write([]byte(room)); err != nil {
+		return nil, err
+	}
+	n, err = c.Read(buf)
+	if err != nil {
+		return nil, err
+	} else if grog.MessageType(buf[0]) == grog.ERROR_MSG {
+		return nil, ServerError{string(buf[1:n])}
+	}
+	clientPath := string(buf[:n])
+
+	// the server only listens on the client socket after sending its path
+	var clientConn net.Conn
+	for range 10 {
+		clientConn, err = d.DialContext(ctx, "unix", clientPath)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(25 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := clientConn.(*net.UnixConn)
+	return &unixConn{conn, bufio.NewReader(conn)}, nil
+}
+
+func (c *unixConn) ReadFrame() ([]byte, error) {
+	msgType, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	frame := []byte{msgType}
+
+	switch grog.MessageType(msgType) {
+	case grog.EMPTY_MSG:
+		return frame, nil
+	case grog.STATUS_MSG:
+		frame, err := c.readN(frame, 2)
+		if err != nil {
+			return nil, err
+		}
+		return c.readN(frame, 5*int(binary.BigEndian.Uint16(frame[1:])))
+	case grog.DELTA_MSG:
+		// sequence, base and number of statuses
+		frame, err := c.readN(frame, 10)
+		if err != nil {
+			return nil, err
+		}
+		return c.readN(frame, 5*int(binary.BigEndian.Uint16(frame[9:])))
+	case grog.ANNOUNCE_MSG:
+		frame, err := c.readN(frame, 2)
+		if err != nil {
+			return nil, err
+		}
+		for range int(binary.BigEndian.Uint16(frame[1:])) {
+			// id and name length
+			if frame, err = c.readN(frame, 3); err != nil {
+				return nil, err
+			}
+			if frame, err = c.readN(frame, int(frame[len(frame)-1])); err != nil {
+				return nil, err
+			}
+		}
+		// number of spectators and muted members
+		if frame, err = c.readN(frame, 4); err != nil {
+			return nil, err
+		}
+		if frame, err = c.readN(frame, 2*int(binary.BigEndian.Uint16(frame[len(frame)-2:]))); err != nil {
+			return nil, err
+		}
+		// number of stale members
+		if frame, err = c.readN(frame, 2); err != nil {
+			return nil, err
+		}
+		return c.readN(frame, 2*int(binary.BigEndian.Uint16(frame[len(frame)-2:])))
+	case grog.QUEUE_MSG:
+		frame, err := c.readN(frame, 4)
+		if err != nil {
+			return nil, err
+		}
+		for range int(binary.BigEndian.Uint16(frame[3:])) {
+			// duration and title length
+			if frame, err = c.readN(frame, 3); err != nil {
+				return nil, err
+			}
+			// title and location length
+			if frame, err = c.readN(frame, int(frame[len(frame)-1])+2); err != nil {
+				return nil, err
+			}
+			if frame, err = c.readN(frame, int(binary.BigEndian.Uint16(frame[len(frame)-2:]))); err != nil {
+				return nil, err
+			}
+		}
+		return frame, nil
+	case grog.READY_MSG:
+		frame, err := c.readN(frame, 3)
+		if err != nil {
+			return nil, err
+		}
+		return c.readN(frame, 2*int(binary.BigEndian.Uint16(frame[2:])))
+	case grog.COUNTDOWN_MSG:
+		return c.readN(frame, 12)
+	case grog.PAUSE_MSG:
+		return c.readN(frame, 3)
+	case grog.RESUME_MSG:
+		return c.readN(frame, grog.RESUME_TOKEN_LEN)
+	case grog.ERROR_MSG:
+		// errors are unframed, the server closes the connection after sending one
+		c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		rest, err := io.ReadAll(io.LimitReader(c.reader, 4096))
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return nil, err
+			}
+		}
+		return append(frame, rest...), nil
+	default:
+		return nil, ErrUnknownMessage
+	}
+}
+
+// Append the next n bytes of the connection to frame
+func (c *unixConn) readN(frame []byte, n int) ([]byte, error) {
+	start := len(frame)
+	frame = append(frame, make([]byte, n)...)
+	_, err := io.ReadFull(c.reader, frame[start:])
+	return frame, err
+}
+
+func (c *unixConn) WriteFrame(frame []byte) error {
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *unixConn) Close() error {
+	return c.conn.Close()
+}
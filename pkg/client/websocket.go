@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+type wsConn struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+func dialWebSocket(ctx context.Context, addr string, room string, token string, spectate bool, interval time.Duration, announce grog.ClientAnnounceMessage) (*wsConn, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: "/barrel/" + room}
+	query := url.Values{}
+	if token != "" {
+		query.Set("resume", token)
+	}
+	if spectate {
+		query.Set("spectate", "")
+	}
+	if interval > 0 {
+		query.Set("interval", strconv.FormatInt(interval.Milliseconds(), 10))
+	}
+	u.RawQuery = query.Encode()
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &wsConn{conn: c}
+	if err := conn.WriteFrame(announce.WriteBytes(nil)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *wsConn) ReadFrame() ([]byte, error) {
+	_, frame, err := c.conn.ReadMessage()
+
+	// the server sends errors as the payload of a close message,
+	// so the message type and first byte of the error end up in the close code.
+	// Standard close codes start at 1000, above any error message's code
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code < 1000 && closeErr.Code>>8 == int(grog.ERROR_MSG) {
+		frame = []byte{byte(grog.ERROR_MSG), byte(closeErr.Code)}
+		return append(frame, closeErr.Text...), nil
+	}
+
+	return frame, err
+}
+
+func (c *wsConn) WriteFrame(frame []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (c *wsConn) Close() error {
+	c.writeLock.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeLock.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,330 @@
+// Package cluster shares rooms between grogbarrel instances through redis.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"iter"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// How long an instance's members outlive its last heartbeat
+const INSTANCE_TTL = 15 * time.Second
+
+// Set a member's status only while the id is claimed, so released members leave no status behind.
+// KEYS: members, statuses. ARGV: id, status.
+const setStatusScript = `if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	return redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+end
+return 0`
+
+// Remove a member of an expired instance unless its id was claimed again since it was read.
+// KEYS: members, statuses, version. ARGV: id, member.
+const reapScript = `if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	return redis.call('INCR', KEYS[3])
+end
+return 0`
+
+// Backend storing rooms in redis so members of every instance share them.
+//
+// Each room is a hash of members (id -> instance NUL name), a hash of statuses (id -> 3 bytes)
+// and a version counter. Members of instances whose heartbeat expired are hidden when read,
+// and removed by the heartbeat of an instance with members in the same room.
+//
+// Commands share one connection, so each call pipelines its commands.
+// A status tick costs one round trip for every SetStatus and one for Statuses,
+// plus one when members of other instances need their heartbeats checked.
+type RedisBackend struct {
+	conn     *respConn
+	prefix   string
+	instance string
+	logger   *slog.Logger
+
+	// rooms with members of this instance, name -> member count
+	rooms map[string]int
+	lock  sync.Mutex
+}
+
+var _ grog.Backend = (*RedisBackend)(nil)
+
+// Connect to redis at a redis:// url or host:port.
+// Keys are prefixed so several deployments can share a server.
+func DialRedis(ctx context.Context, rawUrl string, prefix string, logger *slog.Logger) (*RedisBackend, error) {
+	conn, err := parseRedisUrl(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	conn.lock.Lock()
+	err = conn.dial(ctx)
+	conn.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	b := &RedisBackend{
+		conn:     conn,
+		prefix:   prefix,
+		instance: hex.EncodeToString(buf),
+		logger:   logger.With(slog.String("backend", "redis")),
+		rooms:    make(map[string]int),
+	}
+	if err := b.heartbeat(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *RedisBackend) key(room string, kind string) string {
+	return b.prefix + "room:" + room + ":" + kind
+}
+
+func (b *RedisBackend) instanceKey(instance string) string {
+	return b.prefix + "instance:" + instance
+}
+
+func (b *RedisBackend) heartbeat() error {
+	ttl := strconv.Itoa(int(INSTANCE_TTL / time.Second))
+	_, err := b.conn.Do("SET", b.instanceKey(b.instance), "1", "EX", ttl)
+	return err
+}
+
+// Refresh the instance's heartbeat and remove members of expired instances until ctx is done
+func (b *RedisBackend) Run(ctx context.Context) {
+	ticker := time.NewTicker(INSTANCE_TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.heartbeat(); err != nil {
+				b.logger.Error("Failed to send heartbeat", slog.String("err", err.Error()))
+			}
+			b.reapAll()
+		}
+	}
+}
+
+// Remove members of expired instances from the rooms this instance has members in
+func (b *RedisBackend) reapAll() {
+	b.lock.Lock()
+	rooms := make([]string, 0, len(b.rooms))
+	for room := range b.rooms {
+		rooms = append(rooms, room)
+	}
+	b.lock.Unlock()
+
+	for _, room := range rooms {
+		if err := b.reap(room); err != nil {
+			b.logger.Error("Failed to remove members of expired instances",
+				slog.String("roomName", room), slog.String("err", err.Error()))
+		}
+	}
+}
+
+func (b *RedisBackend) reap(room string) error {
+	entries, err := replyMap(b.conn.Do("HGETALL", b.key(room, "members")))
+	if err != nil {
+		return err
+	}
+	_, expired, err := b.split(entries)
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	commands := make([][]string, 0, len(expired))
+	for _, member := range expired {
+		field := strconv.Itoa(int(member.Id))
+		b.logger.Info("Removing member of expired instance",
+			slog.String("roomName", room),
+			slog.String("instance", member.instance),
+			slog.Int("id", int(member.Id)),
+		)
+		commands = append(commands, []string{"EVAL", reapScript, "3",
+			b.key(room, "members"), b.key(room, "statuses"), b.key(room, "version"),
+			field, entries[field]})
+	}
+	return replyErr(b.conn.Pipeline(commands...))
+}
+
+type redisMember struct {
+	grog.AnnouncedClient
+	instance string
+}
+
+// Split a room's members hash into members of live and expired instances, ordered by id.
+// Heartbeats of other instances are checked with a single pipeline.
+func (b *RedisBackend) split(entries map[string]string) (live []grog.AnnouncedClient, expired []redisMember, err error) {
+	members := make([]redisMember, 0, len(entries))
+	var instances []string
+	for field, value := range entries {
+		id, err := strconv.Atoi(field)
+		instance, name, ok := strings.Cut(value, "\x00")
+		if err != nil || id < 0 || id >= grog.MAX_CONNECTIONS || !ok {
+			continue
+		}
+		members = append(members, redisMember{grog.AnnouncedClient{Id: uint16(id), Name: name}, instance})
+		if instance != b.instance && !slices.Contains(instances, instance) {
+			instances = append(instances, instance)
+		}
+	}
+	slices.SortFunc(members, func(a, b redisMember) int { return int(a.Id) - int(b.Id) })
+
+	alive := map[string]bool{b.instance: true}
+	if len(instances) > 0 {
+		commands := make([][]string, len(instances))
+		for i, instance := range instances {
+			commands[i] = []string{"EXISTS", b.instanceKey(instance)}
+		}
+		replies, err := b.conn.Pipeline(commands...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, instance := range instances {
+			exists, err := replyInt(replies[i], nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			alive[instance] = exists == 1
+		}
+	}
+
+	live = make([]grog.AnnouncedClient, 0, len(members))
+	for _, member := range members {
+		if alive[member.instance] {
+			live = append(live, member.AnnouncedClient)
+		} else {
+			expired = append(expired, member)
+		}
+	}
+	return live, expired, nil
+}
+
+// Remove the instance's heartbeat and disconnect
+func (b *RedisBackend) Close() error {
+	b.conn.Do("DEL", b.instanceKey(b.instance))
+	return b.conn.Close()
+}
+
+func (b *RedisBackend) Claim(room string, candidates iter.Seq[uint16], name string) (uint16, error) {
+	members, err := replyMap(b.conn.Do("HGETALL", b.key(room, "members")))
+	if err != nil {
+		return 0, err
+	}
+
+	// ids of expired instances stay taken until they are removed by a heartbeat
+	for id := range candidates {
+		field := strconv.Itoa(int(id))
+		if _, taken := members[field]; taken {
+			continue
+		}
+		// another instance may claim the id first
+		claimed, err := replyInt(b.conn.Do("HSETNX", b.key(room, "members"), field, b.instance+"\x00"+name))
+		if err != nil {
+			return 0, err
+		} else if claimed == 0 {
+			continue
+		}
+
+		b.lock.Lock()
+		b.rooms[room]++
+		b.lock.Unlock()
+		return id, replyErr(b.conn.Pipeline(
+			[]string{"HDEL", b.key(room, "statuses"), field},
+			[]string{"INCR", b.key(room, "version")},
+		))
+	}
+
+	return 0, grog.ErrNoFreeId
+}
+
+func (b *RedisBackend) Release(room string, id uint16) error {
+	b.lock.Lock()
+	if b.rooms[room]--; b.rooms[room] <= 0 {
+		delete(b.rooms, room)
+	}
+	b.lock.Unlock()
+
+	field := strconv.Itoa(int(id))
+	return replyErr(b.conn.Pipeline(
+		[]string{"HDEL", b.key(room, "members"), field},
+		[]string{"HDEL", b.key(room, "statuses"), field},
+		[]string{"INCR", b.key(room, "version")},
+	))
+}
+
+// Statuses of released members are dropped
+func (b *RedisBackend) SetStatus(room string, status grog.ClientStatusMessage) error {
+	_, err := b.conn.Do("EVAL", setStatusScript, "2", b.key(room, "members"), b.key(room, "statuses"),
+		strconv.Itoa(int(status.Id)), string(status.WriteClientBytes(make([]byte, 0, 3))))
+	return err
+}
+
+func (b *RedisBackend) Members(room string) ([]grog.AnnouncedClient, error) {
+	entries, err := replyMap(b.conn.Do("HGETALL", b.key(room, "members")))
+	if err != nil {
+		return nil, err
+	}
+	members, _, err := b.split(entries)
+	return members, err
+}
+
+func (b *RedisBackend) Statuses(room string) ([]grog.ClientStatusMessage, error) {
+	replies, err := b.conn.Pipeline(
+		[]string{"HGETALL", b.key(room, "members")},
+		[]string{"HGETALL", b.key(room, "statuses")},
+	)
+	if err != nil {
+		return nil, err
+	}
+	memberEntries, err := replyMap(replies[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := replyMap(replies[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	members, _, err := b.split(memberEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]grog.ClientStatusMessage, 0, len(members))
+	for _, member := range members {
+		value, ok := entries[strconv.Itoa(int(member.Id))]
+		if !ok {
+			continue
+		}
+		status, err := grog.ParseClientStatus([]byte(value), member.Id)
+		if err != nil {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func (b *RedisBackend) Version(room string) (int64, error) {
+	version, err := replyInt(b.conn.Do("GET", b.key(room, "version")))
+	if err == ErrNil {
+		return 0, nil
+	}
+	return version, err
+}
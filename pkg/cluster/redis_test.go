@@ -0,0 +1,238 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+func dialBackend(t *testing.T, addr string) *RedisBackend {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b, err := DialRedis(ctx, addr, "test:", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func ids(from uint16, to uint16) func(func(uint16) bool) {
+	return func(yield func(uint16) bool) {
+		for id := from; id < to; id++ {
+			if !yield(id) {
+				return
+			}
+		}
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	t.Run("fake", func(t *testing.T) { testRedisBackend(t, newFakeRedis(t, "").Addr()) })
+	t.Run("redis-server", func(t *testing.T) { testRedisBackend(t, startRedisServer(t)) })
+}
+
+// Two instances sharing a room
+func testRedisBackend(t *testing.T, addr string) {
+	a := dialBackend(t, addr)
+	b := dialBackend(t, addr)
+	const room = "room"
+
+	version := func() int64 {
+		t.Helper()
+		v, err := a.Version(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	members := func(backend *RedisBackend) []grog.AnnouncedClient {
+		t.Helper()
+		m, err := backend.Members(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if v := version(); v != 0 {
+		t.Errorf("Version() of a new room = %d, want 0", v)
+	}
+
+	alice, err := a.Claim(room, ids(0, 4), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := b.Claim(room, ids(0, 4), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice != 0 || bob != 1 {
+		t.Errorf("claimed ids %d and %d, want 0 and 1", alice, bob)
+	}
+	if _, err := b.Claim(room, ids(0, 2), "carol"); err != grog.ErrNoFreeId {
+		t.Errorf("Claim() of a full room error = %v, want %v", err, grog.ErrNoFreeId)
+	}
+	claimed := version()
+
+	want := []grog.AnnouncedClient{{Id: 0, Name: "alice"}, {Id: 1, Name: "bob"}}
+	if got := members(a); !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() = %v, want %v", got, want)
+	}
+	if got := members(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() of the other instance = %v, want %v", got, want)
+	}
+
+	// statuses of members are shared, those of non-members are dropped
+	statuses := []grog.ClientStatusMessage{
+		{Id: alice, Offset: 30, PlayerState: grog.PLAYING_STATUS},
+		{Id: bob, Offset: 31, PlayerState: grog.PAUSED_STATUS},
+		{Id: 3, Offset: 99, PlayerState: grog.PLAYING_STATUS},
+	}
+	for _, status := range statuses {
+		if err := a.SetStatus(room, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := b.Statuses(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, statuses[:2]) {
+		t.Errorf("Statuses() = %v, want %v", got, statuses[:2])
+	}
+	stored, err := replyMap(a.conn.Do("HGETALL", a.key(room, "statuses")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["3"]; ok {
+		t.Error("status of a non-member was stored")
+	}
+
+	if err := b.Release(room, bob); err != nil {
+		t.Fatal(err)
+	}
+	if got := members(a); !slices.Equal(got, want[:1]) {
+		t.Errorf("Members() after Release = %v, want %v", got, want[:1])
+	}
+	if err := a.SetStatus(room, statuses[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.Statuses(room); !slices.Equal(got, statuses[:1]) {
+		t.Errorf("Statuses() after Release = %v, want %v", got, statuses[:1])
+	}
+	if v := version(); v <= claimed {
+		t.Errorf("Version() after Release = %d, want more than %d", v, claimed)
+	}
+}
+
+func TestRedisExpiredInstance(t *testing.T) {
+	t.Run("fake", func(t *testing.T) { testRedisExpiredInstance(t, newFakeRedis(t, "").Addr()) })
+	t.Run("redis-server", func(t *testing.T) { testRedisExpiredInstance(t, startRedisServer(t)) })
+}
+
+func testRedisExpiredInstance(t *testing.T, addr string) {
+	a := dialBackend(t, addr)
+	b := dialBackend(t, addr)
+	const room = "room"
+
+	if _, err := a.Claim(room, ids(0, 4), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := b.Claim(room, ids(0, 4), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetStatus(room, grog.ClientStatusMessage{Id: bob, Offset: 5}); err != nil {
+		t.Fatal(err)
+	}
+	// b stops without removing its members
+	if _, err := b.conn.Do("DEL", b.instanceKey(b.instance)); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := a.Version(room)
+
+	// members of the expired instance are hidden, but reads leave them in place
+	want := []grog.AnnouncedClient{{Id: 0, Name: "alice"}}
+	if got, err := a.Members(room); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() = %v, %v, want %v", got, err, want)
+	}
+	if got, err := a.Statuses(room); err != nil || len(got) != 0 {
+		t.Errorf("Statuses() = %v, %v, want none", got, err)
+	}
+	stored, _ := replyMap(a.conn.Do("HGETALL", a.key(room, "members")))
+	if len(stored) != 2 {
+		t.Errorf("reads removed members: %v", stored)
+	}
+	if v, _ := a.Version(room); v != before {
+		t.Errorf("reads changed the version from %d to %d", before, v)
+	}
+
+	// the heartbeat of the remaining instance removes them
+	a.reapAll()
+	stored, _ = replyMap(a.conn.Do("HGETALL", a.key(room, "members")))
+	if _, ok := stored["1"]; ok || len(stored) != 1 {
+		t.Errorf("members after reaping = %v, want only alice", stored)
+	}
+	statuses, _ := replyMap(a.conn.Do("HGETALL", a.key(room, "statuses")))
+	if len(statuses) != 0 {
+		t.Errorf("statuses after reaping = %v, want none", statuses)
+	}
+	if v, _ := a.Version(room); v <= before {
+		t.Errorf("Version() after reaping = %d, want more than %d", v, before)
+	}
+
+	// an id claimed again since it was read is not removed
+	carol, err := a.Claim(room, ids(1, 4), "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.conn.Do("EVAL", reapScript, "3", a.key(room, "members"), a.key(room, "statuses"),
+		a.key(room, "version"), "1", b.instance+"\x00bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.Members(room); len(got) != 2 || got[1].Id != carol {
+		t.Errorf("Members() after a stale reap = %v, want alice and carol", got)
+	}
+}
+
+// A status tick is one round trip per SetStatus and one for Statuses
+func TestRedisRoundTrips(t *testing.T) {
+	f := newFakeRedis(t, "")
+	a := dialBackend(t, f.Addr())
+	const room = "room"
+
+	id, err := a.Claim(room, ids(0, 4), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrips := func(fn func() error) int {
+		t.Helper()
+		f.lock.Lock()
+		start := f.commands
+		f.lock.Unlock()
+		if err := fn(); err != nil {
+			t.Fatal(err)
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.commands - start
+	}
+
+	if n := roundTrips(func() error { return a.SetStatus(room, grog.ClientStatusMessage{Id: id}) }); n != 1 {
+		t.Errorf("SetStatus() sent %d commands, want 1", n)
+	}
+	// the fake counts commands, the two HGETALLs of Statuses are pipelined together
+	if n := roundTrips(func() error { _, err := a.Statuses(room); return err }); n != 2 {
+		t.Errorf("Statuses() sent %d commands, want 2", n)
+	}
+}
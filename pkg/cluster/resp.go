@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNil error = errors.New("nil reply")
+
+// Error reply sent by the server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// A redis protocol (RESP2) connection, redialed after errors.
+// Commands are serialized over a single connection, so callers pipeline independent commands.
+type respConn struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+// Parse a redis://[:password@]host:port[/db] url, a bare host:port is also accepted
+func parseRedisUrl(rawUrl string) (*respConn, error) {
+	c := &respConn{addr: rawUrl, timeout: 5 * time.Second}
+	if !strings.Contains(rawUrl, "://") {
+		return c, nil
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	c.addr = u.Host
+	if !strings.Contains(c.addr, ":") {
+		c.addr += ":6379"
+	}
+	if password, ok := u.User.Password(); ok {
+		c.password = password
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+
+	return c, nil
+}
+
+// Connect and authenticate, must hold the lock
+func (c *respConn) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) == 0 {
+		return nil
+	}
+
+	replies, err := c.roundTrip(setup...)
+	for _, reply := range replies {
+		if redisErr, ok := reply.(RedisError); ok && err == nil {
+			err = redisErr
+		}
+	}
+	if err != nil {
+		c.close()
+	}
+	return err
+}
+
+// Must hold the lock
+func (c *respConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *respConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.close()
+	return nil
+}
+
+// Run a command, redialing once if the connection is broken.
+// Error replies are returned as a RedisError.
+func (c *respConn) Do(args ...string) (any, error) {
+	replies, err := c.Pipeline(args)
+	if err != nil {
+		return nil, err
+	} else if redisErr, ok := replies[0].(RedisError); ok {
+		return nil, redisErr
+	}
+	return replies[0], nil
+}
+
+// Send several commands before reading their replies, costing a single round trip.
+// Error replies are returned in place of their command's reply as a RedisError.
+func (c *respConn) Pipeline(commands ...[]string) ([]any, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			err := c.dial(ctx)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		replies, err := c.roundTrip(commands...)
+		if err == nil {
+			return replies, nil
+		}
+		c.close()
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// Must hold the lock
+func (c *respConn) roundTrip(commands ...[]string) ([]any, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	buf := make([]byte, 0, 64*len(commands))
+	for _, args := range commands {
+		buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(commands))
+	for i := range replies {
+		reply, err := readReply(c.reader)
+		var redisErr RedisError
+		if errors.As(err, &redisErr) {
+			reply = redisErr
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// Read a reply: string for simple and bulk strings, int64, []any, or nil
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	} else if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		} else if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		} else if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				var redisErr RedisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", kind)
+	}
+}
+
+func replyInt(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case RedisError:
+		return 0, v
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, ErrNil
+	default:
+		return 0, fmt.Errorf("unexpected reply %T", reply)
+	}
+}
+
+// The first error of a pipeline, including error replies
+func replyErr(replies []any, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if redisErr, ok := reply.(RedisError); ok {
+			return redisErr
+		}
+	}
+	return nil
+}
+
+// Read a flat array of alternating fields and values, as sent by HGETALL
+func replyMap(reply any, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	} else if redisErr, ok := reply.(RedisError); ok {
+		return nil, redisErr
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+
+	m := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		field, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		m[field] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,382 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory redis answering the commands used by RedisBackend.
+// EVAL runs the backend's scripts natively rather than interpreting lua.
+type fakeRedis struct {
+	password string
+
+	lock     sync.Mutex
+	strings  map[string]string
+	expiries map[string]time.Time
+	hashes   map[string]map[string]string
+	conns    []net.Conn
+	commands int
+	listener net.Listener
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		password: password,
+		strings:  make(map[string]string),
+		expiries: make(map[string]time.Time),
+		hashes:   make(map[string]map[string]string),
+		listener: l,
+	}
+	t.Cleanup(f.close)
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.dropConns()
+}
+
+// Close every client connection, as a restarting server would
+func (f *fakeRedis) dropConns() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		f.conns = append(f.conns, conn)
+		f.lock.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var length int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &length); err != nil {
+			return nil, err
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:length])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		if args[0] == "AUTH" {
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		} else if !authed {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			f.lock.Lock()
+			f.commands++
+			reply = f.run(args)
+			f.lock.Unlock()
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Must hold the lock
+func (f *fakeRedis) live(key string) bool {
+	if expiry, ok := f.expiries[key]; ok && time.Now().After(expiry) {
+		delete(f.strings, key)
+		delete(f.expiries, key)
+	}
+	_, ok := f.strings[key]
+	return ok
+}
+
+// Must hold the lock
+func (f *fakeRedis) hash(key string) map[string]string {
+	if f.hashes[key] == nil {
+		f.hashes[key] = make(map[string]string)
+	}
+	return f.hashes[key]
+}
+
+func boolReply(b bool) string {
+	if b {
+		return ":1\r\n"
+	}
+	return ":0\r\n"
+}
+
+// Must hold the lock
+func (f *fakeRedis) run(args []string) string {
+	switch args[0] {
+	case "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		f.strings[args[1]] = args[2]
+		delete(f.expiries, args[1])
+		if len(args) == 5 && args[3] == "EX" {
+			seconds, _ := strconv.Atoi(args[4])
+			f.expiries[args[1]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		return "+OK\r\n"
+	case "GET":
+		if !f.live(args[1]) {
+			return "$-1\r\n"
+		}
+		return bulk(f.strings[args[1]])
+	case "DEL":
+		existed := f.live(args[1])
+		delete(f.strings, args[1])
+		delete(f.hashes, args[1])
+		return boolReply(existed)
+	case "EXISTS":
+		return boolReply(f.live(args[1]))
+	case "INCR":
+		n, _ := strconv.Atoi(f.strings[args[1]])
+		f.strings[args[1]] = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "HGETALL":
+		h := f.hashes[args[1]]
+		reply := fmt.Sprintf("*%d\r\n", 2*len(h))
+		for field, value := range h {
+			reply += bulk(field) + bulk(value)
+		}
+		return reply
+	case "HGET":
+		value, ok := f.hashes[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "HSET", "HSETNX":
+		h := f.hash(args[1])
+		_, exists := h[args[2]]
+		if !exists || args[0] == "HSET" {
+			h[args[2]] = args[3]
+		}
+		return boolReply(!exists)
+	case "HDEL":
+		_, existed := f.hashes[args[1]][args[2]]
+		delete(f.hashes[args[1]], args[2])
+		return boolReply(existed)
+	case "EVAL":
+		return f.eval(args[1], args[3:])
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// Must hold the lock
+func (f *fakeRedis) eval(script string, keysAndArgs []string) string {
+	switch script {
+	case setStatusScript:
+		members, statuses, id, status := keysAndArgs[0], keysAndArgs[1], keysAndArgs[2], keysAndArgs[3]
+		if _, ok := f.hashes[members][id]; !ok {
+			return ":0\r\n"
+		}
+		return f.run([]string{"HSET", statuses, id, status})
+	case reapScript:
+		members, statuses, version, id, member := keysAndArgs[0], keysAndArgs[1], keysAndArgs[2], keysAndArgs[3], keysAndArgs[4]
+		if value, ok := f.hashes[members][id]; !ok || value != member {
+			return ":0\r\n"
+		}
+		delete(f.hashes[members], id)
+		delete(f.hashes[statuses], id)
+		return f.run([]string{"INCR", version})
+	default:
+		return "-NOSCRIPT unknown script\r\n"
+	}
+}
+
+// Start a real redis-server for the duration of a test, skipping the test if it is not installed
+func startRedisServer(t *testing.T) string {
+	t.Helper()
+	server, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	l.Close()
+
+	cmd := exec.Command(server, "--port", port, "--bind", "127.0.0.1", "--save", "", "--appendonly", "no")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for range 100 {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("redis-server never started listening")
+	return ""
+}
+
+func dialResp(t *testing.T, rawUrl string) *respConn {
+	t.Helper()
+	c, err := parseRedisUrl(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.lock.Lock()
+	err = c.dial(ctx)
+	c.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestParseRedisUrl(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		err      bool
+	}{
+		{"localhost:6379", "localhost:6379", "", 0, false},
+		{"redis://localhost", "localhost:6379", "", 0, false},
+		{"redis://:secret@redis:6380/2", "redis:6380", "secret", 2, false},
+		{"rediss://localhost", "", "", 0, true},
+		{"redis://localhost/db", "", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			c, err := parseRedisUrl(tt.url)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseRedisUrl() error = %v, want error %v", err, tt.err)
+			}
+			if err == nil && (c.addr != tt.addr || c.password != tt.password || c.db != tt.db) {
+				t.Errorf("parseRedisUrl() = %s %q %d, want %s %q %d",
+					c.addr, c.password, c.db, tt.addr, tt.password, tt.db)
+			}
+		})
+	}
+}
+
+func TestRespPipeline(t *testing.T) {
+	f := newFakeRedis(t, "")
+	c := dialResp(t, f.Addr())
+
+	replies, err := c.Pipeline(
+		[]string{"SET", "key", "value"},
+		[]string{"BOGUS"},
+		[]string{"INCR", "counter"},
+		[]string{"GET", "key"},
+		[]string{"GET", "missing"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"OK", RedisError("ERR unknown command 'BOGUS'"), int64(1), "value", nil}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("Pipeline() = %#v, want %#v", replies, want)
+	}
+
+	// error replies leave the connection usable
+	if _, err := c.Do("BOGUS"); !errors.As(err, new(RedisError)) {
+		t.Errorf("Do(BOGUS) error = %v, want a RedisError", err)
+	}
+	if n, err := replyInt(c.Do("INCR", "counter")); err != nil || n != 2 {
+		t.Errorf("INCR = %d, %v, want 2", n, err)
+	}
+}
+
+func TestRespRedial(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	c := dialResp(t, "redis://:secret@"+f.Addr()+"/1")
+
+	if _, err := c.Do("SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	f.dropConns()
+
+	// the broken connection is redialed and authenticated again
+	value, err := c.Do("GET", "key")
+	if err != nil || value != "value" {
+		t.Errorf("GET after a dropped connection = %v, %v, want value", value, err)
+	}
+}
+
+func TestRespAuth(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	c, err := parseRedisUrl("redis://:wrong@" + f.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.lock.Lock()
+	err = c.dial(context.Background())
+	c.lock.Unlock()
+	if !errors.As(err, new(RedisError)) {
+		t.Errorf("dial with a wrong password error = %v, want a RedisError", err)
+	}
+}
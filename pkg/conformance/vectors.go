@@ -0,0 +1,509 @@
+// Package conformance provides golden protocol vectors for testing grogbarrel servers and clients.
+// It does not import testing, so the vectors can be checked and exported by the grogbarrel binary.
+package conformance
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+type Kind byte
+
+const (
+	CLIENT_ANNOUNCE   Kind = iota // clientAnnounce sent by a client
+	CLIENT_STATUS                 // clientStatus sent by a client
+	SERVER_FRAME                  // any message sent by the server, including its type
+	CLIENT_QUEUE                  // queue message sent by a client since v2.2, excluding its type
+	CLIENT_READY                  // ready message sent by a client since v2.3, excluding its type
+	CLIENT_STATUS_ACK             // clientStatus with its acknowledged sequence sent by a client since v2.5, excluding its type
+)
+
+// A golden encoding of a protocol message
+type Vector struct {
+	Name  string
+	Kind  Kind
+	Frame []byte
+	Valid bool
+	// Decoded message of a valid vector:
+	// grog.ClientAnnounceMessage, grog.ClientStatusMessage, grog.ClientStatusAckMessage, grog.ClientQueueMessage,
+	// grog.ClientReadyMessage, grog.ServerAnnounceMessage, grog.ServerStatusMessage, grog.StatusDeltaMessage,
+	// grog.QueueMessage, grog.ReadyMessage,
+	// grog.CountdownMessage, grog.PauseMessage, grog.ResumeMessage, string for errors, or nil for empty messages
+	Message any
+}
+
+var Vectors = []Vector{
+	{
+		Name:    "clientAnnounce",
+		Kind:    CLIENT_ANNOUNCE,
+		Frame:   []byte{1, 5, 0, 'a', 'l', 'i', 'c', 'e'},
+		Valid:   true,
+		Message: grog.ClientAnnounceMessage{Version: util.SemVer{Major: 1, Minor: 5, Patch: 0}, Name: "alice"},
+	},
+	{
+		Name:    "clientAnnounce utf-8 name",
+		Kind:    CLIENT_ANNOUNCE,
+		Frame:   []byte{1, 5, 0, 0xf0, 0x9f, 0x8d, 0xba},
+		Valid:   true,
+		Message: grog.ClientAnnounceMessage{Version: util.SemVer{Major: 1, Minor: 5, Patch: 0}, Name: "🍺"},
+	},
+	{
+		Name:  "clientAnnounce short",
+		Kind:  CLIENT_ANNOUNCE,
+		Frame: []byte{1, 5},
+	},
+	{
+		Name:    "clientStatus playing",
+		Kind:    CLIENT_STATUS,
+		Frame:   []byte{0x01, 0x2c, byte(grog.PLAYING_STATUS)},
+		Valid:   true,
+		Message: grog.ClientStatusMessage{Offset: 300, PlayerState: grog.PLAYING_STATUS},
+	},
+	{
+		Name:    "clientStatus loading",
+		Kind:    CLIENT_STATUS,
+		Frame:   []byte{0xff, 0xff, byte(grog.LOADING_STATUS)},
+		Valid:   true,
+		Message: grog.ClientStatusMessage{Offset: 65535, PlayerState: grog.LOADING_STATUS},
+	},
+	{
+		Name:  "clientStatus short",
+		Kind:  CLIENT_STATUS,
+		Frame: []byte{0x01},
+	},
+	{
+		Name:  "clientStatus acknowledging",
+		Kind:  CLIENT_STATUS_ACK,
+		Frame: []byte{0x01, 0x2c, byte(grog.PLAYING_STATUS), 0, 0, 0, 42},
+		Valid: true,
+		Message: grog.ClientStatusAckMessage{
+			ClientStatusMessage: grog.ClientStatusMessage{Offset: 300, PlayerState: grog.PLAYING_STATUS},
+			Ack:                 42,
+		},
+	},
+	{
+		Name:  "clientStatus missing acknowledgement",
+		Kind:  CLIENT_STATUS_ACK,
+		Frame: []byte{0x01, 0x2c, byte(grog.PLAYING_STATUS)},
+	},
+	{
+		Name: "clientQueue add",
+		Kind: CLIENT_QUEUE,
+		Frame: []byte{byte(grog.QUEUE_ADD), 0x05, 0x46,
+			3, 'e', 'p', '4',
+			0, 8, '/', 'e', 'p', '4', '.', 'm', 'k', 'v',
+		},
+		Valid: true,
+		Message: grog.ClientQueueMessage{Op: grog.QUEUE_ADD,
+			Item: grog.QueueItem{Title: "ep4", Location: "/ep4.mkv", Duration: 1350}},
+	},
+	{
+		Name:    "clientQueue move",
+		Kind:    CLIENT_QUEUE,
+		Frame:   []byte{byte(grog.QUEUE_MOVE), 0, 3, 0, 0},
+		Valid:   true,
+		Message: grog.ClientQueueMessage{Op: grog.QUEUE_MOVE, Index: 3, To: 0},
+	},
+	{
+		Name:    "clientQueue advance",
+		Kind:    CLIENT_QUEUE,
+		Frame:   []byte{byte(grog.QUEUE_ADVANCE)},
+		Valid:   true,
+		Message: grog.ClientQueueMessage{Op: grog.QUEUE_ADVANCE},
+	},
+	{
+		Name:  "clientQueue short remove",
+		Kind:  CLIENT_QUEUE,
+		Frame: []byte{byte(grog.QUEUE_REMOVE), 0},
+	},
+	{
+		Name:  "clientQueue unknown operation",
+		Kind:  CLIENT_QUEUE,
+		Frame: []byte{9},
+	},
+	{
+		Name:    "clientReady ready",
+		Kind:    CLIENT_READY,
+		Frame:   []byte{byte(grog.READY_DONE)},
+		Valid:   true,
+		Message: grog.ClientReadyMessage{Op: grog.READY_DONE},
+	},
+	{
+		Name:  "clientReady unknown operation",
+		Kind:  CLIENT_READY,
+		Frame: []byte{9},
+	},
+	{
+		Name:    "empty",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.EMPTY_MSG)},
+		Valid:   true,
+		Message: nil,
+	},
+	{
+		Name:    "serverAnnounce empty room",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.ANNOUNCE_MSG), 0, 0, 0, 0},
+		Valid:   true,
+		Message: grog.ServerAnnounceMessage{Connections: 0, Clients: []grog.AnnouncedClient{}},
+	},
+	{
+		Name:    "serverAnnounce spectators only",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.ANNOUNCE_MSG), 0, 0, 0x01, 0x02},
+		Valid:   true,
+		Message: grog.ServerAnnounceMessage{Connections: 0, Clients: []grog.AnnouncedClient{}, Spectators: 258},
+	},
+	{
+		Name: "serverAnnounce two clients",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 2,
+			0, 0, 5, 'a', 'l', 'i', 'c', 'e',
+			0x01, 0x2c, 3, 'b', 'o', 'b',
+			0, 1,
+		},
+		Valid: true,
+		Message: grog.ServerAnnounceMessage{Connections: 2, Clients: []grog.AnnouncedClient{
+			{Id: 0, Name: "alice"},
+			{Id: 300, Name: "bob"},
+		}, Spectators: 1},
+	},
+	{
+		Name: "serverAnnounce muted member",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 1,
+			0x01, 0x2c, 3, 'b', 'o', 'b',
+			0, 0,
+			0, 1, 0x01, 0x2c,
+		},
+		Valid: true,
+		Message: grog.ServerAnnounceMessage{Connections: 1, Clients: []grog.AnnouncedClient{
+			{Id: 300, Name: "bob"},
+		}, Muted: []uint16{300}},
+	},
+	{
+		Name:  "serverAnnounce truncated muted members",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 0, 0, 0, 0, 2, 0x01, 0x2c},
+	},
+	{
+		Name: "serverAnnounce stale member",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 1,
+			0x01, 0x2c, 3, 'b', 'o', 'b',
+			0, 0,
+			0, 0,
+			0, 1, 0x01, 0x2c,
+		},
+		Valid: true,
+		Message: grog.ServerAnnounceMessage{Connections: 1, Clients: []grog.AnnouncedClient{
+			{Id: 300, Name: "bob"},
+		}, Muted: []uint16{}, Stale: []uint16{300}},
+	},
+	{
+		Name:  "serverAnnounce truncated stale members",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 0, 0, 0, 0, 0, 0, 2, 0x01, 0x2c},
+	},
+	{
+		Name:  "serverAnnounce truncated name",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 1, 0, 0, 5, 'a', 'l'},
+	},
+	{
+		Name:  "serverAnnounce missing spectators",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 0, 1, 0, 0, 5, 'a', 'l', 'i', 'c', 'e'},
+	},
+	{
+		Name:  "serverAnnounce v1 count",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.ANNOUNCE_MSG), 1, 0, 5, 'a', 'l', 'i', 'c', 'e', 0, 0},
+	},
+	{
+		Name:    "queue empty",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.QUEUE_MSG), 0xff, 0xff, 0, 0},
+		Valid:   true,
+		Message: grog.QueueMessage{Current: grog.QUEUE_END, Items: []grog.QueueItem{}},
+	},
+	{
+		Name: "queue two items",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.QUEUE_MSG), 0, 1, 0, 2,
+			0x05, 0x46, 3, 'e', 'p', '3', 0, 0,
+			0, 0, 3, 'e', 'p', '4', 0, 4, 'e', 'p', '.', '4',
+		},
+		Valid: true,
+		Message: grog.QueueMessage{Current: 1, Items: []grog.QueueItem{
+			{Title: "ep3", Duration: 1350},
+			{Title: "ep4", Location: "ep.4"},
+		}},
+	},
+	{
+		Name:  "queue truncated location",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.QUEUE_MSG), 0, 0, 0, 1, 0, 0, 0, 0, 5, 'e', 'p'},
+	},
+	{
+		Name:    "ready waiting",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.READY_MSG), 1, 0, 2, 0, 3, 0x01, 0x2c},
+		Valid:   true,
+		Message: grog.ReadyMessage{Active: true, Waiting: []uint16{3, 300}},
+	},
+	{
+		Name:    "ready cancelled",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.READY_MSG), 0, 0, 0},
+		Valid:   true,
+		Message: grog.ReadyMessage{Waiting: []uint16{}},
+	},
+	{
+		Name:  "ready truncated",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.READY_MSG), 1, 0, 2, 0, 3},
+	},
+	{
+		Name: "countdown",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.COUNTDOWN_MSG), 0, 0, 0x01, 0x9a, 0x00, 0x00, 0x00, 0x00,
+			0, 0, 0x0b, 0xb8,
+		},
+		Valid:   true,
+		Message: grog.CountdownMessage{Start: 0x019a00000000, Remaining: 3000},
+	},
+	{
+		Name: "countdown started",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.COUNTDOWN_MSG), 0, 0, 0x01, 0x9a, 0x00, 0x00, 0x00, 0x00,
+			0xff, 0xff, 0xff, 0x9c,
+		},
+		Valid:   true,
+		Message: grog.CountdownMessage{Start: 0x019a00000000, Remaining: -100},
+	},
+	{
+		Name:  "countdown truncated",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.COUNTDOWN_MSG), 0, 0, 0x01, 0x9a},
+	},
+	{
+		Name:    "pause",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.PAUSE_MSG), 1, 0x01, 0x2c},
+		Valid:   true,
+		Message: grog.PauseMessage{Paused: true, Id: 300},
+	},
+	{
+		Name:    "pause resumed",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.PAUSE_MSG), 0, 0, 3},
+		Valid:   true,
+		Message: grog.PauseMessage{Id: 3},
+	},
+	{
+		Name:  "pause truncated",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.PAUSE_MSG), 1, 0},
+	},
+	{
+		Name:    "serverStatus empty room",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.STATUS_MSG), 0, 0},
+		Valid:   true,
+		Message: grog.ServerStatusMessage{Statuses: []grog.ClientStatusMessage{}},
+	},
+	{
+		Name: "serverStatus two clients",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.STATUS_MSG), 0, 2,
+			0x01, 0x2c, byte(grog.PLAYING_STATUS), 0, 0,
+			0x00, 0x0a, byte(grog.PAUSED_STATUS), 0x01, 0x2c,
+		},
+		Valid: true,
+		Message: grog.ServerStatusMessage{Statuses: []grog.ClientStatusMessage{
+			{Offset: 300, PlayerState: grog.PLAYING_STATUS, Id: 0},
+			{Offset: 10, PlayerState: grog.PAUSED_STATUS, Id: 300},
+		}},
+	},
+	{
+		Name:  "serverStatus truncated",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.STATUS_MSG), 0, 2, 0x01, 0x2c, byte(grog.PLAYING_STATUS), 0, 0},
+	},
+	{
+		Name: "statusDelta keyframe",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.DELTA_MSG), 0, 0, 0, 7, 0, 0, 0, 0, 0, 2,
+			0x01, 0x2c, byte(grog.PLAYING_STATUS), 0, 0,
+			0x00, 0x0a, byte(grog.PAUSED_STATUS), 0x01, 0x2c,
+		},
+		Valid: true,
+		Message: grog.StatusDeltaMessage{Seq: 7, Statuses: []grog.ClientStatusMessage{
+			{Offset: 300, PlayerState: grog.PLAYING_STATUS, Id: 0},
+			{Offset: 10, PlayerState: grog.PAUSED_STATUS, Id: 300},
+		}},
+	},
+	{
+		Name: "statusDelta one change",
+		Kind: SERVER_FRAME,
+		Frame: []byte{byte(grog.DELTA_MSG), 0, 0, 0, 8, 0, 0, 0, 7, 0, 1,
+			0x01, 0x2d, byte(grog.PLAYING_STATUS), 0, 0,
+		},
+		Valid: true,
+		Message: grog.StatusDeltaMessage{Seq: 8, Base: 7, Statuses: []grog.ClientStatusMessage{
+			{Offset: 301, PlayerState: grog.PLAYING_STATUS, Id: 0},
+		}},
+	},
+	{
+		Name:    "statusDelta unchanged",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.DELTA_MSG), 0, 0, 0, 8, 0, 0, 0, 8, 0, 0},
+		Valid:   true,
+		Message: grog.StatusDeltaMessage{Seq: 8, Base: 8, Statuses: []grog.ClientStatusMessage{}},
+	},
+	{
+		Name:  "statusDelta truncated",
+		Kind:  SERVER_FRAME,
+		Frame: []byte{byte(grog.DELTA_MSG), 0, 0, 0, 8, 0, 0},
+	},
+	{
+		Name:    "resume",
+		Kind:    SERVER_FRAME,
+		Frame:   append([]byte{byte(grog.RESUME_MSG)}, "0123456789abcdef0123456789abcdef"...),
+		Valid:   true,
+		Message: grog.ResumeMessage{Token: "0123456789abcdef0123456789abcdef"},
+	},
+	{
+		Name:  "resume truncated",
+		Kind:  SERVER_FRAME,
+		Frame: append([]byte{byte(grog.RESUME_MSG)}, "0123456789abcdef"...),
+	},
+	{
+		Name:    "error",
+		Kind:    SERVER_FRAME,
+		Frame:   []byte{byte(grog.ERROR_MSG), 'R', 'o', 'o', 'm', ' ', 'i', 's', ' ', 'f', 'u', 'l', 'l'},
+		Valid:   true,
+		Message: "Room is full",
+	},
+}
+
+func (k Kind) String() string {
+	switch k {
+	case CLIENT_ANNOUNCE:
+		return "clientAnnounce"
+	case CLIENT_STATUS:
+		return "clientStatus"
+	case SERVER_FRAME:
+		return "serverFrame"
+	case CLIENT_QUEUE:
+		return "clientQueue"
+	case CLIENT_READY:
+		return "clientReady"
+	case CLIENT_STATUS_ACK:
+		return "clientStatusAck"
+	default:
+		return "unknown"
+	}
+}
+
+// Decode a message sent by a server, see Vector.Message for the returned types
+func DecodeServerFrame(frame []byte) (any, error) {
+	if len(frame) == 0 {
+		return nil, grog.ErrShortMessage
+	}
+
+	switch grog.MessageType(frame[0]) {
+	case grog.EMPTY_MSG:
+		return nil, nil
+	case grog.ANNOUNCE_MSG:
+		return grog.ParseServerAnnounce(frame[1:])
+	case grog.STATUS_MSG:
+		return grog.ParseServerStatus(frame[1:])
+	case grog.DELTA_MSG:
+		return grog.ParseStatusDelta(frame[1:])
+	case grog.RESUME_MSG:
+		return grog.ParseResume(frame[1:])
+	case grog.QUEUE_MSG:
+		return grog.ParseQueue(frame[1:])
+	case grog.READY_MSG:
+		return grog.ParseReady(frame[1:])
+	case grog.COUNTDOWN_MSG:
+		return grog.ParseCountdown(frame[1:])
+	case grog.PAUSE_MSG:
+		return grog.ParsePause(frame[1:])
+	case grog.ERROR_MSG:
+		return string(frame[1:]), nil
+	default:
+		return nil, fmt.Errorf("unknown message type %d", frame[0])
+	}
+}
+
+// Decode the frame of a vector according to its kind
+func Decode(v Vector) (any, error) {
+	switch v.Kind {
+	case CLIENT_ANNOUNCE:
+		return grog.ParseClientAnnounce(v.Frame)
+	case CLIENT_STATUS:
+		return grog.ParseClientStatus(v.Frame, 0)
+	case SERVER_FRAME:
+		return DecodeServerFrame(v.Frame)
+	case CLIENT_QUEUE:
+		return grog.ParseClientQueue(v.Frame)
+	case CLIENT_READY:
+		return grog.ParseClientReady(v.Frame)
+	case CLIENT_STATUS_ACK:
+		return grog.ParseClientStatusAck(v.Frame, 0)
+	default:
+		return nil, fmt.Errorf("unknown vector kind %d", v.Kind)
+	}
+}
+
+// Check that the grog parsers agree with a vector
+func Check(v Vector) error {
+	msg, err := Decode(v)
+	if !v.Valid {
+		if err == nil {
+			return fmt.Errorf("%s: expected an error, decoded %+v", v.Name, msg)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", v.Name, err)
+	} else if !reflect.DeepEqual(msg, v.Message) {
+		return fmt.Errorf("%s: decoded %+v, expected %+v", v.Name, msg, v.Message)
+	}
+	return nil
+}
+
+type jsonVector struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Hex     string `json:"hex"`
+	Valid   bool   `json:"valid"`
+	Message any    `json:"message,omitempty"`
+}
+
+// Write vectors as a json array for validating clients in other languages.
+// Frames are hex encoded and messages use the field names of the grog types.
+func WriteJSON(w io.Writer, vectors []Vector) error {
+	out := make([]jsonVector, len(vectors))
+	for i, v := range vectors {
+		out[i] = jsonVector{
+			Name:    v.Name,
+			Kind:    v.Kind.String(),
+			Hex:     hex.EncodeToString(v.Frame),
+			Valid:   v.Valid,
+			Message: v.Message,
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,157 @@
+package grog
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A room's policy of pausing every member while one is loading.
+// The zero value never pauses.
+type AutoPause struct {
+	Threshold time.Duration // time a member loads before the room pauses
+	MaxStalls int           // pauses a member may cause before they are ignored, 0 for no limit
+	MaxWait   time.Duration // time the room stays paused before ignoring the loading members, 0 for no limit
+}
+
+// Sent to clients since v2.4 when the room pauses for a loading member or resumes
+type PauseMessage struct {
+	Paused bool
+	Id     uint16 // a member the room waits on
+}
+
+func (p AutoPause) Enabled() bool {
+	return p.Threshold > 0
+}
+
+func (m PauseMessage) WriteBytes(p []byte) []byte {
+	if m.Paused {
+		p = append(p, 1)
+	} else {
+		p = append(p, 0)
+	}
+	return binary.BigEndian.AppendUint16(p, m.Id)
+}
+
+// Parse the body of a pause message, excluding the message type
+func ParsePause(p []byte) (PauseMessage, error) {
+	if len(p) < 3 {
+		return PauseMessage{}, ErrShortMessage
+	}
+	return PauseMessage{Paused: p[0] != 0, Id: binary.BigEndian.Uint16(p[1:])}, nil
+}
+
+// Members loading under a room's AutoPause policy
+type stalls struct {
+	loading map[uint16]time.Time // when each loading member started loading
+	counts  map[uint16]int       // pauses caused by each member
+	ignored map[uint16]bool      // members that kept the room paused past MaxWait
+	paused  bool
+	id      uint16    // member the paused room waits on
+	since   time.Time // when the room paused
+	version int       // incremented on every pause and resume
+	sync.Mutex
+}
+
+// Track a member loading, pausing or resuming the room.
+// Stalls are only checked when a status arrives, members send one at least every second.
+func (r *Room) stallStatus(msg ClientStatusMessage, now time.Time) {
+	if !r.AutoPause.Enabled() {
+		return
+	}
+	r.stalls.Lock()
+	defer r.stalls.Unlock()
+
+	if msg.PlayerState != LOADING_STATUS {
+		delete(r.stalls.loading, msg.Id)
+	} else if _, ok := r.stalls.loading[msg.Id]; !ok {
+		r.stalls.loading[msg.Id] = now
+	}
+	r.checkStalls(now)
+}
+
+// Forget a departed member's stalls
+func (r *Room) stallLeave(id uint16) {
+	if !r.AutoPause.Enabled() {
+		return
+	}
+	r.stalls.Lock()
+	defer r.stalls.Unlock()
+
+	delete(r.stalls.loading, id)
+	delete(r.stalls.counts, id)
+	delete(r.stalls.ignored, id)
+	r.checkStalls(time.Now())
+}
+
+// Check if a member has stalled the room too often, must hold the stalls lock
+func (r *Room) stallIgnored(id uint16) bool {
+	if r.stalls.ignored[id] {
+		return true
+	}
+	return r.AutoPause.MaxStalls > 0 && r.stalls.counts[id] >= r.AutoPause.MaxStalls
+}
+
+// Pause once a member loads past the threshold and resume when no member is loading.
+// Must hold the stalls lock.
+func (r *Room) checkStalls(now time.Time) {
+	s := &r.stalls
+	policy := r.AutoPause
+
+	if !s.paused {
+		for id, since := range s.loading {
+			if r.stallIgnored(id) || now.Sub(since) < policy.Threshold {
+				continue
+			}
+			s.counts[id]++
+			s.paused, s.id, s.since = true, id, now
+			s.version++
+			r.logger.Info("Member stalled, pausing room",
+				slog.Int("id", int(id)),
+				slog.Int("stalls", s.counts[id]),
+			)
+			return
+		}
+		return
+	}
+
+	if policy.MaxWait > 0 && now.Sub(s.since) >= policy.MaxWait {
+		for id := range s.loading {
+			if !s.ignored[id] {
+				r.logger.Warn("Stalled too long, ignoring member", slog.Int("id", int(id)))
+				s.ignored[id] = true
+			}
+		}
+	}
+	// members out of stalls still hold the pause they caused
+	for id := range s.loading {
+		if s.ignored[id] || (id != s.id && r.stallIgnored(id)) {
+			continue
+		}
+		if id != s.id {
+			s.id = id
+			s.version++
+		}
+		return
+	}
+	s.paused = false
+	s.version++
+	r.logger.Info("No member loading, resuming room")
+}
+
+// Check for a changed pause
+func (r *Room) CheckPause(lastPause int) (int, bool) {
+	r.stalls.Lock()
+	defer r.stalls.Unlock()
+	return max(r.stalls.version, lastPause), r.stalls.version > lastPause
+}
+
+// The pause frame sent to clients since v2.4
+func (r *Room) PauseFrame() []byte {
+	r.stalls.Lock()
+	defer r.stalls.Unlock()
+
+	msg := PauseMessage{Paused: r.stalls.paused, Id: r.stalls.id}
+	return msg.WriteBytes([]byte{byte(PAUSE_MSG)})
+}
@@ -0,0 +1,70 @@
+package grog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoPause(t *testing.T) {
+	const alice, bob = 0, 1
+	r := newTestRoom(t)
+	r.AutoPause = AutoPause{Threshold: 2 * time.Second, MaxStalls: 2, MaxWait: 10 * time.Second}
+	start := time.Now()
+
+	steps := []struct {
+		name  string
+		id    uint16
+		state PlayerState
+		at    time.Duration
+		want  PauseMessage
+		// the pause frame changed
+		changed bool
+	}{
+		{"loading", alice, LOADING_STATUS, 0, PauseMessage{}, false},
+		{"under the threshold", alice, LOADING_STATUS, 1 * time.Second, PauseMessage{}, false},
+		{"stalled", alice, LOADING_STATUS, 2 * time.Second, PauseMessage{true, alice}, true},
+		{"another loading", bob, LOADING_STATUS, 3 * time.Second, PauseMessage{true, alice}, false},
+		{"waits on the other", alice, PLAYING_STATUS, 4 * time.Second, PauseMessage{true, bob}, true},
+		{"resumed", bob, PLAYING_STATUS, 5 * time.Second, PauseMessage{false, bob}, true},
+		{"second stall", alice, LOADING_STATUS, 6 * time.Second, PauseMessage{false, bob}, false},
+		{"second stall pauses", alice, LOADING_STATUS, 8 * time.Second, PauseMessage{true, alice}, true},
+		{"resumed again", alice, PAUSED_STATUS, 9 * time.Second, PauseMessage{false, alice}, true},
+		{"out of stalls", alice, LOADING_STATUS, 10 * time.Second, PauseMessage{false, alice}, false},
+		{"out of stalls past the threshold", alice, LOADING_STATUS, 13 * time.Second, PauseMessage{false, alice}, false},
+		{"another stall", bob, LOADING_STATUS, 14 * time.Second, PauseMessage{false, alice}, false},
+		{"paused past max wait", bob, LOADING_STATUS, 16 * time.Second, PauseMessage{true, bob}, true},
+		{"ignored past max wait", bob, LOADING_STATUS, 26 * time.Second, PauseMessage{false, bob}, true},
+	}
+	last := 0
+	for _, step := range steps {
+		r.stallStatus(ClientStatusMessage{Id: step.id, PlayerState: step.state}, start.Add(step.at))
+
+		frame := r.PauseFrame()
+		if MessageType(frame[0]) != PAUSE_MSG {
+			t.Fatalf("frame %v is not a pause", frame)
+		}
+		got, err := ParsePause(frame[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("%s: pause = %+v, want %+v", step.name, got, step.want)
+		}
+		var changed bool
+		if last, changed = r.CheckPause(last); changed != step.changed {
+			t.Errorf("%s: CheckPause() changed = %v, want %v", step.name, changed, step.changed)
+		}
+	}
+}
+
+// Rooms without a policy never pause
+func TestAutoPauseDisabled(t *testing.T) {
+	r := newTestRoom(t)
+	start := time.Now()
+	for i := range 10 {
+		r.stallStatus(ClientStatusMessage{PlayerState: LOADING_STATUS}, start.Add(time.Duration(i)*time.Minute))
+	}
+	if _, changed := r.CheckPause(0); changed {
+		t.Error("room without a policy paused")
+	}
+}
@@ -0,0 +1,140 @@
+package grog
+
+import (
+	"errors"
+	"iter"
+	"slices"
+	"sync"
+)
+
+var ErrNoFreeId error = errors.New("No free id in room")
+
+// Shares room membership and statuses between server instances.
+// Rooms are identified by name, so one backend serves every room.
+type Backend interface {
+	// Claim the first unused id of candidates for a member named name
+	Claim(room string, candidates iter.Seq[uint16], name string) (uint16, error)
+	Release(room string, id uint16) error
+	SetStatus(room string, status ClientStatusMessage) error
+	// Members of a room on every instance, ordered by id
+	Members(room string) ([]AnnouncedClient, error)
+	// Statuses of a room on every instance, ordered by id
+	Statuses(room string) ([]ClientStatusMessage, error)
+	// Counter that changes whenever a room's membership does
+	Version(room string) (int64, error)
+}
+
+type memoryRoom struct {
+	members  map[uint16]string
+	statuses map[uint16]ClientStatusMessage
+	version  int64
+}
+
+// Backend for a single instance
+type MemoryBackend struct {
+	rooms map[string]*memoryRoom
+	// versions are unique across rooms so a recreated room never repeats one
+	version int64
+	lock    sync.Mutex
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{rooms: make(map[string]*memoryRoom)}
+}
+
+// Get a room, creating it if it does not exist. Must hold the lock.
+func (b *MemoryBackend) room(name string) *memoryRoom {
+	room, ok := b.rooms[name]
+	if !ok {
+		room = &memoryRoom{
+			members:  make(map[uint16]string),
+			statuses: make(map[uint16]ClientStatusMessage),
+		}
+		b.rooms[name] = room
+	}
+	return room
+}
+
+var emptyMemoryRoom = memoryRoom{}
+
+// Get a room without creating it. Must hold the lock.
+func (b *MemoryBackend) peek(name string) *memoryRoom {
+	if room, ok := b.rooms[name]; ok {
+		return room
+	}
+	return &emptyMemoryRoom
+}
+
+func (b *MemoryBackend) Claim(name string, candidates iter.Seq[uint16], member string) (uint16, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	room := b.room(name)
+	for id := range candidates {
+		if _, taken := room.members[id]; !taken {
+			room.members[id] = member
+			b.version++
+			room.version = b.version
+			return id, nil
+		}
+	}
+	return 0, ErrNoFreeId
+}
+
+func (b *MemoryBackend) Release(name string, id uint16) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	room := b.room(name)
+	delete(room.members, id)
+	delete(room.statuses, id)
+	b.version++
+	room.version = b.version
+	if len(room.members) == 0 {
+		delete(b.rooms, name)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) SetStatus(name string, status ClientStatusMessage) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// statuses of released members are dropped
+	room := b.peek(name)
+	if _, ok := room.members[status.Id]; ok {
+		room.statuses[status.Id] = status
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Members(name string) ([]AnnouncedClient, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	room := b.peek(name)
+	members := make([]AnnouncedClient, 0, len(room.members))
+	for id, member := range room.members {
+		members = append(members, AnnouncedClient{id, member})
+	}
+	slices.SortFunc(members, func(a, b AnnouncedClient) int { return int(a.Id) - int(b.Id) })
+	return members, nil
+}
+
+func (b *MemoryBackend) Statuses(name string) ([]ClientStatusMessage, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	room := b.peek(name)
+	statuses := make([]ClientStatusMessage, 0, len(room.statuses))
+	for _, status := range room.statuses {
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b ClientStatusMessage) int { return int(a.Id) - int(b.Id) })
+	return statuses, nil
+}
+
+func (b *MemoryBackend) Version(name string) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.peek(name).version, nil
+}
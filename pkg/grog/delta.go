@@ -0,0 +1,120 @@
+package grog
+
+import (
+	"encoding/binary"
+	"slices"
+	"sync"
+)
+
+// Deltas sent to a connection between keyframes
+const KEYFRAME_INTERVAL = 30
+
+// The statuses that changed since a client's acknowledged sequence, sent instead of serverStatus since v2.5
+type StatusDeltaMessage struct {
+	Seq      uint32 // sequence of the room's statuses after applying the delta
+	Base     uint32 // sequence the delta applies to, 0 for a keyframe holding every status
+	Statuses []ClientStatusMessage
+}
+
+// A clientStatus sent since v2.5, acknowledging the last status sequence the client applied
+type ClientStatusAckMessage struct {
+	ClientStatusMessage
+	Ack uint32 // 0 asks for a keyframe
+}
+
+func (m StatusDeltaMessage) Keyframe() bool {
+	return m.Base == 0
+}
+
+func (m StatusDeltaMessage) WriteBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint32(p, m.Seq)
+	p = binary.BigEndian.AppendUint32(p, m.Base)
+	return ServerStatusMessage{Statuses: m.Statuses}.WriteBytes(p)
+}
+
+func (m ClientStatusAckMessage) WriteBytes(p []byte) []byte {
+	p = m.WriteClientBytes(p)
+	return binary.BigEndian.AppendUint32(p, m.Ack)
+}
+
+// Parse a clientStatus with its acknowledged sequence
+func ParseClientStatusAck(p []byte, id uint16) (ClientStatusAckMessage, error) {
+	if len(p) < 7 {
+		return ClientStatusAckMessage{}, ErrShortMessage
+	}
+	status, err := ParseClientStatus(p, id)
+	return ClientStatusAckMessage{ClientStatusMessage: status, Ack: binary.BigEndian.Uint32(p[3:])}, err
+}
+
+// Parse the body of a status delta message, excluding the message type
+func ParseStatusDelta(p []byte) (StatusDeltaMessage, error) {
+	if len(p) < 8 {
+		return StatusDeltaMessage{}, ErrShortMessage
+	}
+	msg := StatusDeltaMessage{
+		Seq:  binary.BigEndian.Uint32(p),
+		Base: binary.BigEndian.Uint32(p[4:]),
+	}
+	status, err := ParseServerStatus(p[8:])
+	msg.Statuses = status.Statuses
+	return msg, err
+}
+
+// The room's statuses by sequence.
+// Removed members are not part of deltas, clients drop them when they leave the serverAnnounce.
+type statusHistory struct {
+	seq     uint32                         // incremented when a built status differs from the last
+	last    map[uint16]ClientStatusMessage // statuses as of seq
+	changed map[uint16]uint32              // sequence each member's status last changed at
+	sync.RWMutex
+}
+
+// Record the statuses of a newly built serverStatus
+func (r *Room) recordStatuses(statuses []ClientStatusMessage) {
+	r.history.Lock()
+	defer r.history.Unlock()
+
+	h := &r.history
+	seq := h.seq + 1
+	changed := false
+	present := make(map[uint16]bool, len(statuses))
+	for _, status := range statuses {
+		present[status.Id] = true
+		if old, ok := h.last[status.Id]; ok && old == status {
+			continue
+		}
+		h.last[status.Id] = status
+		h.changed[status.Id] = seq
+		changed = true
+	}
+	for id := range h.last {
+		if !present[id] {
+			delete(h.last, id)
+			delete(h.changed, id)
+			changed = true
+		}
+	}
+	if changed {
+		h.seq = seq
+	}
+}
+
+// Build the delta from the acknowledged sequence ack to the room's current statuses.
+// A keyframe is built when asked for or when ack is unknown to the room.
+func (r *Room) StatusDelta(ack uint32, keyframe bool) StatusDeltaMessage {
+	r.history.RLock()
+	defer r.history.RUnlock()
+
+	h := &r.history
+	msg := StatusDeltaMessage{Seq: h.seq, Base: ack, Statuses: make([]ClientStatusMessage, 0, len(h.last))}
+	if keyframe || ack == 0 || ack > h.seq {
+		msg.Base = 0
+	}
+	for id, status := range h.last {
+		if msg.Keyframe() || h.changed[id] > ack {
+			msg.Statuses = append(msg.Statuses, status)
+		}
+	}
+	slices.SortFunc(msg.Statuses, func(a, b ClientStatusMessage) int { return int(a.Id) - int(b.Id) })
+	return msg
+}
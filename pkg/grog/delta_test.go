@@ -0,0 +1,73 @@
+package grog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatusSequence(t *testing.T) {
+	r := newTestRoom(t)
+	a0 := ClientStatusMessage{Id: 0, Offset: 1, PlayerState: PLAYING_STATUS}
+	a1 := ClientStatusMessage{Id: 0, Offset: 2, PlayerState: PLAYING_STATUS}
+	b0 := ClientStatusMessage{Id: 1, Offset: 1, PlayerState: PAUSED_STATUS}
+
+	builds := []struct {
+		name     string
+		statuses []ClientStatusMessage
+		seq      uint32
+	}{
+		{"first", []ClientStatusMessage{a0, b0}, 2},
+		{"unchanged", []ClientStatusMessage{a0, b0}, 2},
+		{"changed", []ClientStatusMessage{a1, b0}, 3},
+		{"removed", []ClientStatusMessage{a1}, 4},
+	}
+	for _, build := range builds {
+		r.recordStatuses(build.statuses)
+		if seq := r.StatusDelta(0, false).Seq; seq != build.seq {
+			t.Errorf("%s: sequence %d, want %d", build.name, seq, build.seq)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		ack      uint32
+		keyframe bool
+		want     StatusDeltaMessage
+	}{
+		{"no ack", 0, false, StatusDeltaMessage{4, 0, []ClientStatusMessage{a1}}},
+		{"before the change", 2, false, StatusDeltaMessage{4, 2, []ClientStatusMessage{a1}}},
+		{"after the change", 3, false, StatusDeltaMessage{4, 3, []ClientStatusMessage{}}},
+		{"current", 4, false, StatusDeltaMessage{4, 4, []ClientStatusMessage{}}},
+		{"unknown", 9, false, StatusDeltaMessage{4, 0, []ClientStatusMessage{a1}}},
+		{"keyframe", 3, true, StatusDeltaMessage{4, 0, []ClientStatusMessage{a1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.StatusDelta(tt.ack, tt.keyframe)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StatusDelta() = %+v, want %+v", got, tt.want)
+			}
+			parsed, err := ParseStatusDelta(got.WriteBytes(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Seq != got.Seq || parsed.Base != got.Base || len(parsed.Statuses) != len(got.Statuses) {
+				t.Errorf("ParseStatusDelta() = %+v, want %+v", parsed, got)
+			}
+		})
+	}
+}
+
+func TestClientStatusAck(t *testing.T) {
+	msg := ClientStatusAckMessage{ClientStatusMessage{Offset: 300, PlayerState: LOADING_STATUS, Id: 7}, 70000}
+	got, err := ParseClientStatusAck(msg.WriteBytes(nil), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Errorf("ParseClientStatusAck() = %+v, want %+v", got, msg)
+	}
+	if _, err := ParseClientStatusAck(msg.WriteBytes(nil)[:6], 7); err != ErrShortMessage {
+		t.Errorf("ParseClientStatusAck() of a short message error = %v, want %v", err, ErrShortMessage)
+	}
+}
@@ -0,0 +1,221 @@
+package grog
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+type EventKind string
+
+const (
+	ROOM_CREATED_EVENT  EventKind = "room.created" // first member joined
+	ROOM_CLOSED_EVENT   EventKind = "room.closed"  // last member left
+	MEMBER_JOINED_EVENT EventKind = "member.joined"
+	MEMBER_LEFT_EVENT   EventKind = "member.left"
+	STATUS_EVENT        EventKind = "member.status" // every clientStatus
+	PLAY_EVENT          EventKind = "state.play"
+	PAUSE_EVENT         EventKind = "state.pause"
+	SEEK_EVENT          EventKind = "state.seek"
+)
+
+// Every kind of event a room emits
+var EventKinds = []EventKind{
+	ROOM_CREATED_EVENT, ROOM_CLOSED_EVENT, MEMBER_JOINED_EVENT, MEMBER_LEFT_EVENT,
+	STATUS_EVENT, PLAY_EVENT, PAUSE_EVENT, SEEK_EVENT,
+}
+
+// What a subscription does with events that do not fit in its buffer
+type DropPolicy byte
+
+const (
+	DROP_NEWEST DropPolicy = iota // discard the new event
+	DROP_OLDEST                   // discard the oldest buffered event
+)
+
+// Seconds a member's offset may drift from its expected position before it counts as a seek
+const SEEK_THRESHOLD = 3
+
+// Member an event is about
+type EventMember struct {
+	Id   uint16 `json:"id"`
+	Name string `json:"name"`
+}
+
+// A change in a room's state
+type Event struct {
+	Kind   EventKind    `json:"event"`
+	Room   string       `json:"room"`
+	Time   time.Time    `json:"time"`
+	Member *EventMember `json:"member,omitempty"`
+	// offset of state events
+	Offset *uint16 `json:"offset,omitempty"`
+	// status of status events
+	Status *ClientStatusMessage `json:"status,omitempty"`
+}
+
+// Events of a room, recieved on C until Unsubscribe
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	policy  DropPolicy
+	dropped atomic.Uint64
+	room    *Room
+}
+
+// Recieve the room's events.
+// Events are sent while the room is locked, so a full buffer drops events according to policy instead of blocking.
+func (r *Room) Subscribe(buffer int, policy DropPolicy) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, policy: policy, room: r}
+
+	r.subscribers.Lock()
+	r.subscribers.list = append(r.subscribers.list, sub)
+	r.subscribers.Unlock()
+
+	return sub
+}
+
+// Stop recieving events and close C
+func (s *Subscription) Unsubscribe() {
+	r := s.room
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	s.unsubscribe()
+}
+
+// Must hold the subscribers lock
+func (s *Subscription) unsubscribe() {
+	r := s.room
+	if i := slices.Index(r.subscribers.list, s); i >= 0 {
+		r.subscribers.list = slices.Delete(r.subscribers.list, i, i+1)
+		close(s.c)
+	}
+}
+
+// Run watch on a new subscription each time the room opens, starting with room.created.
+// The subscription is unsubscribed once the room empties, after room.closed, so watch should return once C is closed.
+func (r *Room) SubscribeWhileOpen(buffer int, policy DropPolicy, watch func(*Subscription)) {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+
+	w := &watcher{buffer: buffer, policy: policy, watch: watch}
+	r.subscribers.watchers = append(r.subscribers.watchers, w)
+	if r.Open {
+		w.open(r)
+	}
+}
+
+// Subscribe the room's watchers as it opens, must hold the ids lock
+func (r *Room) openWatchers() {
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	for _, w := range r.subscribers.watchers {
+		w.open(r)
+	}
+}
+
+// Unsubscribe the room's watchers as it empties, must hold the ids lock
+func (r *Room) closeWatchers() {
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	for _, w := range r.subscribers.watchers {
+		if w.sub != nil {
+			w.sub.unsubscribe()
+			w.sub = nil
+		}
+	}
+}
+
+// Must hold the subscribers lock
+func (w *watcher) open(r *Room) {
+	c := make(chan Event, w.buffer)
+	w.sub = &Subscription{C: c, c: c, policy: w.policy, room: r}
+	r.subscribers.list = append(r.subscribers.list, w.sub)
+	go w.watch(w.sub)
+}
+
+// Subscribes with SubscribeWhileOpen, sub is only set while the room is open
+type watcher struct {
+	buffer int
+	policy DropPolicy
+	watch  func(*Subscription)
+	sub    *Subscription
+}
+
+// Number of events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Must hold the subscribers lock
+func (s *Subscription) send(event Event) {
+	select {
+	case s.c <- event:
+		return
+	default:
+	}
+
+	s.dropped.Add(1)
+	if s.policy == DROP_OLDEST {
+		select {
+		case <-s.c:
+		default:
+		}
+		select {
+		case s.c <- event:
+		default:
+		}
+	}
+}
+
+func (r *Room) hasSubscribers() bool {
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	return len(r.subscribers.list) > 0
+}
+
+func (r *Room) publish(event Event) {
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	for _, sub := range r.subscribers.list {
+		sub.send(event)
+	}
+}
+
+// Send an event to the room's subscribers
+func (r *Room) emit(kind EventKind, client *Client, id uint16, offset *uint16) {
+	if !r.hasSubscribers() {
+		return
+	}
+
+	event := Event{Kind: kind, Room: r.Name, Time: time.Now(), Offset: offset}
+	if client != nil {
+		event.Member = &EventMember{Id: id, Name: client.Name}
+	}
+	r.publish(event)
+}
+
+// Emit a state event when a member starts playing, pauses or seeks
+func (r *Room) emitStateChange(client Client, prev *ClientStatusMessage, msg ClientStatusMessage, elapsed time.Duration) {
+	offset := msg.Offset
+	if prev == nil || msg.PlayerState != prev.PlayerState {
+		switch msg.PlayerState {
+		case PLAYING_STATUS:
+			r.emit(PLAY_EVENT, &client, msg.Id, &offset)
+		case PAUSED_STATUS:
+			r.emit(PAUSE_EVENT, &client, msg.Id, &offset)
+		}
+		return
+	}
+
+	expected := int(prev.Offset)
+	if prev.PlayerState == PLAYING_STATUS {
+		expected += int(elapsed.Seconds())
+	}
+	if drift := int(msg.Offset) - expected; drift > SEEK_THRESHOLD || drift < -SEEK_THRESHOLD {
+		r.emit(SEEK_EVENT, &client, msg.Id, &offset)
+	}
+}
@@ -0,0 +1,83 @@
+package grog
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+func subscriberCount(r *Room) int {
+	r.subscribers.Lock()
+	defer r.subscribers.Unlock()
+	return len(r.subscribers.list)
+}
+
+// Watch the room, sending the kinds of events each subscription recieved once it is released
+func watchRoom(r *Room) <-chan []EventKind {
+	watches := make(chan []EventKind, 4)
+	r.SubscribeWhileOpen(16, DROP_NEWEST, func(sub *Subscription) {
+		var kinds []EventKind
+		for event := range sub.C {
+			kinds = append(kinds, event.Kind)
+		}
+		watches <- kinds
+	})
+	return watches
+}
+
+// Events recieved by the next released subscription
+func watchEvents(t *testing.T, watches <-chan []EventKind) []EventKind {
+	t.Helper()
+	select {
+	case kinds := <-watches:
+		return kinds
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was never released")
+		return nil
+	}
+}
+
+// Watches only hold a subscription while the room has members
+func TestSubscribeWhileOpen(t *testing.T) {
+	r := newTestRoom(t)
+	watches := watchRoom(r)
+	if n := subscriberCount(r); n != 0 {
+		t.Fatalf("%d subscribers before the room opened, want 0", n)
+	}
+
+	want := []EventKind{ROOM_CREATED_EVENT, MEMBER_JOINED_EVENT, MEMBER_JOINED_EVENT,
+		MEMBER_LEFT_EVENT, MEMBER_LEFT_EVENT, ROOM_CLOSED_EVENT}
+	for _, name := range []string{"opened", "reopened"} {
+		alice, _ := joinRoom(t, r, "alice", util.ServerVersion)
+		bob, _ := joinRoom(t, r, "bob", util.ServerVersion)
+		if n := subscriberCount(r); n != 1 {
+			t.Errorf("%s: %d subscribers, want 1", name, n)
+		}
+		r.Leave(alice)
+		r.Leave(bob)
+
+		if kinds := watchEvents(t, watches); !slices.Equal(kinds, want) {
+			t.Errorf("%s: events %v, want %v", name, kinds, want)
+		}
+		if n := subscriberCount(r); n != 0 {
+			t.Errorf("%s: %d subscribers once empty, want 0", name, n)
+		}
+	}
+}
+
+// Watching an open room subscribes immediately
+func TestSubscribeWhileOpenJoined(t *testing.T) {
+	r := newTestRoom(t)
+	alice, _ := joinRoom(t, r, "alice", util.ServerVersion)
+	watches := watchRoom(r)
+	if n := subscriberCount(r); n != 1 {
+		t.Errorf("%d subscribers, want 1", n)
+	}
+
+	r.Leave(alice)
+	if kinds, want := watchEvents(t, watches), []EventKind{MEMBER_LEFT_EVENT, ROOM_CLOSED_EVENT}; !slices.Equal(kinds, want) {
+		t.Errorf("events %v, want %v", kinds, want)
+	}
+}
@@ -0,0 +1,145 @@
+package grog
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kick reason sent to members evicted for missing heartbeats
+const EVICT_REASON = "missed heartbeats"
+
+// A room's policy for members that stop sending messages.
+// Every message and pong from a member counts as a heartbeat.
+// The zero value never marks members stale or evicts them.
+type Heartbeat struct {
+	Interval   time.Duration // how often members are pinged and idle members should send a heartbeat
+	StaleAfter time.Duration // silence before a member is announced as stale
+	EvictAfter time.Duration // silence before a member is evicted
+}
+
+// Heartbeat policy of rooms that don't set one
+var DefaultHeartbeat = Heartbeat{
+	Interval:   15 * time.Second,
+	StaleAfter: 30 * time.Second,
+	EvictAfter: 1 * time.Minute,
+}
+
+// When each member was last heard from
+type heartbeats struct {
+	seen  map[uint16]time.Time
+	stale map[uint16]bool // members announced as stale
+	sync.Mutex
+}
+
+func (h Heartbeat) Enabled() bool {
+	return h.Interval > 0
+}
+
+// Record a heartbeat from a member, a stale member is no longer announced as stale
+func (r *Room) Seen(id uint16) {
+	if !r.Heartbeat.Enabled() {
+		return
+	}
+	r.beats.Lock()
+	if _, ok := r.beats.seen[id]; !ok {
+		r.beats.Unlock()
+		return
+	}
+	r.beats.seen[id] = time.Now()
+	stale := r.beats.stale[id]
+	r.beats.Unlock()
+	if !stale {
+		return
+	}
+
+	r.ids.Lock()
+	defer r.ids.Unlock()
+	r.beats.Lock()
+	stale = r.beats.stale[id]
+	delete(r.beats.stale, id)
+	r.beats.Unlock()
+	if stale {
+		r.logger.Info("Stale member is back", slog.Int("id", int(id)))
+		r.announceChanged()
+	}
+}
+
+// Start tracking a joined member, must hold the ids lock
+func (r *Room) beatJoin(id uint16) {
+	r.beats.Lock()
+	defer r.beats.Unlock()
+	r.beats.seen[id] = time.Now()
+	delete(r.beats.stale, id)
+}
+
+// Stop tracking a departed member, must hold the ids lock
+func (r *Room) beatLeave(id uint16) {
+	r.beats.Lock()
+	defer r.beats.Unlock()
+	delete(r.beats.seen, id)
+	delete(r.beats.stale, id)
+}
+
+// Members announced as stale, sorted by id
+func (r *Room) staleMembers() []uint16 {
+	r.beats.Lock()
+	defer r.beats.Unlock()
+
+	stale := make([]uint16, 0, len(r.beats.stale))
+	for id := range r.beats.stale {
+		stale = append(stale, id)
+	}
+	slices.Sort(stale)
+	return stale
+}
+
+// Mark silent members stale and evict those silent for too long.
+// Evicted members are kicked and leave through Room.Leave once their connection closes.
+func (r *Room) checkHeartbeats(now time.Time) {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	policy := r.Heartbeat
+	changed := false
+	r.beats.Lock()
+	for id, seen := range r.beats.seen {
+		silent := now.Sub(seen)
+		if silent >= policy.EvictAfter {
+			select {
+			case r.ids.kicks[id] <- EVICT_REASON:
+				r.logger.Info("Evicting member", slog.Int("id", int(id)), slog.Duration("silent", silent))
+			default:
+				// already kicked
+			}
+		} else if silent >= policy.StaleAfter && !r.beats.stale[id] {
+			r.beats.stale[id] = true
+			changed = true
+			r.logger.Info("Member is stale", slog.Int("id", int(id)), slog.Duration("silent", silent))
+		}
+	}
+	r.beats.Unlock()
+
+	if changed {
+		r.announceChanged()
+	}
+}
+
+// Check the room's heartbeats every interval until done
+func (r *Room) runHeartbeats(done <-chan struct{}) {
+	if !r.Heartbeat.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(r.Heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			r.checkHeartbeats(now)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package grog
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+func TestHeartbeats(t *testing.T) {
+	r := newTestRoom(t)
+	r.Heartbeat = DefaultHeartbeat
+	alice, _ := joinRoom(t, r, "alice", util.ServerVersion)
+	bob, _ := joinRoom(t, r, "bob", util.ServerVersion)
+
+	// how long each member was silent, alice is always heard from
+	silent := func(d time.Duration) func(now time.Time) {
+		return func(now time.Time) {
+			r.beats.Lock()
+			r.beats.seen[alice] = now
+			r.beats.seen[bob] = now.Add(-d)
+			r.beats.Unlock()
+		}
+	}
+	seen := func(now time.Time) { r.Seen(bob) }
+
+	steps := []struct {
+		name   string
+		before func(now time.Time)
+		stale  []uint16
+		kicked bool
+	}{
+		{"heard from", silent(0), []uint16{}, false},
+		{"under stale", silent(DefaultHeartbeat.StaleAfter - time.Second), []uint16{}, false},
+		{"stale", silent(DefaultHeartbeat.StaleAfter), []uint16{bob}, false},
+		{"still stale", silent(DefaultHeartbeat.StaleAfter + time.Second), []uint16{bob}, false},
+		{"back", seen, []uint16{}, false},
+		{"evicted", silent(DefaultHeartbeat.EvictAfter), []uint16{}, true},
+	}
+	for _, step := range steps {
+		now := time.Now()
+		step.before(now)
+		r.checkHeartbeats(now)
+
+		if stale := r.staleMembers(); !slices.Equal(stale, step.stale) {
+			t.Errorf("%s: stale %v, want %v", step.name, stale, step.stale)
+		}
+		select {
+		case reason := <-r.Kicked(bob):
+			if !step.kicked || reason != EVICT_REASON {
+				t.Errorf("%s: kicked for %q, want kicked %v for %q", step.name, reason, step.kicked, EVICT_REASON)
+			}
+		default:
+			if step.kicked {
+				t.Errorf("%s: not evicted", step.name)
+			}
+		}
+		if len(r.Kicked(alice)) != 0 {
+			t.Errorf("%s: evicted a member that was heard from", step.name)
+		}
+	}
+}
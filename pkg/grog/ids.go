@@ -0,0 +1,144 @@
+package grog
+
+import (
+	"iter"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A room's members by id and the ids held for departed members.
+// Free ids are tracked so joining never scans every id.
+type memberIds struct {
+	members  map[uint16]Client
+	tokens   map[uint16]string
+	reserved map[uint16]reservation
+	kicks    map[uint16]chan string // recieves the reason a member is kicked
+	host     int                    // id of the room's host, -1 without members
+	free     []uint16               // released ids below next, ascending
+	next     int                    // lowest id never taken
+	held     []heldId               // reservations in the order they expire, including stale ones
+	sync.RWMutex
+}
+
+type heldId struct {
+	id      uint16
+	expires time.Time
+}
+
+func newMemberIds() memberIds {
+	return memberIds{
+		members:  make(map[uint16]Client),
+		tokens:   make(map[uint16]string),
+		reserved: make(map[uint16]reservation),
+		kicks:    make(map[uint16]chan string),
+		host:     -1,
+	}
+}
+
+// Ids without a member below limit in the order they should be claimed:
+// released ids, never taken ids, then ids held for departed members.
+// Must hold the lock.
+func (m *memberIds) candidates(limit int) iter.Seq[uint16] {
+	m.expire(time.Now())
+	return func(yield func(uint16) bool) {
+		for _, id := range m.free {
+			if int(id) >= limit {
+				break
+			} else if !yield(id) {
+				return
+			}
+		}
+		for id := m.next; id < limit; id++ {
+			if !yield(uint16(id)) {
+				return
+			}
+		}
+		for _, h := range m.held {
+			if int(h.id) < limit && m.holds(h) && !yield(h.id) {
+				return
+			}
+		}
+	}
+}
+
+// Check if a held id is still reserved, must hold the lock
+func (m *memberIds) holds(h heldId) bool {
+	res, ok := m.reserved[h.id]
+	return ok && res.expires.Equal(h.expires)
+}
+
+// Free the ids of expired reservations, must hold the lock
+func (m *memberIds) expire(now time.Time) {
+	for len(m.held) > 0 {
+		h := m.held[0]
+		if m.holds(h) {
+			if now.Before(h.expires) {
+				return
+			}
+			m.release(h.id)
+		}
+		m.held = m.held[1:]
+	}
+}
+
+// Remove an id from the free ids, must hold the lock
+func (m *memberIds) take(id uint16) {
+	if int(id) >= m.next {
+		for skipped := m.next; skipped < int(id); skipped++ {
+			m.free = append(m.free, uint16(skipped))
+		}
+		m.next = int(id) + 1
+	} else if i, ok := slices.BinarySearch(m.free, id); ok {
+		m.free = slices.Delete(m.free, i, i+1)
+	}
+	delete(m.reserved, id)
+}
+
+// Return an unused id to the free ids, dropping its reservation. Must hold the lock.
+func (m *memberIds) release(id uint16) {
+	delete(m.reserved, id)
+	if i, ok := slices.BinarySearch(m.free, id); !ok && int(id) < m.next {
+		m.free = slices.Insert(m.free, i, id)
+	}
+}
+
+// Hold an unused id for a departed member, must hold the lock
+func (m *memberIds) hold(id uint16, res reservation) {
+	m.take(id)
+	m.reserved[id] = res
+	m.held = append(m.held, heldId{id, res.expires})
+}
+
+// Must hold the lock
+func (m *memberIds) add(id uint16, client Client, token string) {
+	m.take(id)
+	m.members[id] = client
+	m.tokens[id] = token
+	m.kicks[id] = make(chan string, 1)
+	if m.host == -1 {
+		m.host = int(id)
+	}
+}
+
+// Remove a member, holding its id for res unless the member has no token.
+// The member with the lowest id becomes host when the host leaves. Must hold the lock.
+func (m *memberIds) remove(id uint16, res reservation) {
+	delete(m.members, id)
+	delete(m.tokens, id)
+	delete(m.kicks, id)
+	if res.token == "" {
+		m.release(id)
+	} else {
+		m.hold(id, res)
+	}
+
+	if m.host == int(id) {
+		m.host = -1
+		for member := range m.members {
+			if m.host == -1 || int(member) < m.host {
+				m.host = int(member)
+			}
+		}
+	}
+}
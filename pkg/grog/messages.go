@@ -2,6 +2,7 @@ package grog
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/jpappel/grog_barrel/pkg/util"
@@ -22,12 +23,23 @@ const (
 	ANNOUNCE_MSG
 	STATUS_MSG
     ERROR_MSG
+	RESUME_MSG
+	QUEUE_MSG
+	READY_MSG
+	COUNTDOWN_MSG
+	PAUSE_MSG
+	DELTA_MSG
 )
 
+// Length of a resume token, tokens are hex encoded
+const RESUME_TOKEN_LEN = 32
+
+var ErrShortMessage error = errors.New("message too short")
+
 type ClientStatusMessage struct {
 	Offset      uint16      // current timestamp in file
 	PlayerState PlayerState // playerState
-	Id          byte        // consistent id from client
+	Id          uint16      // consistent id from client
 }
 
 type ClientAnnounceMessage struct {
@@ -39,33 +51,71 @@ type ServerStatusMessage struct {
 	Statuses []ClientStatusMessage
 }
 
+type AnnouncedClient struct {
+	Id   uint16
+	Name string
+}
+
 type ServerAnnounceMessage struct {
-	Connections byte
-	Clients     []struct {
-		Id   byte
-		Name string
-	}
+	Connections uint16
+	Clients     []AnnouncedClient
+	Spectators  uint16
+	// ids of members whose statuses are ignored, nil for announcements before v2.1
+	Muted []uint16
+	// ids of members that missed heartbeats, nil for announcements before v2.6
+	Stale []uint16
 }
 
-func (m ClientStatusMessage) String() string {
+// Token for rejoining a room with the same id
+type ResumeMessage struct {
+	Token string
+}
+
+func (s PlayerState) String() string {
 	status := ""
-	if m.PlayerState == UNKNOWN_STATUS {
+	if s == UNKNOWN_STATUS {
 		status = "UNKNOWN"
-	} else if m.PlayerState == PLAYING_STATUS {
+	} else if s == PLAYING_STATUS {
 		status = "PLAYING"
-	} else if m.PlayerState == PAUSED_STATUS {
+	} else if s == PAUSED_STATUS {
 		status = "PAUSED"
-	} else if m.PlayerState == LOADING_STATUS {
+	} else if s == LOADING_STATUS {
 		status = "LOADING"
 	}
-	return fmt.Sprintf("%s %d", status, m.Offset)
+	return status
+}
+
+func (m ClientStatusMessage) String() string {
+	return fmt.Sprintf("%s %d", m.PlayerState, m.Offset)
 }
 
 // Append the correct transport encoding of a client status message to a slice
 func (m ClientStatusMessage) WriteBytes(p []byte) []byte {
 	p = binary.BigEndian.AppendUint16(p, m.Offset)
 	p = append(p, byte(m.PlayerState))
-	p = append(p, m.Id)
+	p = binary.BigEndian.AppendUint16(p, m.Id)
+	return p
+}
+
+// Append the v1 encoding of a client status message, the id must be below LEGACY_MAX_CONNECTIONS
+func (m ClientStatusMessage) WriteLegacyBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint16(p, m.Offset)
+	p = append(p, byte(m.PlayerState))
+	p = append(p, byte(m.Id))
+	return p
+}
+
+// Append the encoding of a client status message as sent by a client, which omits the id
+func (m ClientStatusMessage) WriteClientBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint16(p, m.Offset)
+	p = append(p, byte(m.PlayerState))
+	return p
+}
+
+// Append the transport encoding of a client announce message to a slice
+func (m ClientAnnounceMessage) WriteBytes(p []byte) []byte {
+	p = append(p, m.Version.Major, m.Version.Minor, m.Version.Patch)
+	p = append(p, m.Name...)
 	return p
 }
 
@@ -74,18 +124,182 @@ func (m ClientAnnounceMessage) String() string {
 }
 
 func (m ServerStatusMessage) WriteBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint16(p, uint16(len(m.Statuses)))
 	for _, status := range m.Statuses {
 		p = status.WriteBytes(p)
 	}
 	return p
 }
 
+// Append the v1 encoding, statuses of ids that do not fit in a byte are omitted
+func (m ServerStatusMessage) WriteLegacyBytes(p []byte) []byte {
+	countPos := len(p)
+	p = append(p, 0)
+	for _, status := range m.Statuses {
+		if status.Id >= LEGACY_MAX_CONNECTIONS || p[countPos] == 255 {
+			continue
+		}
+		p = status.WriteLegacyBytes(p)
+		p[countPos]++
+	}
+	return p
+}
+
 func (m ServerAnnounceMessage) WriteBytes(p []byte) []byte {
-	p = append(p, m.Connections)
+	p = binary.BigEndian.AppendUint16(p, m.Connections)
 	for _, client := range m.Clients {
-		p = append(p, client.Id)
+		p = binary.BigEndian.AppendUint16(p, client.Id)
 		p = append(p, byte(len(client.Name)))
 		p = append(p, client.Name...)
 	}
+	p = binary.BigEndian.AppendUint16(p, m.Spectators)
+	if m.Muted != nil {
+		p = binary.BigEndian.AppendUint16(p, uint16(len(m.Muted)))
+		for _, id := range m.Muted {
+			p = binary.BigEndian.AppendUint16(p, id)
+		}
+	}
+	if m.Muted != nil && m.Stale != nil {
+		p = binary.BigEndian.AppendUint16(p, uint16(len(m.Stale)))
+		for _, id := range m.Stale {
+			p = binary.BigEndian.AppendUint16(p, id)
+		}
+	}
 	return p
 }
+
+// Append the v1 encoding, clients whose ids do not fit in a byte are omitted
+func (m ServerAnnounceMessage) WriteLegacyBytes(p []byte) []byte {
+	countPos := len(p)
+	p = append(p, 0)
+	for _, client := range m.Clients {
+		if client.Id >= LEGACY_MAX_CONNECTIONS || p[countPos] == 255 {
+			continue
+		}
+		p = append(p, byte(client.Id))
+		p = append(p, byte(len(client.Name)))
+		p = append(p, client.Name...)
+		p[countPos]++
+	}
+	p = binary.BigEndian.AppendUint16(p, m.Spectators)
+	return p
+}
+
+func (m ResumeMessage) WriteBytes(p []byte) []byte {
+	return append(p, m.Token...)
+}
+
+// Parse the body of a resume message, excluding the message type
+func ParseResume(p []byte) (ResumeMessage, error) {
+	if len(p) < RESUME_TOKEN_LEN {
+		return ResumeMessage{}, ErrShortMessage
+	}
+	return ResumeMessage{Token: string(p[:RESUME_TOKEN_LEN])}, nil
+}
+
+// Parse the body of a serverStatus message, excluding the message type
+func ParseServerStatus(p []byte) (ServerStatusMessage, error) {
+	if len(p) < 2 {
+		return ServerStatusMessage{}, ErrShortMessage
+	}
+	count := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < 5*count {
+		return ServerStatusMessage{}, ErrShortMessage
+	}
+
+	msg := ServerStatusMessage{Statuses: make([]ClientStatusMessage, count)}
+	for i := range count {
+		status := p[5*i : 5*i+5]
+		msg.Statuses[i] = ClientStatusMessage{
+			Offset:      binary.BigEndian.Uint16(status[:2]),
+			PlayerState: PlayerState(status[2]),
+			Id:          binary.BigEndian.Uint16(status[3:]),
+		}
+	}
+
+	return msg, nil
+}
+
+// Parse the body of a serverAnnounce message, excluding the message type
+func ParseServerAnnounce(p []byte) (ServerAnnounceMessage, error) {
+	if len(p) < 2 {
+		return ServerAnnounceMessage{}, ErrShortMessage
+	}
+	msg := ServerAnnounceMessage{Connections: binary.BigEndian.Uint16(p)}
+	msg.Clients = make([]AnnouncedClient, 0, min(int(msg.Connections), len(p)/3))
+
+	pos := 2
+	for range int(msg.Connections) {
+		if len(p) < pos+3 {
+			return msg, ErrShortMessage
+		}
+		id := binary.BigEndian.Uint16(p[pos:])
+		nameLen := int(p[pos+2])
+		pos += 3
+		if len(p) < pos+nameLen {
+			return msg, ErrShortMessage
+		}
+		msg.Clients = append(msg.Clients, AnnouncedClient{id, string(p[pos : pos+nameLen])})
+		pos += nameLen
+	}
+	if len(p) < pos+2 {
+		return msg, ErrShortMessage
+	}
+	msg.Spectators = binary.BigEndian.Uint16(p[pos : pos+2])
+	pos += 2
+
+	// muted members are only announced to clients since v2.1
+	if len(p) < pos+2 {
+		return msg, nil
+	}
+	numMuted := int(binary.BigEndian.Uint16(p[pos:]))
+	pos += 2
+	if len(p) < pos+2*numMuted {
+		return msg, ErrShortMessage
+	}
+	msg.Muted = make([]uint16, numMuted)
+	for i := range msg.Muted {
+		msg.Muted[i] = binary.BigEndian.Uint16(p[pos+2*i:])
+	}
+	pos += 2 * numMuted
+
+	// stale members are only announced to clients since v2.6
+	if len(p) < pos+2 {
+		return msg, nil
+	}
+	numStale := int(binary.BigEndian.Uint16(p[pos:]))
+	pos += 2
+	if len(p) < pos+2*numStale {
+		return msg, ErrShortMessage
+	}
+	msg.Stale = make([]uint16, numStale)
+	for i := range msg.Stale {
+		msg.Stale[i] = binary.BigEndian.Uint16(p[pos+2*i:])
+	}
+
+	return msg, nil
+}
+
+// Parse a clientAnnounce, the name is not validated
+func ParseClientAnnounce(p []byte) (ClientAnnounceMessage, error) {
+	if len(p) < 3 {
+		return ClientAnnounceMessage{}, ErrShortMessage
+	}
+	return ClientAnnounceMessage{
+		Version: util.SemVer{Major: p[0], Minor: p[1], Patch: p[2]},
+		Name:    string(p[3:]),
+	}, nil
+}
+
+// Parse a clientStatus sent by the client with the given id
+func ParseClientStatus(p []byte, id uint16) (ClientStatusMessage, error) {
+	if len(p) < 3 {
+		return ClientStatusMessage{}, ErrShortMessage
+	}
+	return ClientStatusMessage{
+		Offset:      binary.BigEndian.Uint16(p[:2]),
+		PlayerState: PlayerState(p[2]),
+		Id:          id,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package grog
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+)
+
+var ErrBanned error = errors.New("Banned from room")
+var ErrKicked error = errors.New("Kicked from room")
+var ErrNotMember error = errors.New("No member with id")
+
+// Keeps matching clients out of a room.
+// A ban matches a client if any of its set fields do.
+type Ban struct {
+	Name string  `json:",omitempty"`
+	IP   string  `json:",omitempty"`
+	Uid  *uint32 `json:",omitempty"` // only matches clients with peer credentials
+	// kept in room snapshots, otherwise the ban lasts until the server restarts
+	Persistent bool `json:",omitempty"`
+}
+
+// The ip a client connected from, empty for unix socket clients
+func (c Client) IP() string {
+	// server sent events clients have a session id after the address
+	addr, _, _ := strings.Cut(c.Addr, "/")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (b Ban) Empty() bool {
+	return b.Name == "" && b.IP == "" && b.Uid == nil
+}
+
+func (b Ban) Matches(c Client) bool {
+	return (b.Name != "" && b.Name == c.Name) ||
+		(b.IP != "" && b.IP == c.IP()) ||
+		(b.Uid != nil && c.Cred != nil && *b.Uid == c.Cred.Uid)
+}
+
+// Check if two bans match the same clients
+func (b Ban) same(other Ban) bool {
+	return b.Name == other.Name && b.IP == other.IP &&
+		((b.Uid == nil && other.Uid == nil) || (b.Uid != nil && other.Uid != nil && *b.Uid == *other.Uid))
+}
+
+// Must hold the ids lock
+func (r *Room) banned(client Client) bool {
+	return slices.ContainsFunc(r.bans, func(b Ban) bool { return b.Matches(client) })
+}
+
+// Ban clients from the room and kick the members it matches
+func (r *Room) Ban(ban Ban) {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	if i := slices.IndexFunc(r.bans, ban.same); i >= 0 {
+		r.bans[i] = ban
+	} else {
+		r.bans = append(r.bans, ban)
+	}
+	for id, client := range r.ids.members {
+		if ban.Matches(client) {
+			r.kick(id, "banned")
+		}
+	}
+	r.logger.Info("Ban added", slog.String("roomName", r.Name))
+}
+
+// Remove a ban, reports if the room had it
+func (r *Room) Unban(ban Ban) bool {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	i := slices.IndexFunc(r.bans, ban.same)
+	if i < 0 {
+		return false
+	}
+	r.bans = slices.Delete(r.bans, i, i+1)
+	return true
+}
+
+// Disconnect a member through Kicked, their id is not held for them to resume
+func (r *Room) Kick(id uint16, reason string) error {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	if _, ok := r.ids.members[id]; !ok {
+		return ErrNotMember
+	}
+	r.kick(id, reason)
+	return nil
+}
+
+// Must hold the ids lock
+func (r *Room) kick(id uint16, reason string) {
+	select {
+	case r.ids.kicks[id] <- reason:
+	default:
+		// already kicked
+	}
+	r.ids.tokens[id] = ""
+	r.logger.Info("Member kicked", slog.Int("id", int(id)), slog.String("reason", reason))
+}
+
+// Recieves the reason the member is kicked, the member should leave once it does
+func (r *Room) Kicked(id uint16) <-chan string {
+	r.ids.RLock()
+	defer r.ids.RUnlock()
+	return r.ids.kicks[id]
+}
+
+// Ignore or stop ignoring a member's statuses, muted members are announced
+func (r *Room) Mute(id uint16, muted bool) error {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	if _, ok := r.ids.members[id]; !ok {
+		return ErrNotMember
+	}
+	if muted {
+		r.muted.Store(id, struct{}{})
+	} else {
+		r.muted.Delete(id)
+	}
+	r.announceChanged()
+	return nil
+}
+
+func (r *Room) Muted(id uint16) bool {
+	_, ok := r.muted.Load(id)
+	return ok
+}
+
+// Check if token is the resume token of the room's host.
+// The host is the member who opened the room, or the lowest id once they leave.
+func (r *Room) IsHost(token string) bool {
+	r.ids.RLock()
+	defer r.ids.RUnlock()
+
+	if r.ids.host == -1 || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.ids.tokens[uint16(r.ids.host)]), []byte(token)) == 1
+}
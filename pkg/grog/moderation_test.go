@@ -0,0 +1,119 @@
+package grog
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+func TestBanMatches(t *testing.T) {
+	uid := uint32(1000)
+	other := uint32(1001)
+	ws := Client{Name: "alice", Addr: "10.0.0.1:5000"}
+	sse := Client{Name: "alice", Addr: "10.0.0.1:5000/session"}
+	unix := Client{Name: "alice", Addr: "/tmp/grog/room/alice", Cred: &PeerCred{Uid: uid}}
+
+	tests := []struct {
+		name   string
+		ban    Ban
+		client Client
+		want   bool
+	}{
+		{"name", Ban{Name: "alice"}, ws, true},
+		{"other name", Ban{Name: "bob"}, ws, false},
+		{"ip", Ban{IP: "10.0.0.1"}, ws, true},
+		{"ip of an event stream", Ban{IP: "10.0.0.1"}, sse, true},
+		{"other ip", Ban{IP: "10.0.0.2"}, ws, false},
+		{"ip of a unix client", Ban{IP: "10.0.0.1"}, Client{Addr: "/tmp/grog/room/alice"}, false},
+		{"uid", Ban{Uid: &uid}, unix, true},
+		{"other uid", Ban{Uid: &other}, unix, false},
+		{"uid without credentials", Ban{Uid: &uid}, ws, false},
+		{"any field", Ban{Name: "bob", IP: "10.0.0.1"}, ws, true},
+		{"empty", Ban{}, ws, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ban.Matches(tt.client); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Banned members are kicked without a resume token and can't rejoin until unbanned
+func TestBan(t *testing.T) {
+	r := newTestRoom(t)
+	alice, client := joinRoom(t, r, "alice", util.ServerVersion)
+	bob, _ := joinRoom(t, r, "bob", util.ServerVersion)
+
+	r.Ban(Ban{Name: "alice"})
+	select {
+	case reason := <-r.Kicked(alice):
+		if reason != "banned" {
+			t.Errorf("kicked for %q, want banned", reason)
+		}
+	default:
+		t.Fatal("banned member was not kicked")
+	}
+	if len(r.Kicked(bob)) != 0 {
+		t.Error("member not matching the ban was kicked")
+	}
+	if token := r.Token(alice); token != "" {
+		t.Errorf("banned member kept resume token %q", token)
+	}
+	r.Leave(alice)
+
+	if _, err := r.Join(client); err != ErrBanned {
+		t.Errorf("Join() of a banned client error = %v, want %v", err, ErrBanned)
+	}
+	if err := r.Spectate(client); err != ErrBanned {
+		t.Errorf("Spectate() of a banned client error = %v, want %v", err, ErrBanned)
+	}
+	if !r.Unban(Ban{Name: "alice"}) {
+		t.Fatal("Unban() did not find the ban")
+	}
+	joinRoom(t, r, "alice", util.ServerVersion)
+
+	if err := r.Kick(alice+100, "gone"); err != ErrNotMember {
+		t.Errorf("Kick() of a non-member error = %v, want %v", err, ErrNotMember)
+	}
+}
+
+// Statuses and queue changes of muted members are ignored
+func TestMute(t *testing.T) {
+	r := newTestRoom(t)
+	alice, aliceClient := joinRoom(t, r, "alice", util.ServerVersion)
+	bob, bobClient := joinRoom(t, r, "bob", util.ServerVersion)
+
+	if err := r.Mute(bob, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Mute(bob+1, true); err != ErrNotMember {
+		t.Errorf("Mute() of a non-member error = %v, want %v", err, ErrNotMember)
+	}
+
+	r.Update(aliceClient, ClientStatusMessage{Id: alice, Offset: 5, PlayerState: PLAYING_STATUS})
+	r.Update(bobClient, ClientStatusMessage{Id: bob, Offset: 9, PlayerState: PAUSED_STATUS})
+	r.UpdateQueue(bobClient, bob, ClientQueueMessage{Op: QUEUE_ADD, Item: QueueItem{Title: "muted"}})
+
+	statuses, err := r.Backend.Statuses(r.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ClientStatusMessage{{Id: alice, Offset: 5, PlayerState: PLAYING_STATUS}}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if titles, _ := queueTitles(t, r); len(titles) != 0 {
+		t.Errorf("queue of a muted member's change = %v, want none", titles)
+	}
+
+	if err := r.Mute(bob, false); err != nil {
+		t.Fatal(err)
+	}
+	r.Update(bobClient, ClientStatusMessage{Id: bob, Offset: 9, PlayerState: PAUSED_STATUS})
+	if statuses, _ := r.Backend.Statuses(r.Name); len(statuses) != 2 {
+		t.Errorf("statuses after unmuting = %v, want both members", statuses)
+	}
+}
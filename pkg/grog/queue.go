@@ -0,0 +1,314 @@
+package grog
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+type QueueOp byte
+
+const (
+	QUEUE_ADD QueueOp = iota
+	QUEUE_REMOVE
+	QUEUE_MOVE
+	QUEUE_ADVANCE
+)
+
+// Items are counted and indexed with a uint16
+const MAX_QUEUE_ITEMS = 1024
+
+// Current index of a queue without a current item
+const QUEUE_END = 65535
+
+var ErrQueueFull error = errors.New("Queue is full")
+var ErrInvalidQueueIndex error = errors.New("Invalid queue index")
+var ErrInvalidQueueOp error = errors.New("Invalid queue operation")
+
+// Media the room watches in order
+type QueueItem struct {
+	Title    string // max length 255
+	Location string // url or path, max length 65535
+	Duration uint16 // seconds, 0 if unknown
+}
+
+// A room's queue sent to clients since v2.2
+type QueueMessage struct {
+	Current uint16 // index of the item being watched, QUEUE_END when there is none
+	Items   []QueueItem
+}
+
+// A change to a room's queue sent by a member
+type ClientQueueMessage struct {
+	Op    QueueOp
+	Item  QueueItem // item to add
+	Index uint16    // item to remove or move
+	To    uint16    // index to move the item to
+}
+
+func (o QueueOp) String() string {
+	switch o {
+	case QUEUE_ADD:
+		return "add"
+	case QUEUE_REMOVE:
+		return "remove"
+	case QUEUE_MOVE:
+		return "move"
+	case QUEUE_ADVANCE:
+		return "advance"
+	default:
+		return "unknown"
+	}
+}
+
+// Titles and locations over their max length are truncated,
+// items restored from a snapshot never passed through a parser
+func (i QueueItem) writeBytes(p []byte) []byte {
+	title := i.Title[:min(len(i.Title), 255)]
+	location := i.Location[:min(len(i.Location), 65535)]
+	p = binary.BigEndian.AppendUint16(p, i.Duration)
+	p = append(p, byte(len(title)))
+	p = append(p, title...)
+	p = binary.BigEndian.AppendUint16(p, uint16(len(location)))
+	p = append(p, location...)
+	return p
+}
+
+// Parse an item, returning the number of bytes read
+func parseQueueItem(p []byte) (QueueItem, int, error) {
+	if len(p) < 3 {
+		return QueueItem{}, 0, ErrShortMessage
+	}
+	item := QueueItem{Duration: binary.BigEndian.Uint16(p)}
+	pos := 3 + int(p[2])
+	if len(p) < pos+2 {
+		return item, 0, ErrShortMessage
+	}
+	item.Title = string(p[3:pos])
+	locationEnd := pos + 2 + int(binary.BigEndian.Uint16(p[pos:]))
+	if len(p) < locationEnd {
+		return item, 0, ErrShortMessage
+	}
+	item.Location = string(p[pos+2 : locationEnd])
+	return item, locationEnd, nil
+}
+
+func (m QueueMessage) WriteBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint16(p, m.Current)
+	p = binary.BigEndian.AppendUint16(p, uint16(len(m.Items)))
+	for _, item := range m.Items {
+		p = item.writeBytes(p)
+	}
+	return p
+}
+
+func (m ClientQueueMessage) WriteBytes(p []byte) []byte {
+	p = append(p, byte(m.Op))
+	switch m.Op {
+	case QUEUE_ADD:
+		p = m.Item.writeBytes(p)
+	case QUEUE_REMOVE:
+		p = binary.BigEndian.AppendUint16(p, m.Index)
+	case QUEUE_MOVE:
+		p = binary.BigEndian.AppendUint16(p, m.Index)
+		p = binary.BigEndian.AppendUint16(p, m.To)
+	}
+	return p
+}
+
+// Parse the body of a queue message, excluding the message type
+func ParseQueue(p []byte) (QueueMessage, error) {
+	if len(p) < 4 {
+		return QueueMessage{}, ErrShortMessage
+	}
+	msg := QueueMessage{Current: binary.BigEndian.Uint16(p)}
+	count := int(binary.BigEndian.Uint16(p[2:]))
+	msg.Items = make([]QueueItem, 0, min(count, len(p)/5))
+
+	pos := 4
+	for range count {
+		item, n, err := parseQueueItem(p[pos:])
+		if err != nil {
+			return msg, err
+		}
+		msg.Items = append(msg.Items, item)
+		pos += n
+	}
+	return msg, nil
+}
+
+// Parse the body of a client queue message, excluding the message type
+func ParseClientQueue(p []byte) (ClientQueueMessage, error) {
+	if len(p) < 1 {
+		return ClientQueueMessage{}, ErrShortMessage
+	}
+	msg := ClientQueueMessage{Op: QueueOp(p[0])}
+	p = p[1:]
+
+	switch msg.Op {
+	case QUEUE_ADD:
+		item, _, err := parseQueueItem(p)
+		if err != nil {
+			return msg, err
+		}
+		msg.Item = item
+	case QUEUE_REMOVE:
+		if len(p) < 2 {
+			return msg, ErrShortMessage
+		}
+		msg.Index = binary.BigEndian.Uint16(p)
+	case QUEUE_MOVE:
+		if len(p) < 4 {
+			return msg, ErrShortMessage
+		}
+		msg.Index = binary.BigEndian.Uint16(p)
+		msg.To = binary.BigEndian.Uint16(p[2:])
+	case QUEUE_ADVANCE:
+	default:
+		return msg, ErrInvalidQueueOp
+	}
+	return msg, nil
+}
+
+// The media a room watches in order.
+// The current item ends once every member that started it has reached its duration.
+type queue struct {
+	items   []QueueItem
+	current int               // len(items) when there is no current item
+	started map[uint16]uint16 // last offset of the members that started the current item
+	version int               // incremented on every change
+	frame   []byte
+	sync.RWMutex
+}
+
+// Apply a member's change to the queue, changes from muted members are ignored
+func (r *Room) UpdateQueue(client Client, id uint16, msg ClientQueueMessage) error {
+	if r.Muted(id) {
+		return nil
+	}
+
+	r.queue.Lock()
+	defer r.queue.Unlock()
+
+	q := &r.queue
+	switch msg.Op {
+	case QUEUE_ADD:
+		if len(q.items) >= MAX_QUEUE_ITEMS {
+			return ErrQueueFull
+		}
+		q.items = append(q.items, msg.Item)
+	case QUEUE_REMOVE:
+		i := int(msg.Index)
+		if i >= len(q.items) {
+			return ErrInvalidQueueIndex
+		}
+		q.items = slices.Delete(q.items, i, i+1)
+		if i < q.current {
+			q.current--
+		} else if i == q.current {
+			clear(q.started)
+		}
+	case QUEUE_MOVE:
+		from, to := int(msg.Index), int(msg.To)
+		if from >= len(q.items) || to >= len(q.items) {
+			return ErrInvalidQueueIndex
+		}
+		item := q.items[from]
+		q.items = slices.Insert(slices.Delete(q.items, from, from+1), to, item)
+		// the current item stays current
+		if from == q.current {
+			q.current = to
+		} else if from < q.current && to >= q.current {
+			q.current--
+		} else if from > q.current && to <= q.current {
+			q.current++
+		}
+	case QUEUE_ADVANCE:
+		if q.current >= len(q.items) {
+			return ErrInvalidQueueIndex
+		}
+		q.advance()
+	default:
+		return ErrInvalidQueueOp
+	}
+
+	r.queueChanged()
+	r.logger.Debug("Queue updated",
+		slog.String("op", msg.Op.String()),
+		slog.Int("id", int(id)),
+		slog.String("name", client.Name),
+		slog.Int("items", len(q.items)),
+	)
+	return nil
+}
+
+// Move to the next item, must hold the queue lock
+func (q *queue) advance() {
+	q.current = min(q.current+1, len(q.items))
+	clear(q.started)
+}
+
+// Rebuild the queue frame, must hold the queue lock
+func (r *Room) queueChanged() {
+	r.queue.build()
+	r.queue.version++
+}
+
+// Must hold the queue lock
+func (q *queue) build() {
+	msg := QueueMessage{Current: QUEUE_END, Items: q.items}
+	if q.current < len(q.items) {
+		msg.Current = uint16(q.current)
+	}
+	// frames returned by QueueFrame are still read after the lock is released
+	q.frame = msg.WriteBytes([]byte{byte(QUEUE_MSG)})
+}
+
+// Advance the queue once every member that started the current item has reached its end
+func (r *Room) queueStatus(msg ClientStatusMessage) {
+	r.queue.Lock()
+	defer r.queue.Unlock()
+
+	q := &r.queue
+	if q.current >= len(q.items) || q.items[q.current].Duration == 0 {
+		return
+	}
+	duration := q.items[q.current].Duration
+	if _, ok := q.started[msg.Id]; !ok && msg.Offset >= duration {
+		// still at the end of the previous item
+		return
+	}
+	q.started[msg.Id] = msg.Offset
+
+	for _, offset := range q.started {
+		if offset < duration {
+			return
+		}
+	}
+	r.logger.Info("Queue item finished", slog.Int("index", q.current))
+	q.advance()
+	r.queueChanged()
+}
+
+// Forget a departed member's progress through the current item
+func (r *Room) queueLeave(id uint16) {
+	r.queue.Lock()
+	defer r.queue.Unlock()
+	delete(r.queue.started, id)
+}
+
+// Check for a changed queue
+func (r *Room) CheckQueue(lastQueue int) (int, bool) {
+	r.queue.RLock()
+	defer r.queue.RUnlock()
+	return max(r.queue.version, lastQueue), r.queue.version > lastQueue
+}
+
+// The queue frame sent to clients since v2.2
+func (r *Room) QueueFrame() []byte {
+	r.queue.RLock()
+	defer r.queue.RUnlock()
+	return r.queue.frame
+}
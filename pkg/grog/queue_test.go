@@ -0,0 +1,126 @@
+package grog
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+func queueTitles(t *testing.T, r *Room) ([]string, uint16) {
+	t.Helper()
+	frame := r.QueueFrame()
+	if len(frame) == 0 || MessageType(frame[0]) != QUEUE_MSG {
+		t.Fatalf("frame %v is not a queue", frame)
+	}
+	msg, err := ParseQueue(frame[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, 0, len(msg.Items))
+	for _, item := range msg.Items {
+		titles = append(titles, item.Title)
+	}
+	return titles, msg.Current
+}
+
+func restoreQueue(r *Room, current int, titles ...string) {
+	snapshot := RoomSnapshot{Name: r.Name, Current: current}
+	for _, title := range titles {
+		snapshot.Queue = append(snapshot.Queue, QueueItem{Title: title, Location: "/media/" + title, Duration: 10})
+	}
+	r.Restore(snapshot)
+}
+
+func TestQueueOps(t *testing.T) {
+	tests := []struct {
+		name    string
+		current int
+		msg     ClientQueueMessage
+		want    []string
+		wantCur uint16
+		err     error
+	}{
+		{"add", 1, ClientQueueMessage{Op: QUEUE_ADD, Item: QueueItem{Title: "e"}}, []string{"a", "b", "c", "d", "e"}, 1, nil},
+		{"remove before current", 2, ClientQueueMessage{Op: QUEUE_REMOVE, Index: 0}, []string{"b", "c", "d"}, 1, nil},
+		{"remove current", 2, ClientQueueMessage{Op: QUEUE_REMOVE, Index: 2}, []string{"a", "b", "d"}, 2, nil},
+		{"remove missing", 2, ClientQueueMessage{Op: QUEUE_REMOVE, Index: 4}, []string{"a", "b", "c", "d"}, 2, ErrInvalidQueueIndex},
+		{"move current", 1, ClientQueueMessage{Op: QUEUE_MOVE, Index: 1, To: 3}, []string{"a", "c", "d", "b"}, 3, nil},
+		{"move past current", 1, ClientQueueMessage{Op: QUEUE_MOVE, Index: 0, To: 2}, []string{"b", "c", "a", "d"}, 0, nil},
+		{"move before current", 1, ClientQueueMessage{Op: QUEUE_MOVE, Index: 3, To: 0}, []string{"d", "a", "b", "c"}, 2, nil},
+		{"move missing", 1, ClientQueueMessage{Op: QUEUE_MOVE, Index: 0, To: 4}, []string{"a", "b", "c", "d"}, 1, ErrInvalidQueueIndex},
+		{"advance", 3, ClientQueueMessage{Op: QUEUE_ADVANCE}, []string{"a", "b", "c", "d"}, QUEUE_END, nil},
+		{"advance at end", 4, ClientQueueMessage{Op: QUEUE_ADVANCE}, []string{"a", "b", "c", "d"}, QUEUE_END, ErrInvalidQueueIndex},
+		{"unknown", 0, ClientQueueMessage{Op: 9}, []string{"a", "b", "c", "d"}, 0, ErrInvalidQueueOp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			restoreQueue(r, tt.current, "a", "b", "c", "d")
+
+			if err := r.UpdateQueue(Client{Name: "alice"}, 0, tt.msg); err != tt.err {
+				t.Errorf("UpdateQueue() error = %v, want %v", err, tt.err)
+			}
+			titles, current := queueTitles(t, r)
+			if !slices.Equal(titles, tt.want) || current != tt.wantCur {
+				t.Errorf("queue = %v at %d, want %v at %d", titles, current, tt.want, tt.wantCur)
+			}
+		})
+	}
+}
+
+// The current item ends once every member that started it reaches its duration
+func TestQueueAutoAdvance(t *testing.T) {
+	r := newTestRoom(t)
+	restoreQueue(r, 0, "a", "b")
+	alice, aliceClient := joinRoom(t, r, "alice", util.ServerVersion)
+	bob, bobClient := joinRoom(t, r, "bob", util.ServerVersion)
+
+	steps := []struct {
+		client Client
+		status ClientStatusMessage
+		want   uint16
+	}{
+		{aliceClient, ClientStatusMessage{Id: alice, Offset: 5}, 0},
+		{bobClient, ClientStatusMessage{Id: bob, Offset: 6}, 0},
+		{aliceClient, ClientStatusMessage{Id: alice, Offset: 10}, 0},
+		{bobClient, ClientStatusMessage{Id: bob, Offset: 10}, 1},
+		// still at the end of the previous item
+		{aliceClient, ClientStatusMessage{Id: alice, Offset: 10}, 1},
+		{bobClient, ClientStatusMessage{Id: bob, Offset: 11}, 1},
+	}
+	for i, step := range steps {
+		r.Update(step.client, step.status)
+		if _, current := queueTitles(t, r); current != step.want {
+			t.Errorf("step %d: current = %d, want %d", i, current, step.want)
+		}
+	}
+}
+
+// A rebuild leaves previously returned frames untouched
+func TestQueueFrameRebuild(t *testing.T) {
+	r := newTestRoom(t)
+	restoreQueue(r, 0, "a", "b", "c")
+
+	frame := r.QueueFrame()
+	sent := bytes.Clone(frame)
+	if err := r.UpdateQueue(Client{Name: "alice"}, 0, ClientQueueMessage{Op: QUEUE_REMOVE, Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, sent) {
+		t.Errorf("queue frame changed from %v to %v after a rebuild", sent, frame)
+	}
+}
+
+// Titles restored from a snapshot are truncated rather than corrupting the frame
+func TestQueueTitleLength(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	r := newTestRoom(t)
+	restoreQueue(r, 0, long, "next")
+	titles, _ := queueTitles(t, r)
+	if want := []string{long[:255], "next"}; !slices.Equal(titles, want) {
+		t.Errorf("titles = %q, want %q", titles, want)
+	}
+}
@@ -0,0 +1,261 @@
+package grog
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+type ReadyOp byte
+
+const (
+	READY_START  ReadyOp = iota // the host starts a ready check
+	READY_DONE                  // the member is ready
+	READY_CANCEL                // the host cancels the ready check
+)
+
+// Time between every member being ready and play starting
+const COUNTDOWN = 3 * time.Second
+
+// First client version that takes part in ready checks
+var ReadyVersion = util.SemVer{Major: 2, Minor: 3, Patch: 0}
+
+var ErrNotHost error = errors.New("Only the host can do that")
+var ErrNoReadyCheck error = errors.New("No ready check in progress")
+var ErrInvalidReadyOp error = errors.New("Invalid ready operation")
+
+// The members a room's ready check waits on, sent to clients since v2.3.
+// An inactive check was cancelled.
+type ReadyMessage struct {
+	Active  bool
+	Waiting []uint16
+}
+
+// Sent to clients since v2.3 once every member is ready
+type CountdownMessage struct {
+	Start     uint64 // unix milliseconds at which play starts
+	Remaining int32  // milliseconds until play starts when sent, negative once started
+}
+
+// A ready check operation sent by a member
+type ClientReadyMessage struct {
+	Op ReadyOp
+}
+
+func (o ReadyOp) String() string {
+	switch o {
+	case READY_START:
+		return "start"
+	case READY_DONE:
+		return "ready"
+	case READY_CANCEL:
+		return "cancel"
+	default:
+		return "unknown"
+	}
+}
+
+func (m ReadyMessage) WriteBytes(p []byte) []byte {
+	if m.Active {
+		p = append(p, 1)
+	} else {
+		p = append(p, 0)
+	}
+	p = binary.BigEndian.AppendUint16(p, uint16(len(m.Waiting)))
+	for _, id := range m.Waiting {
+		p = binary.BigEndian.AppendUint16(p, id)
+	}
+	return p
+}
+
+func (m CountdownMessage) WriteBytes(p []byte) []byte {
+	p = binary.BigEndian.AppendUint64(p, m.Start)
+	return binary.BigEndian.AppendUint32(p, uint32(m.Remaining))
+}
+
+func (m ClientReadyMessage) WriteBytes(p []byte) []byte {
+	return append(p, byte(m.Op))
+}
+
+// The time at which play starts
+func (m CountdownMessage) StartTime() time.Time {
+	return time.UnixMilli(int64(m.Start))
+}
+
+// Parse the body of a ready message, excluding the message type
+func ParseReady(p []byte) (ReadyMessage, error) {
+	if len(p) < 3 {
+		return ReadyMessage{}, ErrShortMessage
+	}
+	msg := ReadyMessage{Active: p[0] != 0}
+	count := int(binary.BigEndian.Uint16(p[1:]))
+	if len(p) < 3+2*count {
+		return msg, ErrShortMessage
+	}
+	msg.Waiting = make([]uint16, count)
+	for i := range count {
+		msg.Waiting[i] = binary.BigEndian.Uint16(p[3+2*i:])
+	}
+	return msg, nil
+}
+
+// Parse the body of a countdown message, excluding the message type
+func ParseCountdown(p []byte) (CountdownMessage, error) {
+	if len(p) < 12 {
+		return CountdownMessage{}, ErrShortMessage
+	}
+	return CountdownMessage{
+		Start:     binary.BigEndian.Uint64(p),
+		Remaining: int32(binary.BigEndian.Uint32(p[8:])),
+	}, nil
+}
+
+// Parse the body of a client ready message, excluding the message type
+func ParseClientReady(p []byte) (ClientReadyMessage, error) {
+	if len(p) < 1 {
+		return ClientReadyMessage{}, ErrShortMessage
+	}
+	msg := ClientReadyMessage{Op: ReadyOp(p[0])}
+	if msg.Op > READY_CANCEL {
+		return msg, ErrInvalidReadyOp
+	}
+	return msg, nil
+}
+
+// A room's ready check.
+// Once no member is waiting play starts for everyone after COUNTDOWN.
+type readyCheck struct {
+	active  bool
+	waiting map[uint16]bool
+	start   time.Time // zero until every member is ready
+	version int       // incremented on every change
+	sync.Mutex
+}
+
+// Apply a member's ready check operation, only the host starts and cancels checks
+func (r *Room) UpdateReady(client Client, id uint16, msg ClientReadyMessage) error {
+	r.ids.RLock()
+	defer r.ids.RUnlock()
+
+	r.ready.Lock()
+	defer r.ready.Unlock()
+
+	c := &r.ready
+	switch msg.Op {
+	case READY_START:
+		if r.ids.host != int(id) {
+			return ErrNotHost
+		}
+		c.active = true
+		c.start = time.Time{}
+		clear(c.waiting)
+		// members that predate ready checks can't take part
+		for member, user := range r.ids.members {
+			if member != id && user.Version.AtLeast(ReadyVersion) {
+				c.waiting[member] = true
+			}
+		}
+		r.logger.Info("Ready check started", slog.Int("waiting", len(c.waiting)))
+		r.readyChanged()
+	case READY_DONE:
+		if !c.active || !c.start.IsZero() {
+			return ErrNoReadyCheck
+		}
+		r.memberReady(id)
+	case READY_CANCEL:
+		if r.ids.host != int(id) {
+			return ErrNotHost
+		} else if !c.active {
+			return ErrNoReadyCheck
+		}
+		c.active = false
+		clear(c.waiting)
+		r.logger.Info("Ready check cancelled")
+		c.version++
+	default:
+		return ErrInvalidReadyOp
+	}
+	return nil
+}
+
+// Stop waiting on a member, must hold the ready lock
+func (r *Room) memberReady(id uint16) {
+	c := &r.ready
+	if !c.waiting[id] {
+		return
+	}
+	delete(c.waiting, id)
+	r.readyChanged()
+}
+
+// Start the countdown once no member is waiting, must hold the ready lock
+func (r *Room) readyChanged() {
+	c := &r.ready
+	if c.active && len(c.waiting) == 0 {
+		c.start = time.Now().Add(COUNTDOWN)
+		r.logger.Info("Every member is ready, starting countdown")
+	}
+	c.version++
+}
+
+// Members are ready once their player leaves LOADING_STATUS
+func (r *Room) readyStatus(prev, msg ClientStatusMessage) {
+	if prev.PlayerState != LOADING_STATUS || msg.PlayerState == LOADING_STATUS {
+		return
+	}
+	r.ready.Lock()
+	defer r.ready.Unlock()
+	if r.ready.active && r.ready.start.IsZero() {
+		r.memberReady(msg.Id)
+	}
+}
+
+// Stop waiting on a departed member
+func (r *Room) readyLeave(id uint16) {
+	r.ready.Lock()
+	defer r.ready.Unlock()
+	if r.ready.active && r.ready.start.IsZero() {
+		r.memberReady(id)
+	}
+}
+
+// Check for a changed ready check
+func (r *Room) CheckReady(lastReady int) (int, bool) {
+	r.ready.Lock()
+	defer r.ready.Unlock()
+	return max(r.ready.version, lastReady), r.ready.version > lastReady
+}
+
+// The ready check frame sent to clients since v2.3, a countdown once every member is ready.
+// nil once play started more than COUNTDOWN ago.
+func (r *Room) ReadyFrame() []byte {
+	r.ready.Lock()
+	defer r.ready.Unlock()
+
+	c := &r.ready
+	if !c.active {
+		return ReadyMessage{}.WriteBytes([]byte{byte(READY_MSG)})
+	} else if c.start.IsZero() {
+		msg := ReadyMessage{Active: true, Waiting: make([]uint16, 0, len(c.waiting))}
+		for id := range c.waiting {
+			msg.Waiting = append(msg.Waiting, id)
+		}
+		slices.Sort(msg.Waiting)
+		return msg.WriteBytes([]byte{byte(READY_MSG)})
+	}
+
+	remaining := time.Until(c.start)
+	if remaining < -COUNTDOWN {
+		return nil
+	}
+	msg := CountdownMessage{
+		Start:     uint64(c.start.UnixMilli()),
+		Remaining: int32(remaining.Milliseconds()),
+	}
+	return msg.WriteBytes([]byte{byte(COUNTDOWN_MSG)})
+}
@@ -0,0 +1,104 @@
+package grog
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+// Waiting members of an active check, or nil once the countdown started
+func readyWaiting(t *testing.T, r *Room) (bool, []uint16) {
+	t.Helper()
+	frame := r.ReadyFrame()
+	switch MessageType(frame[0]) {
+	case READY_MSG:
+		msg, err := ParseReady(frame[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Active, msg.Waiting
+	case COUNTDOWN_MSG:
+		msg, err := ParseCountdown(frame[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining := time.Duration(msg.Remaining) * time.Millisecond; remaining <= 0 || remaining > COUNTDOWN {
+			t.Errorf("countdown with %v remaining, want at most %v", remaining, COUNTDOWN)
+		}
+		return true, nil
+	}
+	t.Fatalf("frame %v is not a ready check", frame)
+	return false, nil
+}
+
+func TestReadyCheck(t *testing.T) {
+	r := newTestRoom(t)
+	host, hostClient := joinRoom(t, r, "host", util.ServerVersion)
+	bob, bobClient := joinRoom(t, r, "bob", util.ServerVersion)
+	carol, carolClient := joinRoom(t, r, "carol", util.ServerVersion)
+	// predates ready checks, so it is never waited on
+	old, oldClient := joinRoom(t, r, "old", util.SemVer{Major: 2, Minor: 2})
+
+	ready := func(id uint16, client Client, op ReadyOp) func() error {
+		return func() error { return r.UpdateReady(client, id, ClientReadyMessage{Op: op}) }
+	}
+	status := func(id uint16, client Client, state PlayerState) func() error {
+		return func() error {
+			r.Update(client, ClientStatusMessage{Id: id, PlayerState: state})
+			return nil
+		}
+	}
+
+	steps := []struct {
+		name    string
+		do      func() error
+		err     error
+		active  bool
+		waiting []uint16
+	}{
+		{"ready without a check", ready(bob, bobClient, READY_DONE), ErrNoReadyCheck, false, []uint16{}},
+		{"start by a member", ready(bob, bobClient, READY_START), ErrNotHost, false, []uint16{}},
+		{"start", ready(host, hostClient, READY_START), nil, true, []uint16{bob, carol}},
+		{"cancel by a member", ready(bob, bobClient, READY_CANCEL), ErrNotHost, true, []uint16{bob, carol}},
+		{"cancel", ready(host, hostClient, READY_CANCEL), nil, false, []uint16{}},
+		{"cancel without a check", ready(host, hostClient, READY_CANCEL), ErrNoReadyCheck, false, []uint16{}},
+		{"restart", ready(host, hostClient, READY_START), nil, true, []uint16{bob, carol}},
+		{"ready", ready(bob, bobClient, READY_DONE), nil, true, []uint16{carol}},
+		{"ready again", ready(bob, bobClient, READY_DONE), nil, true, []uint16{carol}},
+		{"unknown member ready", ready(old, oldClient, READY_DONE), nil, true, []uint16{carol}},
+		{"loading", status(carol, carolClient, LOADING_STATUS), nil, true, []uint16{carol}},
+		{"loaded", status(carol, carolClient, PAUSED_STATUS), nil, true, nil},
+		{"ready during the countdown", ready(bob, bobClient, READY_DONE), ErrNoReadyCheck, true, nil},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != step.err {
+			t.Errorf("%s: error = %v, want %v", step.name, err, step.err)
+		}
+		active, waiting := readyWaiting(t, r)
+		if active != step.active || !slices.Equal(waiting, step.waiting) {
+			t.Errorf("%s: active %v waiting on %v, want %v waiting on %v",
+				step.name, active, waiting, step.active, step.waiting)
+		}
+	}
+}
+
+// The countdown starts once the last waiting member leaves
+func TestReadyLeave(t *testing.T) {
+	r := newTestRoom(t)
+	host, hostClient := joinRoom(t, r, "host", util.ServerVersion)
+	bob, _ := joinRoom(t, r, "bob", util.ServerVersion)
+
+	if err := r.UpdateReady(hostClient, host, ClientReadyMessage{Op: READY_START}); err != nil {
+		t.Fatal(err)
+	}
+	last, _ := r.CheckReady(0)
+	r.Leave(bob)
+	if _, changed := r.CheckReady(last); !changed {
+		t.Error("leaving did not change the ready check")
+	}
+	if active, waiting := readyWaiting(t, r); !active || waiting != nil {
+		t.Errorf("active %v waiting on %v, want a countdown", active, waiting)
+	}
+}
@@ -0,0 +1,149 @@
+package grog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type RecordKind byte
+
+const (
+	JOIN_RECORD          RecordKind = iota // big endian id followed by the client name
+	LEAVE_RECORD                           // big endian id
+	STATUS_RECORD                          // clientStatus with its big endian id appended
+	ANNOUNCE_RECORD                        // serverAnnounce
+	SERVER_STATUS_RECORD                   // serverStatus
+)
+
+// Recordings of v1 rooms, with single byte ids, are not supported
+const recordMagic = "GROGREC2"
+const legacyRecordMagic = "GROGREC1"
+
+var ErrInvalidRecording error = errors.New("invalid recording")
+
+// A timestamped frame of a recording
+type Record struct {
+	Time time.Time
+	Kind RecordKind
+	Data []byte
+}
+
+// Writes a room's inbound and outbound frames
+type Recorder struct {
+	w    io.Writer
+	lock sync.Mutex
+	buf  []byte
+}
+
+func (k RecordKind) String() string {
+	switch k {
+	case JOIN_RECORD:
+		return "JOIN"
+	case LEAVE_RECORD:
+		return "LEAVE"
+	case STATUS_RECORD:
+		return "STATUS"
+	case ANNOUNCE_RECORD:
+		return "ANNOUNCE"
+	case SERVER_STATUS_RECORD:
+		return "SERVER_STATUS"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Start a recording of a room, writing the recording header to w
+func NewRecorder(w io.Writer, roomName string) (*Recorder, error) {
+	if len(roomName) > 65535 {
+		return nil, errors.New("room name too long to record")
+	}
+
+	header := make([]byte, 0, len(recordMagic)+2+len(roomName))
+	header = append(header, recordMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(roomName)))
+	header = append(header, roomName...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{w: w, buf: make([]byte, 0, 1024)}, nil
+}
+
+// Write a record, each record is written with a single call to Write
+func (r *Recorder) Record(kind RecordKind, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.buf = binary.BigEndian.AppendUint64(r.buf[:0], uint64(time.Now().UnixNano()))
+	r.buf = append(r.buf, byte(kind))
+	r.buf = binary.BigEndian.AppendUint32(r.buf, uint32(len(data)))
+	r.buf = append(r.buf, data...)
+
+	_, err := r.w.Write(r.buf)
+	return err
+}
+
+// Close the underlying writer if it is an io.Closer
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Reads records written by a Recorder
+type RecordReader struct {
+	r        *bufio.Reader
+	RoomName string
+}
+
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(recordMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	} else if string(header[:len(recordMagic)]) == legacyRecordMagic {
+		return nil, fmt.Errorf("%w: recorded by a server before v2", ErrInvalidRecording)
+	} else if string(header[:len(recordMagic)]) != recordMagic {
+		return nil, ErrInvalidRecording
+	}
+	name := make([]byte, binary.BigEndian.Uint16(header[len(recordMagic):]))
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, err
+	}
+
+	return &RecordReader{r: br, RoomName: string(name)}, nil
+}
+
+// Read the next record, returns io.EOF at the end of the recording
+func (rr *RecordReader) Next() (Record, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(rr.r, header); err == io.ErrUnexpectedEOF {
+		return Record{}, ErrInvalidRecording
+	} else if err != nil {
+		return Record{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[9:])
+	if length > 1<<20 {
+		return Record{}, ErrInvalidRecording
+	}
+	record := Record{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+		Kind: RecordKind(header[8]),
+		Data: make([]byte, length),
+	}
+	if _, err := io.ReadFull(rr.r, record.Data); err != nil {
+		return Record{}, ErrInvalidRecording
+	}
+
+	return record, nil
+}
@@ -1,9 +1,14 @@
 package grog
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,52 +17,193 @@ import (
 	"github.com/jpappel/grog_barrel/pkg/util"
 )
 
-const MAX_CONNECTIONS = 256
+// Ids and counts are announced as a uint16
+const MAX_CONNECTIONS = 65535
+
+// Clients before v2 use the v1 protocol, with single byte ids and counts
+const LEGACY_MAX_CONNECTIONS = 256
+
+// Spectators are announced as a uint16
+const MAX_SPECTATORS = 65535
+
+// How long the id of a departed member is held for them to resume
+const RESUME_WINDOW = 2 * time.Minute
 
 var ErrRoomFull error = errors.New("Room is at capacity")
+var ErrPermissionDenied error = errors.New("Permission denied")
+var ErrRoomClosed error = errors.New("Room is closed")
+var ErrInvalidResumeToken error = errors.New("Invalid resume token")
+
+// Credentials of a peer connected over a unix socket, as reported by SO_PEERCRED
+type PeerCred struct {
+	Pid    int32
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // supplementary groups of Uid
+}
+
+// Restricts which unix users or groups may join a room.
+// An empty ACL permits every client.
+type ACL struct {
+	Users  []uint32
+	Groups []uint32
+}
 
 // Name limited to a length of 255
 type Client struct {
 	Name    string
 	Addr    string
 	Version util.SemVer
+	Cred    *PeerCred // nil unless the client connected over a unix socket
+}
+
+// An id held for a departed member until expires
+type reservation struct {
+	token   string
+	name    string
+	status  *ClientStatusMessage
+	expires time.Time
+}
+
+// Persisted state of a member, or of a departed member whose id is still held
+type MemberSnapshot struct {
+	Id     uint16
+	Name   string
+	Token  string
+	Status *ClientStatusMessage `json:",omitempty"`
 }
 
+// Persisted state of a room
+type RoomSnapshot struct {
+	Name    string
+	ACL     ACL
+	Members []MemberSnapshot
+	Bans    []Ban       `json:",omitempty"` // only persistent bans
+	Queue   []QueueItem `json:",omitempty"`
+	Current int         `json:",omitempty"` // index of the current queue item
+}
+
+// The room's latest encoded messages.
+// Rebuilds replace the buffers rather than reuse them, so returned slices stay valid.
 type Messages struct {
-	/* NOTE: consider using a double buffer to avoid lock contention
-	   could possible be implemented as a bool to swap between
-	   the two buffers.
-	*/
-	status           []byte
-	announcements    []byte
-	PreparedStatus   *websocket.PreparedMessage
-	PreparedAnnounce *websocket.PreparedMessage
-	statusLock       sync.RWMutex
-	announcementLock sync.RWMutex
+	status         []byte
+	announcements  []byte
+	unmutedLen     int // length of announcements without the muted members
+	unstaleLen     int // length of announcements without the stale members
+	preparedStatus *websocket.PreparedMessage
+	// v1 encodings for clients before v2
+	legacyStatus         []byte
+	legacyAnnouncements  []byte
+	preparedLegacyStatus *websocket.PreparedMessage
+	statusLock           sync.RWMutex
+	announcementLock     sync.RWMutex
 }
 
+// Members whose playback is kept in sync.
+//
+// Locks are taken in this order, a lock is never held while taking one before it:
+//
+//	ids -> queue, ready, stalls, beats or ticks -> subscribers
+//
+// The feature locks in the middle are never nested with each other.
+// The backend, Messages, history and Recorder locks are leaves, except that a Recorder
+// is written while holding the announcement lock.
+// Update takes each lock on its own, so it is called without holding any.
+// Signals to run never block, so they are sent while holding any lock.
 type Room struct {
 	Name        string
 	Connections atomic.Int32
+	Spectators  atomic.Int32 // connections watching the room without an id
 	Messages    Messages
 	Open        bool
-	statuses    sync.Map
-	wg          sync.WaitGroup
-	usersChange chan bool
-	ids         struct {
-		vals [MAX_CONNECTIONS]Client
-		sync.RWMutex
+	ACL         ACL
+	AutoPause   AutoPause // set before the first join
+	TickRate    TickRate  // set before the first join
+	Heartbeat   Heartbeat // set before the first join
+	Recorder    *Recorder // optional, records the room's frames
+	// shares membership and statuses with other instances, set before the first join
+	Backend     Backend
+	updated     sync.Map // time of each member's last status
+	subscribers struct {
+		list     []*Subscription
+		watchers []*watcher
+		sync.Mutex
 	}
+	statuses     sync.Map
+	muted        sync.Map // ids of members whose statuses are ignored
+	bans         []Ban    // guarded by the ids lock
+	queue        queue
+	ready        readyCheck
+	stalls       stalls
+	ticks        tickRequests
+	history      statusHistory
+	beats        heartbeats
+	wg           sync.WaitGroup
+	usersChange  chan bool
+	ids          memberIds
 	lastAnnounce int
 	logger       *slog.Logger
+	closed       chan struct{}
+	closeOnce    sync.Once
 }
 
 func (c Client) String() string {
 	return fmt.Sprintf("%s @ %s : %s", c.Name, c.Addr, c.Version.String())
 }
 
+// Check if the client uses the v1 protocol
+func (c Client) Legacy() bool {
+	return c.Version.Major < 2
+}
+
+// Number of ids the client's protocol can represent
+func (c Client) maxConnections() int {
+	if c.Legacy() {
+		return LEGACY_MAX_CONNECTIONS
+	}
+	return MAX_CONNECTIONS
+}
+
+func (a ACL) Empty() bool {
+	return len(a.Users) == 0 && len(a.Groups) == 0
+}
+
+// Check if a client is allowed by the ACL.
+// Clients without peer credentials are only permitted by an empty ACL.
+func (a ACL) Permits(c Client) bool {
+	if a.Empty() {
+		return true
+	} else if c.Cred == nil {
+		return false
+	}
+
+	if slices.Contains(a.Users, c.Cred.Uid) || slices.Contains(a.Groups, c.Cred.Gid) {
+		return true
+	}
+	for _, gid := range c.Cred.Groups {
+		if slices.Contains(a.Groups, gid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record a frame if the room has a recorder
+func (r *Room) record(kind RecordKind, data []byte) {
+	if r.Recorder == nil {
+		return
+	}
+	if err := r.Recorder.Record(kind, data); err != nil {
+		r.logger.Error("Failed to record frame",
+			slog.String("roomName", r.Name),
+			slog.String("kind", kind.String()),
+			slog.String("err", err.Error()),
+		)
+	}
+}
+
 func (m *Messages) Status() []byte {
-	// FIXME: idk if this actually protects the slice for reading
 	m.statusLock.RLock()
 	defer m.statusLock.RUnlock()
 	return m.status
@@ -69,60 +215,301 @@ func (m *Messages) Announcements() []byte {
 	return m.announcements
 }
 
+// Announcements without the muted members, for clients before v2.1
+func (m *Messages) UnmutedAnnouncements() []byte {
+	m.announcementLock.RLock()
+	defer m.announcementLock.RUnlock()
+	return m.announcements[:m.unmutedLen]
+}
+
+// Announcements without the stale members, for clients before v2.6
+func (m *Messages) UnstaleAnnouncements() []byte {
+	m.announcementLock.RLock()
+	defer m.announcementLock.RUnlock()
+	return m.announcements[:m.unstaleLen]
+}
+
+func (m *Messages) LegacyStatus() []byte {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.legacyStatus
+}
+
+func (m *Messages) LegacyAnnouncements() []byte {
+	m.announcementLock.RLock()
+	defer m.announcementLock.RUnlock()
+	return m.legacyAnnouncements
+}
+
+// Status prepared for web socket clients
+func (m *Messages) PreparedStatus() *websocket.PreparedMessage {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.preparedStatus
+}
+
+func (m *Messages) PreparedLegacyStatus() *websocket.PreparedMessage {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.preparedLegacyStatus
+}
+
 func NewRoom(name string, logger *slog.Logger) *Room {
 	r := new(Room)
 
 	r.Name = name
 	r.logger = logger
 
-	r.Messages.status = make([]byte, 2, 1024)
-	r.Messages.announcements = make([]byte, 1, 1024)
-	r.Messages.status[0] = byte(STATUS_MSG)
-	r.Messages.announcements[0] = byte(ANNOUNCE_MSG)
-
 	// PERF: profile channel size
 	r.usersChange = make(chan bool, 5)
+	r.closed = make(chan struct{})
+	r.ids = newMemberIds()
+	r.queue.started = make(map[uint16]uint16)
+	r.queue.build()
+	r.ready.waiting = make(map[uint16]bool)
+	r.stalls.loading = make(map[uint16]time.Time)
+	r.stalls.counts = make(map[uint16]int)
+	r.stalls.ignored = make(map[uint16]bool)
+	r.ticks.intervals = make(map[time.Duration]int)
+	r.ticks.wake = make(chan struct{}, 1)
+	// sequence 0 is reserved for clients without statuses
+	r.history.seq = 1
+	r.history.last = make(map[uint16]ClientStatusMessage)
+	r.history.changed = make(map[uint16]uint32)
+	r.beats.seen = make(map[uint16]time.Time)
+	r.beats.stale = make(map[uint16]bool)
+	r.Backend = NewMemoryBackend()
+
+	// connections may write either message before the room first builds them
+	if err := r.buildStatus(); err != nil {
+		panic(err)
+	}
+	if err := r.buildAnnounce(); err != nil {
+		panic(err)
+	}
 
 	return r
 }
 
-func (r *Room) Join(client Client) (byte, error) {
+func (r *Room) Join(client Client) (uint16, error) {
+	if !r.ACL.Permits(client) {
+		r.logger.Info("Client not permitted by room ACL")
+		return 0, ErrPermissionDenied
+	}
+
 	r.ids.Lock()
 	defer r.ids.Unlock()
 
-	for i, v := range r.ids.vals {
-		if v.Addr != "" {
+	select {
+	case <-r.closed:
+		return 0, ErrRoomClosed
+	default:
+	}
+	if r.banned(client) {
+		r.logger.Info("Banned client tried to join")
+		return 0, ErrBanned
+	}
+
+	id, err := r.Backend.Claim(r.Name, r.ids.candidates(client.maxConnections()), client.Name)
+	if err == ErrNoFreeId {
+		r.logger.Warn("Room Full")
+		return 0, ErrRoomFull
+	} else if err != nil {
+		return 0, err
+	}
+	r.join(id, client, newResumeToken())
+	return id, nil
+}
+
+// Join with the id held for a resume token, restoring the member's last status
+func (r *Room) Resume(client Client, token string) (uint16, error) {
+	if !r.ACL.Permits(client) {
+		r.logger.Info("Client not permitted by room ACL")
+		return 0, ErrPermissionDenied
+	}
+
+	id, status, err := r.resume(client, token)
+	if err != nil {
+		return 0, err
+	}
+	// Update takes the feature locks, so it runs once the ids lock is released
+	if status != nil {
+		r.Update(client, *status)
+	}
+	r.logger.Debug("User Resumed", slog.Int("id", int(id)))
+	return id, nil
+}
+
+// Join with the id held for a resume token, returning the member's last status
+func (r *Room) resume(client Client, token string) (uint16, *ClientStatusMessage, error) {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	select {
+	case <-r.closed:
+		return 0, nil, ErrRoomClosed
+	default:
+	}
+	if r.banned(client) {
+		r.logger.Info("Banned client tried to resume")
+		return 0, nil, ErrBanned
+	}
+
+	for id, res := range r.ids.reserved {
+		if res.token != token {
 			continue
 		}
+		if time.Now().After(res.expires) || int(id) >= client.maxConnections() {
+			r.ids.release(id)
+			return 0, nil, ErrInvalidResumeToken
+		}
+		// the id may have been taken on another instance
+		if _, err := r.Backend.Claim(r.Name, slices.Values([]uint16{id}), client.Name); err == ErrNoFreeId {
+			r.ids.release(id)
+			return 0, nil, ErrInvalidResumeToken
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		r.join(id, client, token)
+		return id, res.status, nil
+	}
+
+	return 0, nil, ErrInvalidResumeToken
+}
+
+// Must hold the ids lock
+func (r *Room) join(id uint16, client Client, token string) {
+	r.wg.Add(1)
+	conns := r.Connections.Add(1)
+
+	r.ids.add(id, client, token)
+	r.beatJoin(id)
+	r.record(JOIN_RECORD, append(binary.BigEndian.AppendUint16(nil, id), client.Name...))
+
+	if conns == 1 && !r.Open {
+		r.Open = true
+		go r.run()
+		r.openWatchers()
+		r.emit(ROOM_CREATED_EVENT, nil, 0, nil)
+	}
+	r.emit(MEMBER_JOINED_EVENT, &client, id, nil)
+	r.membersChanged()
+	r.logger.Debug("User Joined")
+}
+
+func newResumeToken() string {
+	buf := make([]byte, RESUME_TOKEN_LEN/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// The token a member can resume with after leaving
+func (r *Room) Token(id uint16) string {
+	r.ids.RLock()
+	defer r.ids.RUnlock()
+	return r.ids.tokens[id]
+}
+
+// Capture the members of the room and the ids held for departed members
+func (r *Room) Snapshot() RoomSnapshot {
+	r.ids.RLock()
+	defer r.ids.RUnlock()
+
+	snapshot := RoomSnapshot{Name: r.Name, ACL: r.ACL}
+	for id, client := range r.ids.members {
+		member := MemberSnapshot{Id: id, Name: client.Name, Token: r.ids.tokens[id]}
+		if v, ok := r.statuses.Load(client.Addr); ok {
+			status := v.(ClientStatusMessage)
+			member.Status = &status
+		}
+		snapshot.Members = append(snapshot.Members, member)
+	}
+
+	now := time.Now()
+	for id, res := range r.ids.reserved {
+		if now.Before(res.expires) {
+			snapshot.Members = append(snapshot.Members,
+				MemberSnapshot{Id: id, Name: res.name, Token: res.token, Status: res.status})
+		}
+	}
+	slices.SortFunc(snapshot.Members, func(a, b MemberSnapshot) int {
+		return int(a.Id) - int(b.Id)
+	})
+	for _, ban := range r.bans {
+		if ban.Persistent {
+			snapshot.Bans = append(snapshot.Bans, ban)
+		}
+	}
+
+	r.queue.RLock()
+	snapshot.Queue = slices.Clone(r.queue.items)
+	snapshot.Current = r.queue.current
+	r.queue.RUnlock()
+
+	return snapshot
+}
 
-		r.wg.Add(1)
-		conns := r.Connections.Add(1)
+// Hold the ids of a snapshot's members for them to resume and restore its bans and queue
+func (r *Room) Restore(snapshot RoomSnapshot) {
+	r.ids.Lock()
+	defer r.ids.Unlock()
 
-		r.ids.vals[i] = client
+	for _, ban := range snapshot.Bans {
+		if !ban.Empty() && !slices.ContainsFunc(r.bans, ban.same) {
+			r.bans = append(r.bans, ban)
+		}
+	}
+	if len(snapshot.Queue) > 0 {
+		r.queue.Lock()
+		r.queue.items = snapshot.Queue[:min(len(snapshot.Queue), MAX_QUEUE_ITEMS)]
+		r.queue.current = min(max(snapshot.Current, 0), len(r.queue.items))
+		r.queueChanged()
+		r.queue.Unlock()
+	}
 
-		if conns == 1 && !r.Open {
-			r.Open = true
-			go r.run()
+	expires := time.Now().Add(RESUME_WINDOW)
+	for _, member := range snapshot.Members {
+		if _, ok := r.ids.members[member.Id]; ok || member.Token == "" || int(member.Id) >= MAX_CONNECTIONS {
+			continue
 		}
-		r.usersChange <- true
-		r.logger.Debug("User Joined")
-		return byte(i), nil
+		r.ids.hold(member.Id, reservation{member.Token, member.Name, member.Status, expires})
 	}
-	r.logger.Warn("Room Full")
-	return 0, ErrRoomFull
 }
 
-func (r *Room) Leave(id byte) {
+func (r *Room) Leave(id uint16) {
 	r.ids.Lock()
 	defer r.ids.Unlock()
 
-	user := r.ids.vals[id]
-	if user.Addr == "" {
+	user, ok := r.ids.members[id]
+	if !ok {
 		return
 	}
 
-	r.statuses.Delete(user.Addr)
-	r.ids.vals[id].Addr = ""
+	res := reservation{
+		token:   r.ids.tokens[id],
+		name:    user.Name,
+		expires: time.Now().Add(RESUME_WINDOW),
+	}
+	if v, ok := r.statuses.LoadAndDelete(user.Addr); ok {
+		status := v.(ClientStatusMessage)
+		res.status = &status
+	}
+	r.updated.Delete(user.Addr)
+	r.muted.Delete(id)
+	r.queueLeave(id)
+	r.readyLeave(id)
+	r.stallLeave(id)
+	r.beatLeave(id)
+	r.ids.remove(id, res)
+	if err := r.Backend.Release(r.Name, id); err != nil {
+		r.logger.Error("Failed to release id",
+			slog.String("roomName", r.Name),
+			slog.String("err", err.Error()),
+		)
+	}
+	r.record(LEAVE_RECORD, binary.BigEndian.AppendUint16(nil, id))
+	r.emit(MEMBER_LEFT_EVENT, &user, id, nil)
 
 	r.wg.Done()
 	if conns := r.Connections.Add(-1); conns < 0 {
@@ -131,43 +518,192 @@ func (r *Room) Leave(id byte) {
 		panic("Negative Number of connections")
 	} else if conns == 0 {
 		r.Open = false
+		r.emit(ROOM_CLOSED_EVENT, nil, 0, nil)
+		r.closeWatchers()
+	}
+
+	r.membersChanged()
+}
+
+// Watch the room without taking an id.
+// Spectators recieve announces and statuses, they are counted in the announce but never listed.
+func (r *Room) Spectate(client Client) error {
+	if !r.ACL.Permits(client) {
+		r.logger.Info("Client not permitted by room ACL")
+		return ErrPermissionDenied
+	}
+
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	select {
+	case <-r.closed:
+		return ErrRoomClosed
+	default:
+	}
+	if r.banned(client) {
+		r.logger.Info("Banned client tried to spectate")
+		return ErrBanned
+	}
+
+	if r.Spectators.Load() >= MAX_SPECTATORS {
+		r.logger.Warn("Room Full")
+		return ErrRoomFull
+	}
+	r.Spectators.Add(1)
+	r.announceChanged()
+	r.logger.Debug("Spectator Joined")
+	return nil
+}
+
+func (r *Room) LeaveSpectator() {
+	r.ids.Lock()
+	defer r.ids.Unlock()
+
+	if spectators := r.Spectators.Add(-1); spectators < 0 {
+		r.logger.Error("Invalid number of spectators",
+			slog.String("roomName", r.Name), slog.Int("spectators", int(spectators)))
+		panic("Negative Number of spectators")
 	}
+	r.announceChanged()
+}
+
+// Announce a change other than a join or leave, must hold the ids lock
+func (r *Room) announceChanged() {
+	if r.Open {
+		r.membersChanged()
+		return
+	}
+
+	// announcements are only built by run while the room has members
+	r.announce()
+}
+
+// Signal run to build a new announcement.
+// Never blocks, a pending signal already covers the change and run may have exited.
+func (r *Room) membersChanged() {
+	select {
+	case r.usersChange <- true:
+	default:
+	}
+}
+
+// Build a new announcement outside of run
+func (r *Room) announce() {
+	if err := r.buildAnnounce(); err != nil {
+		panic(err)
+	}
+}
+
+// Stop accepting joins and signal members to leave through Done
+func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		r.ids.Lock()
+		close(r.closed)
+		r.ids.Unlock()
+	})
+}
 
-	r.usersChange <- true
+// Closed when the room is closed, members should leave once it is
+func (r *Room) Done() <-chan struct{} {
+	return r.closed
+}
+
+// Wait until every member has left the room
+func (r *Room) Wait(ctx context.Context) error {
+	empty := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(empty)
+	}()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (r *Room) Update(client Client, msg ClientStatusMessage) {
-	r.statuses.Store(client.Addr, msg)
+	if r.Muted(msg.Id) {
+		return
+	}
+	r.queueStatus(msg)
+	now := time.Now()
+	r.stallStatus(msg, now)
+	prev, hadPrev := r.statuses.Swap(client.Addr, msg)
+	lastUpdate, _ := r.updated.Swap(client.Addr, now)
+	if hadPrev {
+		prevMsg := prev.(ClientStatusMessage)
+		r.readyStatus(prevMsg, msg)
+		r.tickStatus(&prevMsg, msg)
+	} else {
+		r.tickStatus(nil, msg)
+	}
+	if r.hasSubscribers() {
+		r.publish(Event{
+			Kind:   STATUS_EVENT,
+			Room:   r.Name,
+			Time:   now,
+			Member: &EventMember{Id: msg.Id, Name: client.Name},
+			Status: &msg,
+		})
+		if hadPrev {
+			prevMsg := prev.(ClientStatusMessage)
+			r.emitStateChange(client, &prevMsg, msg, now.Sub(lastUpdate.(time.Time)))
+		} else {
+			r.emitStateChange(client, nil, msg, 0)
+		}
+	}
+	if err := r.Backend.SetStatus(r.Name, msg); err != nil {
+		r.logger.Error("Failed to share status",
+			slog.String("roomName", r.Name),
+			slog.String("err", err.Error()),
+		)
+	}
+	r.record(STATUS_RECORD, msg.WriteBytes(make([]byte, 0, 5)))
 }
 
-// Build the status message continuously until room.done
+// Build the status messages from the backend's statuses
 func (r *Room) buildStatus() error {
-	r.Messages.statusLock.Lock()
-	r.Messages.status = r.Messages.status[:2]
+	statuses, err := r.Backend.Statuses(r.Name)
+	if err != nil {
+		// keep sending the last status until the backend recovers
+		r.logger.Error("Failed to get statuses",
+			slog.String("roomName", r.Name),
+			slog.String("err", err.Error()),
+		)
+		return nil
+	}
+	msg := ServerStatusMessage{Statuses: statuses}
+	r.recordStatuses(statuses)
 
-	count := 0
-	r.statuses.Range(func(k, v any) bool {
-		msg := v.(ClientStatusMessage)
-		r.Messages.status = msg.WriteBytes(r.Messages.status)
-		count++
-		return true
-	})
-	r.Messages.statusLock.Unlock()
-	r.Messages.status[1] = byte(count)
+	status := msg.WriteBytes([]byte{byte(STATUS_MSG)})
+	legacyStatus := msg.WriteLegacyBytes([]byte{byte(STATUS_MSG)})
+	r.record(SERVER_STATUS_RECORD, status)
 
-	var err error
-	r.Messages.statusLock.RLock()
-	defer r.Messages.statusLock.RUnlock()
-	r.Messages.PreparedStatus, err = websocket.NewPreparedMessage(2, r.Messages.status)
+	prepared, err := websocket.NewPreparedMessage(2, status)
+	var preparedLegacy *websocket.PreparedMessage
+	if err == nil {
+		preparedLegacy, err = websocket.NewPreparedMessage(2, legacyStatus)
+	}
 	if err != nil {
 		r.logger.Error("Failed to prepare status message",
 			slog.String("roomName", r.Name),
 			slog.String("err", err.Error()),
-			slog.Int("msgLen", len(r.Messages.status)),
+			slog.Int("msgLen", len(status)),
 		)
 		return err
 	}
 
+	r.Messages.statusLock.Lock()
+	r.Messages.status = status
+	r.Messages.legacyStatus = legacyStatus
+	r.Messages.preparedStatus = prepared
+	r.Messages.preparedLegacyStatus = preparedLegacy
+	r.Messages.statusLock.Unlock()
+
 	return nil
 }
 
@@ -179,52 +715,79 @@ func (r *Room) Check(lastAnnounce int) (int, bool) {
 }
 
 func (r *Room) buildAnnounce() error {
-	r.ids.RLock()
-	r.Messages.announcementLock.Lock()
-	r.Messages.announcements = r.Messages.announcements[:1]
-
-	// NOTE: this only works when MAX_CONNECTIONS <= 255
-	r.Messages.announcements = append(r.Messages.announcements, byte(r.Connections.Load()))
-	// r.Messages.announcements = append(r.Messages.announcements, 0)
+	members, err := r.Backend.Members(r.Name)
+	if err != nil {
+		r.logger.Error("Failed to get members",
+			slog.String("roomName", r.Name),
+			slog.String("err", err.Error()),
+		)
+		return nil
+	}
+	msg := ServerAnnounceMessage{
+		Connections: uint16(len(members)),
+		Clients:     members,
+		Spectators:  uint16(r.Spectators.Load()),
+		Muted:       []uint16{},
+		Stale:       r.staleMembers(),
+	}
+	r.muted.Range(func(id, _ any) bool {
+		msg.Muted = append(msg.Muted, id.(uint16))
+		return true
+	})
+	slices.Sort(msg.Muted)
 
-	for id, client := range r.ids.vals {
-		if client.Addr == "" {
-			continue
-		}
+	announcements := msg.WriteBytes([]byte{byte(ANNOUNCE_MSG)})
+	legacyAnnouncements := msg.WriteLegacyBytes([]byte{byte(ANNOUNCE_MSG)})
 
-		r.Messages.announcements = append(r.Messages.announcements, byte(id))
-		r.Messages.announcements = append(r.Messages.announcements, byte(len(client.Name)))
-		r.Messages.announcements = append(r.Messages.announcements, client.Name...)
-	}
-	r.ids.RUnlock()
-	// r.Messages.announcements[0] = byte(connections)
+	// members see the new announcement once lastAnnounce changes
+	r.Messages.announcementLock.Lock()
+	r.Messages.announcements = announcements
+	r.Messages.unstaleLen = len(announcements) - 2*(len(msg.Stale)+1)
+	r.Messages.unmutedLen = r.Messages.unstaleLen - 2*(len(msg.Muted)+1)
+	r.Messages.legacyAnnouncements = legacyAnnouncements
+	r.lastAnnounce += 1
+	r.record(ANNOUNCE_RECORD, announcements)
 	r.Messages.announcementLock.Unlock()
 
-	var err error
-	r.Messages.PreparedAnnounce, err = websocket.NewPreparedMessage(2, r.Messages.announcements)
-	if err != nil {
-		r.logger.Error("Failed to prepare announce message",
-			slog.String("roomName", r.Name))
-		return err
-	}
-
 	return nil
 }
 
-func (r *Room) runStatus(done <-chan struct{}, d time.Duration) {
-
-	ticker := time.NewTicker(d)
-	defer ticker.Stop()
+// Rebuild the status at the room's TickRate until done
+func (r *Room) runStatus(done <-chan struct{}) {
+	d := r.fastTick()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
+	// membership can change on other instances
+	lastVersion, _ := r.Backend.Version(r.Name)
 	for {
+		woke := false
 		select {
 		case <-done:
-			break
-		case <-ticker.C:
-			if err := r.buildStatus(); err != nil {
-				panic(err)
+			return
+		case <-r.ticks.wake:
+			// a member played or seeked, an adaptive room that backed off ticks now
+			if d <= r.fastTick() {
+				continue
 			}
+			woke = true
+		case <-timer.C:
 		}
+
+		if err := r.buildStatus(); err != nil {
+			panic(err)
+		}
+		if version, err := r.Backend.Version(r.Name); err == nil && version != lastVersion {
+			lastVersion = version
+			r.membersChanged()
+		}
+
+		if woke {
+			d = r.fastTick()
+		} else {
+			d = r.nextTick(d)
+		}
+		timer.Reset(d)
 	}
 }
 
@@ -232,12 +795,11 @@ func (r *Room) runAnnounce(done <-chan struct{}, usersChange <-chan bool) {
 	for {
 		select {
 		case <-done:
-			break
+			return
 		case <-usersChange:
 			if err := r.buildAnnounce(); err != nil {
 				panic(err)
 			}
-			r.lastAnnounce += 1
 		}
 	}
 }
@@ -246,10 +808,19 @@ func (r *Room) runAnnounce(done <-chan struct{}, usersChange <-chan bool) {
 func (r *Room) run() {
 	statusDone := make(chan struct{})
 	announceDone := make(chan struct{})
+	heartbeatDone := make(chan struct{})
 	defer close(statusDone)
 	defer close(announceDone)
+	defer close(heartbeatDone)
 
-	go r.runStatus(statusDone, 1*time.Second)
+	go r.runStatus(statusDone)
 	go r.runAnnounce(announceDone, r.usersChange)
+	go r.runHeartbeats(heartbeatDone)
 	r.wg.Wait()
+
+	// spectators keep watching the empty room
+	if err := r.buildStatus(); err != nil {
+		panic(err)
+	}
+	r.announce()
 }
@@ -0,0 +1,234 @@
+package grog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+var legacyVersion = util.SemVer{Major: 1, Minor: 7}
+
+func newTestRoom(t *testing.T) *Room {
+	t.Helper()
+	return NewRoom("room", slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// Join the room as a member that leaves once the test ends
+func joinRoom(t *testing.T, r *Room, name string, version util.SemVer) (uint16, Client) {
+	t.Helper()
+	client := Client{Name: name, Addr: "test/" + name, Version: version}
+	id, err := r.Join(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Leave(id) })
+	return id, client
+}
+
+func parseAnnounceFrame(t *testing.T, frame []byte) ServerAnnounceMessage {
+	t.Helper()
+	if len(frame) == 0 || MessageType(frame[0]) != ANNOUNCE_MSG {
+		t.Fatalf("frame %v is not an announce", frame)
+	}
+	msg, err := ParseServerAnnounce(frame[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestServerAnnounceRoundTrip(t *testing.T) {
+	clients := []AnnouncedClient{{0, "alice"}, {300, "bob"}, {65534, "carol"}}
+	tests := []struct {
+		name string
+		msg  ServerAnnounceMessage
+	}{
+		{"v2", ServerAnnounceMessage{Connections: 3, Clients: clients, Spectators: 2}},
+		{"v2.1", ServerAnnounceMessage{Connections: 3, Clients: clients, Spectators: 2, Muted: []uint16{300}}},
+		{"v2.6", ServerAnnounceMessage{Connections: 3, Clients: clients, Spectators: 2,
+			Muted: []uint16{300}, Stale: []uint16{0, 65534}}},
+		{"empty", ServerAnnounceMessage{Clients: []AnnouncedClient{}, Muted: []uint16{}, Stale: []uint16{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseServerAnnounce(tt.msg.WriteBytes(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("ParseServerAnnounce() = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestLegacyEncoding(t *testing.T) {
+	announce := ServerAnnounceMessage{
+		Connections: 4,
+		Clients:     []AnnouncedClient{{0, "a"}, {255, "b"}, {256, "c"}, {300, "d"}},
+		Spectators:  258,
+		Muted:       []uint16{0},
+	}
+	status := ServerStatusMessage{Statuses: []ClientStatusMessage{
+		{Offset: 10, PlayerState: PLAYING_STATUS, Id: 0},
+		{Offset: 11, PlayerState: PAUSED_STATUS, Id: 256},
+		{Offset: 12, PlayerState: LOADING_STATUS, Id: 255},
+	}}
+
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		// ids that don't fit in a byte are omitted, muted members are never sent
+		{"announce", announce.WriteLegacyBytes(nil), []byte{2, 0, 1, 'a', 255, 1, 'b', 1, 2}},
+		{"status", status.WriteLegacyBytes(nil), []byte{2, 0, 10, byte(PLAYING_STATUS), 0, 0, 12, byte(LOADING_STATUS), 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.got, tt.want) {
+				t.Errorf("WriteLegacyBytes() = %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+// Members past the v1 limit get 16-bit ids, v1 clients only take ids that fit in a byte
+func TestRoomIds(t *testing.T) {
+	r := newTestRoom(t)
+	for i := range LEGACY_MAX_CONNECTIONS + 1 {
+		if id, _ := joinRoom(t, r, fmt.Sprint("member", i), util.ServerVersion); int(id) != i {
+			t.Fatalf("member %d joined with id %d", i, id)
+		}
+	}
+	if _, err := r.Join(Client{Name: "legacy", Addr: "test/legacy", Version: legacyVersion}); err != ErrRoomFull {
+		t.Errorf("Join() of a v1 client error = %v, want %v", err, ErrRoomFull)
+	}
+
+	if err := r.buildAnnounce(); err != nil {
+		t.Fatal(err)
+	}
+	msg := parseAnnounceFrame(t, r.Messages.Announcements())
+	if msg.Connections != LEGACY_MAX_CONNECTIONS+1 || msg.Clients[len(msg.Clients)-1].Id != LEGACY_MAX_CONNECTIONS {
+		t.Errorf("announced %d members, last id %d", msg.Connections, msg.Clients[len(msg.Clients)-1].Id)
+	}
+	// the v1 count is a byte, so the announce stops at 255 members
+	if legacy := r.Messages.LegacyAnnouncements(); legacy[1] != 255 {
+		t.Errorf("v1 announce counts %d members, want 255", legacy[1])
+	}
+
+	// the id held for a departed member is the last one a v1 client can take
+	r.Leave(3)
+	if id, _ := joinRoom(t, r, "legacy", legacyVersion); id != 3 {
+		t.Errorf("v1 client joined with id %d, want 3", id)
+	}
+}
+
+// Each version is sent the announce fields it knows about
+func TestAnnounceTrimming(t *testing.T) {
+	r := newTestRoom(t)
+	r.Heartbeat = DefaultHeartbeat
+	alice, _ := joinRoom(t, r, "alice", util.ServerVersion)
+	bob, _ := joinRoom(t, r, "bob", util.ServerVersion)
+	carol, _ := joinRoom(t, r, "carol", util.ServerVersion)
+
+	if err := r.Mute(bob, true); err != nil {
+		t.Fatal(err)
+	}
+	r.beats.Lock()
+	r.beats.seen[carol] = time.Now().Add(-r.Heartbeat.StaleAfter)
+	r.beats.Unlock()
+	r.checkHeartbeats(time.Now())
+	if err := r.buildAnnounce(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		muted []uint16
+		stale []uint16
+	}{
+		{"since v2.6", r.Messages.Announcements(), []uint16{bob}, []uint16{carol}},
+		{"since v2.1", r.Messages.UnstaleAnnouncements(), []uint16{bob}, nil},
+		{"before v2.1", r.Messages.UnmutedAnnouncements(), nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseAnnounceFrame(t, tt.frame)
+			ids := make([]uint16, 0, len(msg.Clients))
+			for _, c := range msg.Clients {
+				ids = append(ids, c.Id)
+			}
+			if !slices.Equal(ids, []uint16{alice, bob, carol}) {
+				t.Errorf("announced ids %v, want %v", ids, []uint16{alice, bob, carol})
+			}
+			if !reflect.DeepEqual(msg.Muted, tt.muted) || !reflect.DeepEqual(msg.Stale, tt.stale) {
+				t.Errorf("muted %v and stale %v, want %v and %v", msg.Muted, msg.Stale, tt.muted, tt.stale)
+			}
+		})
+	}
+
+	// a rebuild leaves previously returned announces untouched
+	frame := r.Messages.Announcements()
+	sent := bytes.Clone(frame)
+	if err := r.Mute(bob, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.buildAnnounce(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, sent) {
+		t.Errorf("announce changed from %v to %v after a rebuild", sent, frame)
+	}
+}
+
+// A resumed member takes its held id and last status
+func TestResume(t *testing.T) {
+	r := newTestRoom(t)
+	joinRoom(t, r, "bob", util.ServerVersion)
+	alice, client := joinRoom(t, r, "alice", util.ServerVersion)
+	status := ClientStatusMessage{Id: alice, Offset: 42, PlayerState: PAUSED_STATUS}
+	r.Update(client, status)
+	token := r.Token(alice)
+	r.Leave(alice)
+
+	if _, err := r.Resume(client, "bogus"); err != ErrInvalidResumeToken {
+		t.Errorf("Resume() with an unknown token error = %v, want %v", err, ErrInvalidResumeToken)
+	}
+	id, err := r.Resume(client, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Leave(id) })
+	if id != alice {
+		t.Errorf("resumed with id %d, want %d", id, alice)
+	}
+	statuses, err := r.Backend.Statuses(r.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(statuses, status) {
+		t.Errorf("statuses after Resume() = %v, want %v", statuses, status)
+	}
+}
+
+// Joins and leaves never block, even once the room emptied with announces pending
+func TestMembershipChurn(t *testing.T) {
+	r := newTestRoom(t)
+	client := Client{Name: "alice", Addr: "test/alice", Version: util.ServerVersion}
+	for range 50 {
+		id, err := r.Join(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Leave(id)
+	}
+}
@@ -0,0 +1,106 @@
+package grog
+
+import (
+	"sync"
+	"time"
+)
+
+// Fastest rate a room or connection may tick at
+const MIN_TICK = 100 * time.Millisecond
+
+// Rate of rooms and connections that don't set one
+const DEFAULT_TICK = 1 * time.Second
+
+// How often a room rebuilds its status.
+// An adaptive rate ticks at Interval while members play or seek,
+// and doubles up to Idle while every member is paused.
+type TickRate struct {
+	Interval time.Duration // DEFAULT_TICK when 0
+	Idle     time.Duration // slowest adaptive interval, 0 for a fixed rate
+}
+
+// Intervals requested by a room's connections
+type tickRequests struct {
+	intervals map[time.Duration]int
+	wake      chan struct{} // recieves when the room should tick at its fastest rate
+	sync.Mutex
+}
+
+func (t TickRate) Adaptive() bool {
+	return t.Idle > ClampTick(t.Interval)
+}
+
+// Clamp a requested interval, 0 is DEFAULT_TICK
+func ClampTick(d time.Duration) time.Duration {
+	if d == 0 {
+		return DEFAULT_TICK
+	}
+	return max(d, MIN_TICK)
+}
+
+// Tick at least every d while the returned release function is not called.
+// Connections request their preferred interval for as long as they are open.
+func (r *Room) RequestTick(d time.Duration) func() {
+	d = ClampTick(d)
+	r.ticks.Lock()
+	r.ticks.intervals[d]++
+	r.ticks.Unlock()
+	r.wakeTick()
+
+	return func() {
+		r.ticks.Lock()
+		if r.ticks.intervals[d]--; r.ticks.intervals[d] <= 0 {
+			delete(r.ticks.intervals, d)
+		}
+		r.ticks.Unlock()
+	}
+}
+
+// The room's interval while members play, the fastest of its rate and requested intervals
+func (r *Room) fastTick() time.Duration {
+	fast := ClampTick(r.TickRate.Interval)
+	r.ticks.Lock()
+	for d := range r.ticks.intervals {
+		fast = min(fast, d)
+	}
+	r.ticks.Unlock()
+	return fast
+}
+
+// The interval after last, backing off while an adaptive room is paused
+func (r *Room) nextTick(last time.Duration) time.Duration {
+	fast := r.fastTick()
+	if !r.TickRate.Adaptive() || r.playing() {
+		return fast
+	}
+	return max(min(last*2, r.TickRate.Idle), fast)
+}
+
+// Check if any member is playing
+func (r *Room) playing() bool {
+	playing := false
+	r.statuses.Range(func(_, v any) bool {
+		playing = v.(ClientStatusMessage).PlayerState == PLAYING_STATUS
+		return !playing
+	})
+	return playing
+}
+
+// Return an adaptive room to its fastest rate
+func (r *Room) wakeTick() {
+	select {
+	case r.ticks.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wake an adaptive room when a member plays or seeks
+func (r *Room) tickStatus(prev *ClientStatusMessage, msg ClientStatusMessage) {
+	if !r.TickRate.Adaptive() {
+		return
+	}
+	if msg.PlayerState == PLAYING_STATUS || prev == nil ||
+		prev.PlayerState != msg.PlayerState || prev.Offset != msg.Offset {
+		r.wakeTick()
+	}
+}
@@ -0,0 +1,146 @@
+package grogtest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/jpappel/grog_barrel/pkg/conformance"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// Fuzz targets for the protocol parsers.
+// They are exported so any package can run them from a _test.go file:
+//
+//	func FuzzServerFrame(f *testing.F) { grogtest.FuzzServerFrame(f) }
+
+func seed(f *testing.F, kind conformance.Kind) {
+	for _, v := range conformance.Vectors {
+		if v.Kind == kind {
+			f.Add(v.Frame)
+		}
+	}
+}
+
+func FuzzClientAnnounce(f *testing.F) {
+	seed(f, conformance.CLIENT_ANNOUNCE)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := grog.ParseClientAnnounce(p)
+		if err != nil {
+			return
+		}
+		if encoded := msg.WriteBytes(nil); !bytes.Equal(encoded, p) {
+			t.Errorf("round trip mismatch: % x != % x", encoded, p)
+		}
+	})
+}
+
+func FuzzClientStatus(f *testing.F) {
+	seed(f, conformance.CLIENT_STATUS)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := grog.ParseClientStatus(p, 0)
+		if err != nil {
+			return
+		}
+		if encoded := msg.WriteClientBytes(nil); !bytes.Equal(encoded, p[:3]) {
+			t.Errorf("round trip mismatch: % x != % x", encoded, p[:3])
+		}
+	})
+}
+
+func FuzzClientStatusAck(f *testing.F) {
+	seed(f, conformance.CLIENT_STATUS_ACK)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := grog.ParseClientStatusAck(p, 0)
+		if err != nil {
+			return
+		}
+		if encoded := msg.WriteBytes(nil); !bytes.Equal(encoded, p[:7]) {
+			t.Errorf("round trip mismatch: % x != % x", encoded, p[:7])
+		}
+	})
+}
+
+func FuzzClientQueue(f *testing.F) {
+	seed(f, conformance.CLIENT_QUEUE)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := grog.ParseClientQueue(p)
+		if err != nil {
+			return
+		}
+		if encoded := msg.WriteBytes(nil); !bytes.HasPrefix(p, encoded) {
+			t.Errorf("round trip mismatch: % x is not a prefix of % x", encoded, p)
+		}
+	})
+}
+
+func FuzzClientReady(f *testing.F) {
+	seed(f, conformance.CLIENT_READY)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := grog.ParseClientReady(p)
+		if err != nil {
+			return
+		}
+		if encoded := msg.WriteBytes(nil); !bytes.HasPrefix(p, encoded) {
+			t.Errorf("round trip mismatch: % x is not a prefix of % x", encoded, p)
+		}
+	})
+}
+
+func FuzzServerFrame(f *testing.F) {
+	seed(f, conformance.SERVER_FRAME)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		msg, err := conformance.DecodeServerFrame(p)
+		if err != nil {
+			return
+		}
+
+		// frames may have trailing bytes, so only the prefix has to match
+		var encoded []byte
+		switch m := msg.(type) {
+		case grog.ServerAnnounceMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.ANNOUNCE_MSG)})
+		case grog.ServerStatusMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.STATUS_MSG)})
+		case grog.StatusDeltaMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.DELTA_MSG)})
+		case grog.ResumeMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.RESUME_MSG)})
+		case grog.QueueMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.QUEUE_MSG)})
+		case grog.ReadyMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.READY_MSG)})
+			// any non zero byte marks a check in progress
+			encoded[1] = p[1]
+		case grog.CountdownMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.COUNTDOWN_MSG)})
+		case grog.PauseMessage:
+			encoded = m.WriteBytes([]byte{byte(grog.PAUSE_MSG)})
+			encoded[1] = p[1]
+		default:
+			return
+		}
+		if !bytes.HasPrefix(p, encoded) {
+			t.Errorf("round trip mismatch: % x is not a prefix of % x", encoded, p)
+		}
+	})
+}
+
+func FuzzRecording(f *testing.F) {
+	f.Add([]byte("GROGREC2\x00\x01r"))
+	f.Add([]byte("GROGREC2\x00\x01r\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x07\x00\x00alice"))
+	f.Fuzz(func(t *testing.T, p []byte) {
+		reader, err := grog.NewRecordReader(bytes.NewReader(p))
+		if err != nil {
+			return
+		}
+		for {
+			if _, err := reader.Next(); err != nil {
+				if !errors.Is(err, grog.ErrInvalidRecording) && err.Error() != "EOF" {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package grogtest_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/conformance"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/grogtest"
+	"github.com/jpappel/grog_barrel/pkg/server"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+func FuzzClientAnnounce(f *testing.F)  { grogtest.FuzzClientAnnounce(f) }
+func FuzzClientStatus(f *testing.F)    { grogtest.FuzzClientStatus(f) }
+func FuzzClientStatusAck(f *testing.F) { grogtest.FuzzClientStatusAck(f) }
+func FuzzClientQueue(f *testing.F)     { grogtest.FuzzClientQueue(f) }
+func FuzzClientReady(f *testing.F)     { grogtest.FuzzClientReady(f) }
+func FuzzServerFrame(f *testing.F)     { grogtest.FuzzServerFrame(f) }
+func FuzzRecording(f *testing.F)       { grogtest.FuzzRecording(f) }
+
+func TestVectors(t *testing.T) {
+	for _, v := range conformance.Vectors {
+		t.Run(v.Kind.String()+"/"+v.Name, func(t *testing.T) {
+			if err := conformance.Check(v); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Members on both transports see each other in the same room
+func TestHarness(t *testing.T) {
+	h := grogtest.NewHarness(t, nil)
+
+	announces := make(chan grog.ServerAnnounceMessage, 16)
+	onAnnounce := func(msg grog.ServerAnnounceMessage) {
+		select {
+		case announces <- msg:
+		default:
+		}
+	}
+	ws := h.Dial(t, client.WEBSOCKET_TRANSPORT, "room", "ws", client.Handler{OnAnnounce: onAnnounce})
+	unix := h.Dial(t, client.UNIX_TRANSPORT, "room", "unix", client.Handler{})
+
+	// the server answers each status, so keep sending them until both members are announced
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			ws.SendStatus(0, grog.PLAYING_STATUS)
+			unix.SendStatus(0, grog.PLAYING_STATUS)
+		case msg := <-announces:
+			names := make([]string, 0, len(msg.Clients))
+			for _, c := range msg.Clients {
+				names = append(names, c.Name)
+			}
+			slices.Sort(names)
+			if slices.Equal(names, []string{"unix", "ws"}) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("never announced both members")
+		}
+	}
+}
+
+// Spectators on both transports are dropped once silent for the eviction window
+func TestSpectatorEviction(t *testing.T) {
+	h := grogtest.NewHarness(t, nil)
+	room := grog.NewRoom("evict", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	room.Heartbeat = grog.Heartbeat{
+		Interval:   20 * time.Millisecond,
+		StaleAfter: 50 * time.Millisecond,
+		EvictAfter: 100 * time.Millisecond,
+	}
+	server.Rooms.Register(room)
+
+	spectate := func(transport client.Transport, name string, heartbeat time.Duration) *client.Client {
+		t.Helper()
+		cfg := h.Config(transport, room.Name, name)
+		cfg.Spectate = true
+		cfg.Heartbeat = heartbeat
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := client.Dial(ctx, cfg, client.Handler{})
+		if err != nil {
+			t.Fatalf("dial %s: %v", transport, err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	ws := spectate(client.WEBSOCKET_TRANSPORT, "ws", 0)
+	unix := spectate(client.UNIX_TRANSPORT, "unix", room.Heartbeat.Interval)
+	silentUnix := spectate(client.UNIX_TRANSPORT, "silent-unix", time.Hour)
+
+	// never reads, so the server's pings go unanswered
+	u := url.URL{Scheme: "ws", Host: h.Addr, Path: "/barrel/" + room.Name, RawQuery: "spectate"}
+	silentWs, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silentWs.Close() })
+	announce := grog.ClientAnnounceMessage{Version: util.ServerVersion, Name: "silent-ws"}
+	if err := silentWs.WriteMessage(websocket.BinaryMessage, announce.WriteBytes(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-silentUnix.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent unix spectator was never dropped")
+	}
+	timeout := time.After(5 * time.Second)
+	for room.Spectators.Load() != 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("%d spectators, want 2", room.Spectators.Load())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// spectators that answer pings or send heartbeats outlast several windows
+	time.Sleep(5 * room.Heartbeat.EvictAfter)
+	for transport, c := range map[client.Transport]*client.Client{client.WEBSOCKET_TRANSPORT: ws, client.UNIX_TRANSPORT: unix} {
+		select {
+		case <-c.Done():
+			t.Errorf("%s spectator was dropped: %v", transport, c.Err())
+		default:
+		}
+	}
+	if n := room.Spectators.Load(); n != 2 {
+		t.Errorf("%d spectators, want 2", n)
+	}
+}
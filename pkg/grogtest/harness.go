@@ -0,0 +1,97 @@
+// Package grogtest provides an in-process server harness and fuzz targets
+// for testing grogbarrel servers and clients against the conformance vectors.
+package grogtest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/server"
+)
+
+// An in-process grogbarrel server listening on both transports
+type Harness struct {
+	// host:port of the http server
+	Addr string
+	// base directory of the socket server, containing join.sock
+	BaseDir string
+	Logger  *slog.Logger
+}
+
+// Start a server for the duration of a test.
+// Logs are discarded unless logger is non-nil.
+func NewHarness(tb testing.TB, logger *slog.Logger) *Harness {
+	tb.Helper()
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	srv := httptest.NewServer(server.New(logger))
+	tb.Cleanup(srv.Close)
+
+	// unix socket paths are limited to ~100 bytes, so avoid the long paths of tb.TempDir
+	dir, err := os.MkdirTemp("", "grogtest")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	go server.NewSockServer(dir, logger).Run(ctx)
+
+	joinSock := filepath.Join(dir, "join.sock")
+	for range 100 {
+		if _, err := os.Stat(joinSock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(joinSock); err != nil {
+		tb.Fatal("socket server never opened join.sock:", err)
+	}
+
+	return &Harness{
+		Addr:    srv.Listener.Addr().String(),
+		BaseDir: dir,
+		Logger:  logger,
+	}
+}
+
+// Client config for a transport of the harness
+func (h *Harness) Config(transport client.Transport, room string, name string) client.Config {
+	cfg := client.Config{
+		Transport: transport,
+		Addr:      h.Addr,
+		Room:      room,
+		Name:      name,
+		Logger:    h.Logger,
+	}
+	if transport == client.UNIX_TRANSPORT {
+		cfg.Addr = h.BaseDir
+	}
+	return cfg
+}
+
+// Connect a client to a room, failing the test on error.
+// The client is closed when the test finishes.
+func (h *Harness) Dial(tb testing.TB, transport client.Transport, room string, name string, handler client.Handler) *client.Client {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, h.Config(transport, room, name), handler)
+	if err != nil {
+		tb.Fatalf("dial %s: %v", transport, err)
+	}
+	tb.Cleanup(func() { c.Close() })
+
+	return c
+}
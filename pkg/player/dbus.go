@@ -0,0 +1,627 @@
+package player
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal D-Bus client, supporting only what is needed to call methods on MPRIS players
+
+type dbusMessageType byte
+
+const (
+	dbusMethodCall dbusMessageType = iota + 1
+	dbusMethodReturn
+	dbusError
+	dbusSignal
+)
+
+const (
+	dbusFieldPath byte = iota + 1
+	dbusFieldInterface
+	dbusFieldMember
+	dbusFieldErrorName
+	dbusFieldReplySerial
+	dbusFieldDestination
+	dbusFieldSender
+	dbusFieldSignature
+)
+
+var ErrDbusMessage error = errors.New("malformed dbus message")
+
+// A D-Bus object path, encoded with signature 'o'
+type dbusObjectPath string
+
+// A D-Bus signature, encoded with signature 'g'
+type dbusSignature string
+
+type dbusMessage struct {
+	Type   dbusMessageType
+	Serial uint32
+	Fields map[byte]any
+	Body   []any
+}
+
+// Error returned by a remote method call
+type DbusError struct {
+	Name    string
+	Message string
+}
+
+type dbusConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	serial    uint32
+	pending   map[uint32]chan *dbusMessage
+	err       error
+}
+
+func (e DbusError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+// Connect to a D-Bus address such as DBUS_SESSION_BUS_ADDRESS and authenticate
+func dialDbus(ctx context.Context, address string) (*dbusConn, error) {
+	var d net.Dialer
+	var conn net.Conn
+	err := errors.New("no supported transport in dbus address " + address)
+
+	for _, addr := range strings.Split(address, ";") {
+		transport, params, _ := strings.Cut(addr, ":")
+		if transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "path":
+				conn, err = d.DialContext(ctx, "unix", value)
+			case "abstract":
+				conn, err = d.DialContext(ctx, "unix", "@"+value)
+			}
+		}
+		if conn != nil {
+			break
+		}
+	}
+	if conn == nil {
+		return nil, err
+	}
+
+	c := &dbusConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		pending: make(map[uint32]chan *dbusMessage),
+	}
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.read()
+
+	if _, err := c.call(ctx, "org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "Hello", ""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Authenticate as the current user with SASL EXTERNAL
+func (c *dbusConn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("dbus authentication failed: %s", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+// Call a method, args are encoded according to signature
+func (c *dbusConn) call(ctx context.Context, dest string, path string, iface string, member string, signature string, args ...any) ([]any, error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.serial++
+	serial := c.serial
+	reply := make(chan *dbusMessage, 1)
+	c.pending[serial] = reply
+	c.lock.Unlock()
+
+	fields := map[byte]any{
+		dbusFieldPath:        dbusObjectPath(path),
+		dbusFieldInterface:   iface,
+		dbusFieldMember:      member,
+		dbusFieldDestination: dest,
+	}
+	if signature != "" {
+		fields[dbusFieldSignature] = dbusSignature(signature)
+	}
+	msg, err := encodeDbusMessage(dbusMethodCall, serial, fields, signature, args)
+	if err == nil {
+		c.writeLock.Lock()
+		_, err = c.conn.Write(msg)
+		c.writeLock.Unlock()
+	}
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, serial)
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.lock.Lock()
+		delete(c.pending, serial)
+		c.lock.Unlock()
+		return nil, ctx.Err()
+	case msg, ok := <-reply:
+		if !ok {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			return nil, c.err
+		} else if msg.Type == dbusError {
+			dbusErr := DbusError{}
+			dbusErr.Name, _ = msg.Fields[dbusFieldErrorName].(string)
+			if len(msg.Body) > 0 {
+				dbusErr.Message, _ = msg.Body[0].(string)
+			}
+			return nil, dbusErr
+		}
+		return msg.Body, nil
+	}
+}
+
+// Dispatch replies to their calls until the connection closes
+func (c *dbusConn) read() {
+	var err error
+	for {
+		var msg *dbusMessage
+		msg, err = readDbusMessage(c.reader)
+		if err != nil {
+			break
+		} else if msg.Type != dbusMethodReturn && msg.Type != dbusError {
+			continue
+		}
+
+		replySerial, _ := msg.Fields[dbusFieldReplySerial].(uint32)
+		c.lock.Lock()
+		if ch, ok := c.pending[replySerial]; ok {
+			ch <- msg
+			delete(c.pending, replySerial)
+		}
+		c.lock.Unlock()
+	}
+
+	c.lock.Lock()
+	c.err = err
+	for serial, ch := range c.pending {
+		close(ch)
+		delete(c.pending, serial)
+	}
+	c.lock.Unlock()
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// Encoder for the little endian D-Bus wire format
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *dbusEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(s string) {
+	e.buf = append(e.buf, byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// Encode a single value of a basic type or a variant of one
+func (e *dbusEncoder) value(sig byte, v any) error {
+	switch sig {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return fmt.Errorf("dbus: expected byte, got %T", v)
+		}
+		e.buf = append(e.buf, b)
+	case 'u':
+		u, ok := v.(uint32)
+		if !ok {
+			return fmt.Errorf("dbus: expected uint32, got %T", v)
+		}
+		e.uint32(u)
+	case 'x':
+		x, ok := v.(int64)
+		if !ok {
+			return fmt.Errorf("dbus: expected int64, got %T", v)
+		}
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(x))
+	case 's':
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("dbus: expected string, got %T", v)
+		}
+		e.string(s)
+	case 'o':
+		o, ok := v.(dbusObjectPath)
+		if !ok {
+			return fmt.Errorf("dbus: expected object path, got %T", v)
+		}
+		e.string(string(o))
+	case 'g':
+		g, ok := v.(dbusSignature)
+		if !ok {
+			return fmt.Errorf("dbus: expected signature, got %T", v)
+		}
+		e.signature(string(g))
+	case 'v':
+		var inner byte
+		switch v.(type) {
+		case byte:
+			inner = 'y'
+		case uint32:
+			inner = 'u'
+		case int64:
+			inner = 'x'
+		case string:
+			inner = 's'
+		case dbusObjectPath:
+			inner = 'o'
+		case dbusSignature:
+			inner = 'g'
+		default:
+			return fmt.Errorf("dbus: unsupported variant type %T", v)
+		}
+		e.signature(string(inner))
+		return e.value(inner, v)
+	default:
+		return fmt.Errorf("dbus: unsupported signature %c", sig)
+	}
+	return nil
+}
+
+func encodeDbusMessage(msgType dbusMessageType, serial uint32, fields map[byte]any, signature string, args []any) ([]byte, error) {
+	if len(signature) != len(args) {
+		return nil, errors.New("dbus: signature does not match arguments")
+	}
+
+	body := &dbusEncoder{}
+	for i, arg := range args {
+		if err := body.value(signature[i], arg); err != nil {
+			return nil, err
+		}
+	}
+
+	header := &dbusEncoder{buf: []byte{'l', byte(msgType), 0, 1}}
+	header.uint32(uint32(len(body.buf)))
+	header.uint32(serial)
+
+	// header fields are an array of (byte, variant)
+	fieldsEnc := &dbusEncoder{buf: make([]byte, 0, 128)}
+	for code := dbusFieldPath; code <= dbusFieldSignature; code++ {
+		v, ok := fields[code]
+		if !ok {
+			continue
+		}
+		// fields start at offset 16, which is 8 aligned
+		fieldsEnc.align(8)
+		fieldsEnc.buf = append(fieldsEnc.buf, code)
+		if err := fieldsEnc.value('v', v); err != nil {
+			return nil, err
+		}
+	}
+	header.uint32(uint32(len(fieldsEnc.buf)))
+	header.buf = append(header.buf, fieldsEnc.buf...)
+	header.align(8)
+
+	return append(header.buf, body.buf...), nil
+}
+
+// Decoder for the D-Bus wire format, offsets are relative to an 8 aligned start
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *dbusDecoder) align(n int) error {
+	for d.pos%n != 0 {
+		d.pos++
+	}
+	if d.pos > len(d.buf) {
+		return ErrDbusMessage
+	}
+	return nil
+}
+
+func (d *dbusDecoder) take(n int) ([]byte, error) {
+	if d.pos+n > len(d.buf) || n < 0 {
+		return nil, ErrDbusMessage
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *dbusDecoder) fixed(size int) ([]byte, error) {
+	if err := d.align(size); err != nil {
+		return nil, err
+	}
+	return d.take(size)
+}
+
+// Length of the first complete type in a signature
+func dbusTypeLen(sig string) (int, error) {
+	if len(sig) == 0 {
+		return 0, ErrDbusMessage
+	}
+	switch sig[0] {
+	case 'a':
+		n, err := dbusTypeLen(sig[1:])
+		return n + 1, err
+	case '(', '{':
+		closing := byte(')')
+		if sig[0] == '{' {
+			closing = '}'
+		}
+		i := 1
+		for i < len(sig) && sig[i] != closing {
+			n, err := dbusTypeLen(sig[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		if i >= len(sig) {
+			return 0, ErrDbusMessage
+		}
+		return i + 1, nil
+	default:
+		return 1, nil
+	}
+}
+
+// Decode the values of a signature
+func (d *dbusDecoder) values(sig string) ([]any, error) {
+	var values []any
+	for len(sig) > 0 {
+		n, err := dbusTypeLen(sig)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(sig[:n])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		sig = sig[n:]
+	}
+	return values, nil
+}
+
+// Decode a single complete type
+func (d *dbusDecoder) value(sig string) (any, error) {
+	switch sig[0] {
+	case 'y':
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b) != 0, nil
+	case 'n':
+		b, err := d.fixed(2)
+		if err != nil {
+			return nil, err
+		}
+		return int16(d.order.Uint16(b)), nil
+	case 'q':
+		b, err := d.fixed(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint16(b), nil
+	case 'i':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return int32(d.order.Uint32(b)), nil
+	case 'u', 'h':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b), nil
+	case 'x':
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(d.order.Uint64(b)), nil
+	case 't':
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint64(b), nil
+	case 'd':
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(d.order.Uint64(b)), nil
+	case 's', 'o':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(d.order.Uint32(b)) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		n, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(n[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		sig, err := d.value("g")
+		if err != nil {
+			return nil, err
+		}
+		values, err := d.values(sig.(string))
+		if err != nil || len(values) != 1 {
+			return nil, ErrDbusMessage
+		}
+		return values[0], nil
+	case 'a':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		length := int(d.order.Uint32(b))
+		// elements are aligned even when the array is empty
+		elemAlign := 1
+		switch sig[1] {
+		case 'x', 't', 'd', '(', '{':
+			elemAlign = 8
+		case 'b', 'i', 'u', 'h', 's', 'o', 'a':
+			elemAlign = 4
+		case 'n', 'q':
+			elemAlign = 2
+		}
+		if err := d.align(elemAlign); err != nil {
+			return nil, err
+		}
+		end := d.pos + length
+		if end > len(d.buf) {
+			return nil, ErrDbusMessage
+		}
+		var elems []any
+		for d.pos < end {
+			v, err := d.value(sig[1:])
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, v)
+		}
+		return elems, nil
+	case '(', '{':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		return d.values(sig[1 : len(sig)-1])
+	default:
+		return nil, fmt.Errorf("dbus: unsupported signature %c", sig[0])
+	}
+}
+
+func readDbusMessage(r io.Reader) (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, ErrDbusMessage
+	}
+	bodyLen := int(order.Uint32(fixed[4:8]))
+	fieldsLen := int(order.Uint32(fixed[12:16]))
+	// pad the header fields to 8 bytes
+	headerLen := 16 + fieldsLen + (8-(16+fieldsLen)%8)%8
+	if bodyLen > 1<<27 || fieldsLen > 1<<26 {
+		return nil, ErrDbusMessage
+	}
+
+	buf := make([]byte, headerLen+bodyLen)
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &dbusMessage{
+		Type:   dbusMessageType(fixed[1]),
+		Serial: order.Uint32(fixed[8:12]),
+		Fields: make(map[byte]any),
+	}
+
+	header := &dbusDecoder{buf: buf[:16+fieldsLen], pos: 12, order: order}
+	fields, err := header.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields.([]any) {
+		pair := field.([]any)
+		msg.Fields[pair[0].(byte)] = pair[1]
+	}
+
+	if signature, ok := msg.Fields[dbusFieldSignature].(string); ok && bodyLen > 0 {
+		body := &dbusDecoder{buf: buf[headerLen:], order: order}
+		if msg.Body, err = body.values(signature); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,360 @@
+package player
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+const dbusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%DIR%</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// Start a private dbus-daemon for the duration of a test and return its address
+func startDbusDaemon(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	// unix socket paths are limited to ~100 bytes, so avoid the long paths of t.TempDir
+	dir, err := os.MkdirTemp("", "dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(strings.ReplaceAll(dbusConfig, "%DIR%", dir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal("dbus-daemon did not print its address:", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func dbusTestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestDbusMessageRoundTrip(t *testing.T) {
+	fields := map[byte]any{
+		dbusFieldPath:        dbusObjectPath("/org/mpris/MediaPlayer2"),
+		dbusFieldInterface:   "org.mpris.MediaPlayer2.Player",
+		dbusFieldMember:      "Seek",
+		dbusFieldReplySerial: uint32(7),
+		dbusFieldSignature:   dbusSignature("yuxsogv"),
+	}
+	args := []any{byte(3), uint32(1 << 20), int64(-5_000_000), "text",
+		dbusObjectPath("/a/b"), dbusSignature("as"), int64(42)}
+
+	encoded, err := encodeDbusMessage(dbusMethodCall, 9, fields, "yuxsogv", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readDbusMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Type != dbusMethodCall || msg.Serial != 9 {
+		t.Errorf("type, serial = %v, %d, want %v, 9", msg.Type, msg.Serial, dbusMethodCall)
+	}
+	wantFields := map[byte]any{
+		dbusFieldPath:        "/org/mpris/MediaPlayer2",
+		dbusFieldInterface:   "org.mpris.MediaPlayer2.Player",
+		dbusFieldMember:      "Seek",
+		dbusFieldReplySerial: uint32(7),
+		dbusFieldSignature:   "yuxsogv",
+	}
+	if !reflect.DeepEqual(msg.Fields, wantFields) {
+		t.Errorf("fields = %v, want %v", msg.Fields, wantFields)
+	}
+	wantBody := []any{byte(3), uint32(1 << 20), int64(-5_000_000), "text", "/a/b", "as", int64(42)}
+	if !reflect.DeepEqual(msg.Body, wantBody) {
+		t.Errorf("body = %v, want %v", msg.Body, wantBody)
+	}
+
+	// every truncation of a valid message is rejected rather than misread
+	for i := range len(encoded) {
+		if _, err := readDbusMessage(bytes.NewReader(encoded[:i])); err == nil {
+			t.Errorf("message truncated to %d bytes was accepted", i)
+		}
+	}
+}
+
+func TestDbusBus(t *testing.T) {
+	address := startDbusDaemon(t)
+	ctx := dbusTestContext(t)
+
+	c, err := dialDbus(ctx, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const bus, busPath = "org.freedesktop.DBus", "/org/freedesktop/DBus"
+
+	body, err := c.call(ctx, bus, busPath, bus, "GetId", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := body[0].(string); len(id) != 32 {
+		t.Errorf("GetId() = %v, want a 32 character id", body)
+	}
+
+	body, err = c.call(ctx, bus, busPath, bus, "NameHasOwner", "s", bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(body, []any{true}) {
+		t.Errorf("NameHasOwner(%s) = %v, want [true]", bus, body)
+	}
+
+	body, err = c.call(ctx, bus, busPath, bus, "ListNames", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := body[0].([]any); len(names) < 2 || names[0] != bus {
+		t.Errorf("ListNames() = %v, want the bus and this connection", body)
+	}
+
+	// Features is an array of strings inside a variant
+	body, err = c.call(ctx, bus, busPath, "org.freedesktop.DBus.Properties", "Get", "ss", bus, "Features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body[0].([]any); !ok {
+		t.Errorf("Get(Features) = %#v, want an array", body)
+	}
+
+	_, err = c.call(ctx, bus, busPath, bus, "GetNameOwner", "s", mprisPrefix+"missing")
+	var dbusErr DbusError
+	if !errors.As(err, &dbusErr) || dbusErr.Name != "org.freedesktop.DBus.Error.NameHasNoOwner" {
+		t.Errorf("GetNameOwner(missing) error = %v, want NameHasNoOwner", err)
+	}
+}
+
+// A fake MPRIS player owning a name on the bus
+type fakeMpris struct {
+	lock     sync.Mutex
+	status   string
+	position int64
+	calls    []string
+	conn     *dbusConn
+}
+
+// Connect a fake player to the bus as org.mpris.MediaPlayer2.<name>
+func newFakeMpris(t *testing.T, ctx context.Context, address string, name string) *fakeMpris {
+	t.Helper()
+	path := strings.TrimPrefix(strings.Split(address, ",")[0], "unix:path=")
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// the client's read loop discards method calls, so the player serves the connection itself
+	c := &dbusConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.auth(); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMpris{status: "Playing", position: 10_000_000, conn: c}
+
+	const bus, busPath = "org.freedesktop.DBus", "/org/freedesktop/DBus"
+	f.send(t, dbusMethodCall, 1, map[byte]any{
+		dbusFieldPath: dbusObjectPath(busPath), dbusFieldInterface: bus, dbusFieldMember: "Hello", dbusFieldDestination: bus,
+	}, "")
+	f.send(t, dbusMethodCall, 2, map[byte]any{
+		dbusFieldPath: dbusObjectPath(busPath), dbusFieldInterface: bus, dbusFieldMember: "RequestName", dbusFieldDestination: bus,
+		dbusFieldSignature: dbusSignature("su"),
+	}, "su", mprisPrefix+name, uint32(0))
+	for {
+		msg, err := readDbusMessage(c.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == dbusError {
+			t.Fatal("fake player failed to join the bus:", msg.Body)
+		}
+		if serial, _ := msg.Fields[dbusFieldReplySerial].(uint32); serial == 2 {
+			break
+		}
+	}
+
+	go f.serve()
+	return f
+}
+
+func (f *fakeMpris) send(t *testing.T, msgType dbusMessageType, serial uint32, fields map[byte]any, signature string, args ...any) {
+	msg, err := encodeDbusMessage(msgType, serial, fields, signature, args)
+	if err == nil {
+		_, err = f.conn.conn.Write(msg)
+	}
+	if err != nil && t != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeMpris) serve() {
+	serial := uint32(100)
+	for {
+		msg, err := readDbusMessage(f.conn.reader)
+		if err != nil {
+			return
+		} else if msg.Type != dbusMethodCall {
+			continue
+		}
+
+		member, _ := msg.Fields[dbusFieldMember].(string)
+		sender, _ := msg.Fields[dbusFieldSender].(string)
+		fields := map[byte]any{dbusFieldReplySerial: msg.Serial, dbusFieldDestination: sender}
+		var signature string
+		var reply []any
+
+		f.lock.Lock()
+		f.calls = append(f.calls, member)
+		switch member {
+		case "Get":
+			signature = "v"
+			if msg.Body[1] == "Position" {
+				reply = []any{f.position}
+			} else {
+				reply = []any{f.status}
+			}
+		case "PlayPause":
+			if f.status == "Playing" {
+				f.status = "Paused"
+			} else {
+				f.status = "Playing"
+			}
+		case "Seek":
+			f.position += msg.Body[0].(int64)
+		}
+		f.lock.Unlock()
+
+		serial++
+		if signature != "" {
+			fields[dbusFieldSignature] = dbusSignature(signature)
+		}
+		f.send(nil, dbusMethodReturn, serial, fields, signature, reply...)
+	}
+}
+
+func (f *fakeMpris) set(status string, position int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status = status
+	f.position = position
+}
+
+func (f *fakeMpris) called(member string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if call == member {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMpris(t *testing.T) {
+	address := startDbusDaemon(t)
+	ctx := dbusTestContext(t)
+
+	if _, err := DialMpris(ctx, address, ""); !errors.Is(err, ErrNoMprisPlayer) {
+		t.Fatalf("DialMpris() on an empty bus error = %v, want %v", err, ErrNoMprisPlayer)
+	}
+
+	f := newFakeMpris(t, ctx, address, "fake")
+	if _, err := DialMpris(ctx, address, "other"); !errors.Is(err, ErrNoMprisPlayer) {
+		t.Errorf("DialMpris(other) error = %v, want %v", err, ErrNoMprisPlayer)
+	}
+	m, err := DialMpris(ctx, address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Name != mprisPrefix+"fake" {
+		t.Errorf("Name = %s, want %s", m.Name, mprisPrefix+"fake")
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grog.ClientStatusMessage{Offset: 10, PlayerState: grog.PLAYING_STATUS}); status != want {
+		t.Errorf("Status() = %+v, want %+v", status, want)
+	}
+
+	// PlayPause toggles, so it is only called when the status must change
+	for _, step := range []func(context.Context) error{m.Play, m.Pause, m.Pause} {
+		if err := step(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.called("PlayPause"); n != 1 {
+		t.Errorf("PlayPause called %d times, want 1", n)
+	}
+
+	// Seek is relative, so the offset is reached from any position
+	f.set("Paused", 40_500_000)
+	if err := m.Seek(ctx, 95); err != nil {
+		t.Fatal(err)
+	}
+	status, err = m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grog.ClientStatusMessage{Offset: 95, PlayerState: grog.PAUSED_STATUS}); status != want {
+		t.Errorf("Status() after Seek = %+v, want %+v", status, want)
+	}
+
+	f.set("Stopped", 0)
+	if _, err := m.Status(ctx); !errors.Is(err, ErrNoMedia) {
+		t.Errorf("Status() when stopped error = %v, want %v", err, ErrNoMedia)
+	}
+}
@@ -0,0 +1,167 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+const (
+	mprisPrefix = "org.mpris.MediaPlayer2."
+	mprisPath   = "/org/mpris/MediaPlayer2"
+	mprisPlayer = "org.mpris.MediaPlayer2.Player"
+)
+
+var ErrNoMprisPlayer error = errors.New("no MPRIS player found on the bus")
+
+// A media player controlled over MPRIS2 on D-Bus
+type Mpris struct {
+	conn *dbusConn
+	// bus name of the player, e.g. org.mpris.MediaPlayer2.vlc
+	Name string
+}
+
+// Connect to an MPRIS player on the bus at address, or DBUS_SESSION_BUS_ADDRESS when empty.
+//
+// player is the name after org.mpris.MediaPlayer2., when empty the first player on the bus is used.
+func DialMpris(ctx context.Context, address string, player string) (*Mpris, error) {
+	if address == "" {
+		address = os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	}
+	if address == "" {
+		return nil, errors.New("no dbus address, DBUS_SESSION_BUS_ADDRESS is unset")
+	}
+
+	conn, err := dialDbus(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mpris{conn: conn, Name: mprisPrefix + player}
+
+	body, err := conn.call(ctx, "org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "ListNames", "")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	names, _ := body[0].([]any)
+	i := slices.IndexFunc(names, func(name any) bool {
+		s, _ := name.(string)
+		if player == "" {
+			return strings.HasPrefix(s, mprisPrefix)
+		}
+		return s == m.Name
+	})
+	if i < 0 {
+		conn.Close()
+		return nil, ErrNoMprisPlayer
+	}
+	m.Name = names[i].(string)
+
+	return m, nil
+}
+
+func (m *Mpris) property(ctx context.Context, name string) (any, error) {
+	body, err := m.conn.call(ctx, m.Name, mprisPath,
+		"org.freedesktop.DBus.Properties", "Get", "ss", mprisPlayer, name)
+	if err != nil {
+		return nil, err
+	} else if len(body) != 1 {
+		return nil, ErrDbusMessage
+	}
+	return body[0], nil
+}
+
+func (m *Mpris) playbackStatus(ctx context.Context) (string, error) {
+	v, err := m.property(ctx, "PlaybackStatus")
+	if err != nil {
+		return "", err
+	}
+	status, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected PlaybackStatus type %T", v)
+	}
+	return status, nil
+}
+
+// Position in microseconds
+func (m *Mpris) position(ctx context.Context) (int64, error) {
+	v, err := m.property(ctx, "Position")
+	if err != nil {
+		return 0, err
+	}
+	position, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected Position type %T", v)
+	}
+	return position, nil
+}
+
+func (m *Mpris) Status(ctx context.Context) (grog.ClientStatusMessage, error) {
+	status, err := m.playbackStatus(ctx)
+	if err != nil {
+		return grog.ClientStatusMessage{}, err
+	}
+
+	msg := grog.ClientStatusMessage{}
+	switch status {
+	case "Playing":
+		msg.PlayerState = grog.PLAYING_STATUS
+	case "Paused":
+		msg.PlayerState = grog.PAUSED_STATUS
+	case "Stopped":
+		return msg, ErrNoMedia
+	default:
+		msg.PlayerState = grog.UNKNOWN_STATUS
+	}
+
+	position, err := m.position(ctx)
+	if err != nil {
+		return msg, err
+	}
+	msg.Offset = uint16(min(max(position/1_000_000, 0), 65535))
+
+	return msg, nil
+}
+
+// PlayPause toggles playback, so only call it when the status differs
+func (m *Mpris) playPauseFrom(ctx context.Context, status string) error {
+	current, err := m.playbackStatus(ctx)
+	if err != nil {
+		return err
+	} else if current != status {
+		return nil
+	}
+
+	_, err = m.conn.call(ctx, m.Name, mprisPath, mprisPlayer, "PlayPause", "")
+	return err
+}
+
+func (m *Mpris) Play(ctx context.Context) error {
+	return m.playPauseFrom(ctx, "Paused")
+}
+
+func (m *Mpris) Pause(ctx context.Context) error {
+	return m.playPauseFrom(ctx, "Playing")
+}
+
+// Seek is relative in MPRIS, so the current position is read first
+func (m *Mpris) Seek(ctx context.Context, offset uint16) error {
+	position, err := m.position(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.conn.call(ctx, m.Name, mprisPath, mprisPlayer, "Seek", "x",
+		int64(offset)*1_000_000-position)
+	return err
+}
+
+func (m *Mpris) Close() error {
+	return m.conn.Close()
+}
@@ -0,0 +1,178 @@
+package player
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// A response or event from mpv's JSON IPC
+type mpvMessage struct {
+	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error"`
+	RequestId int             `json:"request_id"`
+	Event     string          `json:"event"`
+}
+
+type mpvRequest struct {
+	Command   []any `json:"command"`
+	RequestId int   `json:"request_id"`
+}
+
+// An mpv instance controlled over its --input-ipc-server socket
+type Mpv struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	nextId  int
+	pending map[int]chan mpvMessage
+	err     error
+}
+
+// Connect to the socket of an mpv instance started with --input-ipc-server
+func DialMpv(ctx context.Context, path string) (*Mpv, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mpv{
+		conn:    conn,
+		pending: make(map[int]chan mpvMessage),
+	}
+	go m.read()
+
+	return m, nil
+}
+
+// Dispatch responses to their requests until the connection closes
+func (m *Mpv) read() {
+	scanner := bufio.NewScanner(m.conn)
+	for scanner.Scan() {
+		var msg mpvMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.Event != "" {
+			continue
+		}
+
+		m.lock.Lock()
+		if ch, ok := m.pending[msg.RequestId]; ok {
+			ch <- msg
+			delete(m.pending, msg.RequestId)
+		}
+		m.lock.Unlock()
+	}
+
+	m.lock.Lock()
+	m.err = scanner.Err()
+	if m.err == nil {
+		m.err = errors.New("mpv closed the connection")
+	}
+	for id, ch := range m.pending {
+		close(ch)
+		delete(m.pending, id)
+	}
+	m.lock.Unlock()
+}
+
+// Run an mpv command and return its data
+func (m *Mpv) command(ctx context.Context, args ...any) (json.RawMessage, error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	m.nextId++
+	id := m.nextId
+	ch := make(chan mpvMessage, 1)
+	m.pending[id] = ch
+
+	req, err := json.Marshal(mpvRequest{args, id})
+	if err == nil {
+		_, err = m.conn.Write(append(req, '\n'))
+	}
+	if err != nil {
+		delete(m.pending, id)
+		m.lock.Unlock()
+		return nil, err
+	}
+	m.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		m.lock.Lock()
+		delete(m.pending, id)
+		m.lock.Unlock()
+		return nil, ctx.Err()
+	case msg, ok := <-ch:
+		if !ok {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			return nil, m.err
+		} else if msg.Error == "property unavailable" {
+			return nil, ErrNoMedia
+		} else if msg.Error != "success" {
+			return nil, fmt.Errorf("mpv %v: %s", args[0], msg.Error)
+		}
+		return msg.Data, nil
+	}
+}
+
+func (m *Mpv) getProperty(ctx context.Context, name string, v any) error {
+	data, err := m.command(ctx, "get_property", name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (m *Mpv) Status(ctx context.Context) (grog.ClientStatusMessage, error) {
+	var timePos float64
+	var paused, pausedForCache bool
+
+	if err := m.getProperty(ctx, "time-pos", &timePos); err != nil {
+		return grog.ClientStatusMessage{}, err
+	}
+	if err := m.getProperty(ctx, "pause", &paused); err != nil {
+		return grog.ClientStatusMessage{}, err
+	}
+	if err := m.getProperty(ctx, "paused-for-cache", &pausedForCache); err != nil {
+		return grog.ClientStatusMessage{}, err
+	}
+
+	status := grog.ClientStatusMessage{
+		Offset:      uint16(min(max(timePos, 0), 65535)),
+		PlayerState: grog.PLAYING_STATUS,
+	}
+	if pausedForCache {
+		status.PlayerState = grog.LOADING_STATUS
+	} else if paused {
+		status.PlayerState = grog.PAUSED_STATUS
+	}
+
+	return status, nil
+}
+
+func (m *Mpv) Play(ctx context.Context) error {
+	_, err := m.command(ctx, "set_property", "pause", false)
+	return err
+}
+
+func (m *Mpv) Pause(ctx context.Context) error {
+	_, err := m.command(ctx, "set_property", "pause", true)
+	return err
+}
+
+func (m *Mpv) Seek(ctx context.Context, offset uint16) error {
+	_, err := m.command(ctx, "seek", offset, "absolute")
+	return err
+}
+
+func (m *Mpv) Close() error {
+	return m.conn.Close()
+}
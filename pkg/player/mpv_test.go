@@ -0,0 +1,239 @@
+package player
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// A fake mpv answering get_property, set_property and seek over a JSON IPC socket
+type fakeMpv struct {
+	lock       sync.Mutex
+	properties map[string]any
+	commands   [][]any
+	listener   net.Listener
+}
+
+func newFakeMpv(t *testing.T) (*fakeMpv, string) {
+	t.Helper()
+	// unix socket paths are limited to ~100 bytes, so avoid the long paths of t.TempDir
+	dir, err := os.MkdirTemp("", "mpv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "mpv.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeMpv{
+		properties: map[string]any{
+			"time-pos":         12.5,
+			"pause":            false,
+			"paused-for-cache": false,
+		},
+		listener: l,
+	}
+	go f.serve()
+	return f, path
+}
+
+func (f *fakeMpv) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeMpv) handle(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req mpvRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return
+		}
+
+		f.lock.Lock()
+		f.commands = append(f.commands, req.Command)
+		resp := map[string]any{"request_id": req.RequestId, "error": "success"}
+		var event map[string]any
+		switch req.Command[0] {
+		case "get_property":
+			if v, ok := f.properties[req.Command[1].(string)]; ok {
+				resp["data"] = v
+			} else {
+				resp["error"] = "property unavailable"
+			}
+		case "set_property":
+			name := req.Command[1].(string)
+			f.properties[name] = req.Command[2]
+			event = map[string]any{"event": "property-change", "name": name, "data": req.Command[2]}
+		case "seek":
+			f.properties["time-pos"] = req.Command[1]
+			event = map[string]any{"event": "seek"}
+		default:
+			resp["error"] = "invalid parameter"
+		}
+		f.lock.Unlock()
+
+		// mpv interleaves events with responses, they must not be taken as responses
+		if event != nil {
+			enc.Encode(event)
+		}
+		enc.Encode(resp)
+	}
+}
+
+func (f *fakeMpv) set(name string, v any) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if v == nil {
+		delete(f.properties, name)
+	} else {
+		f.properties[name] = v
+	}
+}
+
+func (f *fakeMpv) get(name string) any {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.properties[name]
+}
+
+func dialFakeMpv(t *testing.T) (*fakeMpv, *Mpv, context.Context) {
+	t.Helper()
+	f, path := newFakeMpv(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	m, err := DialMpv(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return f, m, ctx
+}
+
+func TestMpvStatus(t *testing.T) {
+	f, m, ctx := dialFakeMpv(t)
+
+	tests := []struct {
+		name           string
+		timePos        float64
+		pause, caching bool
+		want           grog.ClientStatusMessage
+	}{
+		{"playing", 12.5, false, false, grog.ClientStatusMessage{Offset: 12, PlayerState: grog.PLAYING_STATUS}},
+		{"paused", 30, true, false, grog.ClientStatusMessage{Offset: 30, PlayerState: grog.PAUSED_STATUS}},
+		{"caching", 31, false, true, grog.ClientStatusMessage{Offset: 31, PlayerState: grog.LOADING_STATUS}},
+		{"negative", -0.2, false, false, grog.ClientStatusMessage{Offset: 0, PlayerState: grog.PLAYING_STATUS}},
+		{"clamped", 70000, false, false, grog.ClientStatusMessage{Offset: 65535, PlayerState: grog.PLAYING_STATUS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.set("time-pos", tt.timePos)
+			f.set("pause", tt.pause)
+			f.set("paused-for-cache", tt.caching)
+
+			got, err := m.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Status() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMpvNoMedia(t *testing.T) {
+	f, m, ctx := dialFakeMpv(t)
+	f.set("time-pos", nil)
+
+	if _, err := m.Status(ctx); !errors.Is(err, ErrNoMedia) {
+		t.Errorf("Status() error = %v, want %v", err, ErrNoMedia)
+	}
+}
+
+func TestMpvPauseRoundTrip(t *testing.T) {
+	f, m, ctx := dialFakeMpv(t)
+
+	if err := m.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.get("pause"); got != true {
+		t.Errorf("pause after Pause = %v, want true", got)
+	}
+	if status, err := m.Status(ctx); err != nil {
+		t.Fatal(err)
+	} else if status.PlayerState != grog.PAUSED_STATUS {
+		t.Errorf("state after Pause = %v, want %v", status.PlayerState, grog.PAUSED_STATUS)
+	}
+
+	if err := m.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.get("pause"); got != false {
+		t.Errorf("pause after Play = %v, want false", got)
+	}
+	if status, err := m.Status(ctx); err != nil {
+		t.Fatal(err)
+	} else if status.PlayerState != grog.PLAYING_STATUS {
+		t.Errorf("state after Play = %v, want %v", status.PlayerState, grog.PLAYING_STATUS)
+	}
+}
+
+func TestMpvSeekRoundTrip(t *testing.T) {
+	f, m, ctx := dialFakeMpv(t)
+
+	if err := m.Seek(ctx, 95); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	last := f.commands[len(f.commands)-1]
+	f.lock.Unlock()
+	if len(last) != 3 || last[0] != "seek" || last[1] != 95.0 || last[2] != "absolute" {
+		t.Errorf("seek command = %v, want [seek 95 absolute]", last)
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != 95 {
+		t.Errorf("offset after Seek = %d, want 95", status.Offset)
+	}
+}
+
+func TestMpvClosed(t *testing.T) {
+	f, m, ctx := dialFakeMpv(t)
+	f.listener.Close()
+	m.conn.(*net.UnixConn).CloseRead()
+
+	// the reader notices the closed connection, after which commands fail
+	for range 100 {
+		if err := m.Pause(ctx); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("commands still succeed after the connection closed")
+}
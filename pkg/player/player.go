@@ -0,0 +1,226 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/client"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+var ErrNoMedia error = errors.New("player has no media loaded")
+
+// A media player that can be synchronized with a room
+type Player interface {
+	// Current offset and state of the player
+	Status(ctx context.Context) (grog.ClientStatusMessage, error)
+	Play(ctx context.Context) error
+	Pause(ctx context.Context) error
+	// Seek to an offset in seconds
+	Seek(ctx context.Context, offset uint16) error
+	Close() error
+}
+
+// Synchronizes a Player with the members of a room.
+//
+// The local player's status is reported to the room, and the player follows a leader:
+// either the member named Leader or the member with the lowest id.
+// Members are identified by name, so names should be unique within a room.
+type Bridge struct {
+	Player Player
+	// name of the member to follow, defaults to the member with the lowest id
+	Leader string
+	// maximum difference in seconds from the leader before seeking
+	Tolerance uint16
+	// how often the player is polled
+	Interval time.Duration
+	Logger   *slog.Logger
+
+	name     string
+	lock     sync.Mutex
+	members  map[uint16]string
+	statuses map[uint16]grog.ClientStatusMessage
+	received time.Time
+	// the room is paused while a member loads
+	roomPaused bool
+	// the player was playing when the room paused
+	resumePlay bool
+}
+
+// Connect to a room and synchronize the player until ctx is done or the client stops
+func (b *Bridge) Run(ctx context.Context, cfg client.Config) error {
+	if b.Interval == 0 {
+		b.Interval = 1 * time.Second
+	}
+	if b.Tolerance == 0 {
+		b.Tolerance = 2
+	}
+	if b.Logger == nil {
+		b.Logger = cfg.Logger
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = b.Logger
+	}
+	b.name = cfg.Name
+	b.members = make(map[uint16]string)
+	b.statuses = make(map[uint16]grog.ClientStatusMessage)
+
+	c, err := client.Dial(ctx, cfg, client.Handler{
+		OnAnnounce: b.onAnnounce,
+		OnStatus:   b.onStatus,
+		OnPause:    b.onPause,
+		OnError: func(msg string) {
+			b.Logger.Error("Recieved error from server", slog.String("err", msg))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.Done():
+			return c.Err()
+		case <-ticker.C:
+		}
+
+		status, err := b.Player.Status(ctx)
+		if errors.Is(err, ErrNoMedia) {
+			status = grog.ClientStatusMessage{PlayerState: grog.UNKNOWN_STATUS}
+		} else if err != nil {
+			return err
+		}
+		if err := c.SendStatus(status.Offset, status.PlayerState); err != nil {
+			b.Logger.Debug("Unable to send status", slog.String("err", err.Error()))
+		}
+
+		if paused, err := b.holdPause(ctx, status); err != nil {
+			b.Logger.Warn("Unable to follow room pause", slog.String("err", err.Error()))
+		} else if paused {
+			continue
+		}
+		if err := b.follow(ctx, status); err != nil {
+			b.Logger.Warn("Unable to follow leader", slog.String("err", err.Error()))
+		}
+	}
+}
+
+func (b *Bridge) onAnnounce(msg grog.ServerAnnounceMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	clear(b.members)
+	for _, c := range msg.Clients {
+		b.members[c.Id] = c.Name
+	}
+	for id := range b.statuses {
+		if _, ok := b.members[id]; !ok {
+			delete(b.statuses, id)
+		}
+	}
+}
+
+func (b *Bridge) onStatus(msg grog.ServerStatusMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, status := range msg.Statuses {
+		if _, ok := b.members[status.Id]; ok {
+			b.statuses[status.Id] = status
+		}
+	}
+	b.received = time.Now()
+}
+
+func (b *Bridge) onPause(msg grog.PauseMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.roomPaused = msg.Paused
+}
+
+// Pause the player while the room waits on a loading member and resume it afterwards.
+// Returns true while the room is paused.
+func (b *Bridge) holdPause(ctx context.Context, local grog.ClientStatusMessage) (bool, error) {
+	b.lock.Lock()
+	paused := b.roomPaused
+	b.lock.Unlock()
+
+	if paused && local.PlayerState == grog.PLAYING_STATUS {
+		b.Logger.Info("Pausing while a member loads")
+		b.resumePlay = true
+		return true, b.Player.Pause(ctx)
+	} else if !paused && b.resumePlay {
+		b.Logger.Info("Resuming after members loaded")
+		b.resumePlay = false
+		return false, b.Player.Play(ctx)
+	}
+	return paused, nil
+}
+
+// Status of the member to follow, false when the bridge is the leader or the leader is unknown
+func (b *Bridge) leader() (grog.ClientStatusMessage, time.Time, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ids := make([]uint16, 0, len(b.members))
+	for id, name := range b.members {
+		if b.Leader == "" || name == b.Leader {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return grog.ClientStatusMessage{}, b.received, false
+	}
+
+	id := slices.Min(ids)
+	status, ok := b.statuses[id]
+	if !ok || b.members[id] == b.name {
+		return status, b.received, false
+	}
+	return status, b.received, true
+}
+
+// Match the player's state and offset to the leader
+func (b *Bridge) follow(ctx context.Context, local grog.ClientStatusMessage) error {
+	leader, received, ok := b.leader()
+	if !ok || local.PlayerState == grog.UNKNOWN_STATUS {
+		return nil
+	}
+
+	switch {
+	case leader.PlayerState == grog.PLAYING_STATUS && local.PlayerState == grog.PAUSED_STATUS:
+		b.Logger.Info("Resuming to match leader")
+		if err := b.Player.Play(ctx); err != nil {
+			return err
+		}
+	case leader.PlayerState == grog.PAUSED_STATUS && local.PlayerState == grog.PLAYING_STATUS:
+		b.Logger.Info("Pausing to match leader")
+		if err := b.Player.Pause(ctx); err != nil {
+			return err
+		}
+	}
+
+	// estimate where a playing leader is now
+	target := int(leader.Offset)
+	if leader.PlayerState == grog.PLAYING_STATUS {
+		target += int(time.Since(received).Seconds())
+	}
+	if diff := target - int(local.Offset); diff > int(b.Tolerance) || -diff > int(b.Tolerance) {
+		b.Logger.Info("Seeking to match leader",
+			slog.Int("offset", int(local.Offset)),
+			slog.Int("target", target),
+		)
+		return b.Player.Seek(ctx, uint16(min(max(target, 0), 65535)))
+	}
+
+	return nil
+}
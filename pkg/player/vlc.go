@@ -0,0 +1,121 @@
+package player
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// Subset of VLC's status.json
+type vlcStatus struct {
+	State string `json:"state"`
+	Time  int    `json:"time"`
+}
+
+// A VLC instance controlled over its HTTP interface (--extraintf http)
+type Vlc struct {
+	statusUrl string
+	password  string
+	client    *http.Client
+}
+
+// Control the VLC HTTP interface at addr (host:port) using its lua password
+func NewVlc(addr string, password string) *Vlc {
+	u := url.URL{Scheme: "http", Host: addr, Path: "/requests/status.json"}
+	return &Vlc{
+		statusUrl: u.String(),
+		password:  password,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Request status.json, optionally running a command
+func (v *Vlc) request(ctx context.Context, query url.Values) (vlcStatus, error) {
+	var status vlcStatus
+
+	u := v.statusUrl
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return status, err
+	}
+	// VLC ignores the username
+	req.SetBasicAuth("", v.password)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("vlc responded with %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+func (v *Vlc) Status(ctx context.Context) (grog.ClientStatusMessage, error) {
+	status, err := v.request(ctx, nil)
+	if err != nil {
+		return grog.ClientStatusMessage{}, err
+	}
+
+	msg := grog.ClientStatusMessage{Offset: uint16(min(max(status.Time, 0), 65535))}
+	switch status.State {
+	case "playing":
+		msg.PlayerState = grog.PLAYING_STATUS
+	case "paused":
+		msg.PlayerState = grog.PAUSED_STATUS
+	case "opening", "buffering":
+		msg.PlayerState = grog.LOADING_STATUS
+	case "stopped":
+		return msg, ErrNoMedia
+	default:
+		msg.PlayerState = grog.UNKNOWN_STATUS
+	}
+
+	return msg, nil
+}
+
+// pl_pause toggles playback, so only send it when the state differs
+func (v *Vlc) togglePauseFrom(ctx context.Context, state string) error {
+	status, err := v.request(ctx, nil)
+	if err != nil {
+		return err
+	} else if status.State != state {
+		return nil
+	}
+
+	_, err = v.request(ctx, url.Values{"command": {"pl_pause"}})
+	return err
+}
+
+func (v *Vlc) Play(ctx context.Context) error {
+	return v.togglePauseFrom(ctx, "paused")
+}
+
+func (v *Vlc) Pause(ctx context.Context) error {
+	return v.togglePauseFrom(ctx, "playing")
+}
+
+func (v *Vlc) Seek(ctx context.Context, offset uint16) error {
+	_, err := v.request(ctx, url.Values{
+		"command": {"seek"},
+		"val":     {strconv.Itoa(int(offset))},
+	})
+	return err
+}
+
+func (v *Vlc) Close() error {
+	v.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,161 @@
+package player
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// A fake VLC HTTP interface serving status.json and running its commands
+type fakeVlc struct {
+	lock     sync.Mutex
+	status   vlcStatus
+	commands []string
+}
+
+func (f *fakeVlc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/requests/status.json" {
+		http.NotFound(w, r)
+		return
+	}
+	if _, password, ok := r.BasicAuth(); !ok || password != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="VLC stream"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch cmd := r.URL.Query().Get("command"); cmd {
+	case "":
+	case "pl_pause":
+		f.commands = append(f.commands, cmd)
+		if f.status.State == "playing" {
+			f.status.State = "paused"
+		} else if f.status.State == "paused" {
+			f.status.State = "playing"
+		}
+	case "seek":
+		val := r.URL.Query().Get("val")
+		f.commands = append(f.commands, cmd+" "+val)
+		f.status.Time, _ = strconv.Atoi(val)
+	default:
+		http.Error(w, "unknown command", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(f.status)
+}
+
+func (f *fakeVlc) set(state string, time int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status = vlcStatus{State: state, Time: time}
+}
+
+func (f *fakeVlc) sent() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func newFakeVlc(t *testing.T, password string) (*fakeVlc, *Vlc, context.Context) {
+	t.Helper()
+	f := &fakeVlc{status: vlcStatus{State: "playing", Time: 10}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	v := NewVlc(strings.TrimPrefix(srv.URL, "http://"), password)
+	t.Cleanup(func() { v.Close() })
+	return f, v, ctx
+}
+
+func TestVlcStatus(t *testing.T) {
+	f, v, ctx := newFakeVlc(t, "secret")
+
+	tests := []struct {
+		state string
+		time  int
+		want  grog.ClientStatusMessage
+		err   error
+	}{
+		{"playing", 10, grog.ClientStatusMessage{Offset: 10, PlayerState: grog.PLAYING_STATUS}, nil},
+		{"paused", 20, grog.ClientStatusMessage{Offset: 20, PlayerState: grog.PAUSED_STATUS}, nil},
+		{"opening", 0, grog.ClientStatusMessage{Offset: 0, PlayerState: grog.LOADING_STATUS}, nil},
+		{"buffering", 5, grog.ClientStatusMessage{Offset: 5, PlayerState: grog.LOADING_STATUS}, nil},
+		{"stopped", 0, grog.ClientStatusMessage{}, ErrNoMedia},
+		{"something", 70000, grog.ClientStatusMessage{Offset: 65535, PlayerState: grog.UNKNOWN_STATUS}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			f.set(tt.state, tt.time)
+			got, err := v.Status(ctx)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Status() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("Status() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVlcAuth(t *testing.T) {
+	f, v, ctx := newFakeVlc(t, "wrong")
+
+	if _, err := v.Status(ctx); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Status() with wrong password error = %v, want 401", err)
+	}
+	if err := v.Seek(ctx, 5); err == nil {
+		t.Error("Seek() with wrong password succeeded")
+	}
+	if cmds := f.sent(); len(cmds) != 0 {
+		t.Errorf("commands ran without auth: %v", cmds)
+	}
+}
+
+func TestVlcCommands(t *testing.T) {
+	f, v, ctx := newFakeVlc(t, "secret")
+
+	// pl_pause toggles, so it is only sent when the state must change
+	f.set("playing", 10)
+	if err := v.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Seek(ctx, 95); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"pl_pause", "seek 95", "pl_pause"}
+	if got := f.sent(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+
+	got, err := v.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grog.ClientStatusMessage{Offset: 95, PlayerState: grog.PLAYING_STATUS}); got != want {
+		t.Errorf("Status() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+var ErrInvalidACL error = errors.New("invalid room acl")
+
+// Parse a room acl of the form room=user,@group,...
+//
+// Users and groups may be given by name or numeric id, groups are prefixed with '@'.
+func ParseRoomACL(spec string) (string, grog.ACL, error) {
+	acl := grog.ACL{}
+
+	name, entries, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || entries == "" {
+		return "", acl, ErrInvalidACL
+	}
+
+	for _, entry := range strings.Split(entries, ",") {
+		if group, isGroup := strings.CutPrefix(entry, "@"); isGroup {
+			gid, err := lookupGroup(group)
+			if err != nil {
+				return "", acl, err
+			}
+			acl.Groups = append(acl.Groups, gid)
+		} else {
+			uid, err := lookupUser(entry)
+			if err != nil {
+				return "", acl, err
+			}
+			acl.Users = append(acl.Users, uid)
+		}
+	}
+
+	return name, acl, nil
+}
+
+func lookupUser(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidACL, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidACL, err)
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
+
+// Supplementary groups of a user, ignoring lookup failures
+func userGroups(uid uint32) []uint32 {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+
+	groups := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(gid))
+		}
+	}
+	return groups
+}
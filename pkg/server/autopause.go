@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+var ErrInvalidAutoPause error = errors.New("invalid room auto pause")
+
+// Parse a room's auto pause policy of the form room=threshold[,stalls=N][,wait=DURATION]
+//
+// Members stop pausing the room after 3 stalls, or when the room waits on them for 30 seconds.
+// 0 removes either limit.
+func ParseRoomAutoPause(spec string) (string, grog.AutoPause, error) {
+	policy := grog.AutoPause{MaxStalls: 3, MaxWait: 30 * time.Second}
+
+	name, options, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || options == "" {
+		return "", policy, ErrInvalidAutoPause
+	}
+
+	parts := strings.Split(options, ",")
+	threshold, err := time.ParseDuration(parts[0])
+	if err != nil || threshold <= 0 {
+		return "", policy, fmt.Errorf("%w: invalid threshold %q", ErrInvalidAutoPause, parts[0])
+	}
+	policy.Threshold = threshold
+
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "stalls":
+			stalls, err := strconv.Atoi(value)
+			if err != nil || stalls < 0 {
+				return "", policy, fmt.Errorf("%w: invalid stalls %q", ErrInvalidAutoPause, value)
+			}
+			policy.MaxStalls = stalls
+		case "wait":
+			wait, err := time.ParseDuration(value)
+			if err != nil || wait < 0 {
+				return "", policy, fmt.Errorf("%w: invalid wait %q", ErrInvalidAutoPause, value)
+			}
+			policy.MaxWait = wait
+		default:
+			return "", policy, fmt.Errorf("%w: unknown option %q", ErrInvalidAutoPause, key)
+		}
+	}
+
+	return name, policy, nil
+}
@@ -1,12 +1,12 @@
 package server
 
 import (
-	"encoding/binary"
 	"errors"
 	"log/slog"
+	"strconv"
+	"time"
 
 	"github.com/jpappel/grog_barrel/pkg/grog"
-	"github.com/jpappel/grog_barrel/pkg/util"
 )
 
 type Driver interface {
@@ -17,13 +17,21 @@ type Driver interface {
 var ErrIncompatibleVersion error = errors.New("incompatible version")
 var ErrInvalidClientName error = errors.New("invalid client name")
 var ErrInvalidRoomName error = errors.New("invalid room name")
+var ErrInvalidClientAnnounce error = errors.New("invalid clientAnnounce")
+var ErrInvalidClientStatus error = errors.New("invalid clientStatus")
+var ErrSpectatorStatus error = errors.New("spectators cannot send statuses")
+var ErrInvalidClientMessage error = errors.New("invalid client message")
 
 func parseClient(message []byte, addr string, logger *slog.Logger) (grog.Client, error) {
 	client := grog.Client{Addr: addr}
 
-	client.Version = util.SemVer{Major: message[0], Minor: message[1], Patch: message[2]}
+	announce, err := grog.ParseClientAnnounce(message)
+	if err != nil {
+		return client, ErrInvalidClientAnnounce
+	}
+	client.Version = announce.Version
     logger.Debug("clientversion", slog.String("clientVersion", client.Version.String()))
-	if !ServerVersion.Compatible(client.Version) {
+	if !ServerVersion.Compatible(client.Version) && !legacyVersion.Compatible(client.Version) {
 		logger.Info("Incompatible client version",
 			slog.String("remote", client.Addr),
 			slog.String("serverVersion", ServerVersion.String()),
@@ -33,7 +41,7 @@ func parseClient(message []byte, addr string, logger *slog.Logger) (grog.Client,
 		return client, ErrIncompatibleVersion
 	}
 
-	client.Name = string(message[3:])
+	client.Name = announce.Name
 	// NOTE: len of a string is byte length
 	if len(client.Name) == 0 || len(client.Name) > 255 {
 		return client, ErrInvalidClientName
@@ -42,10 +50,67 @@ func parseClient(message []byte, addr string, logger *slog.Logger) (grog.Client,
 	return client, nil
 }
 
-func parseStatusMessage(p []byte, id byte) grog.ClientStatusMessage {
-	return grog.ClientStatusMessage{
-		Offset:      binary.BigEndian.Uint16(p[:2]),
-		PlayerState: grog.PlayerState(p[2]),
-		Id:          id,
+// Parse an update interval requested in milliseconds, 0 when s is empty or invalid
+func parseInterval(s string) time.Duration {
+	ms, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func parseStatusMessage(p []byte, id uint16) (grog.ClientStatusMessage, error) {
+	if len(p) != 3 {
+		return grog.ClientStatusMessage{}, ErrInvalidClientStatus
+	}
+	return grog.ParseClientStatus(p, id)
+}
+
+// Parse a clientStatus in the client's protocol, since v2.5 they acknowledge a status sequence
+func parseClientStatus(p []byte, client grog.Client, id uint16) (grog.ClientStatusAckMessage, error) {
+	if !client.Version.AtLeast(deltaVersion) {
+		msg, err := parseStatusMessage(p, id)
+		return grog.ClientStatusAckMessage{ClientStatusMessage: msg}, err
+	} else if len(p) != 7 {
+		return grog.ClientStatusAckMessage{}, ErrInvalidClientStatus
+	}
+	return grog.ParseClientStatusAck(p, id)
+}
+
+// Parse a message sent by a member,
+// a grog.ClientStatusAckMessage, grog.ClientQueueMessage, grog.ClientReadyMessage or nil for a heartbeat.
+// Clients since v2.2 prefix their messages with the message type.
+func parseClientMessage(p []byte, client grog.Client, id uint16) (any, error) {
+	if !client.Version.AtLeast(queueVersion) {
+		return parseClientStatus(p, client, id)
+	} else if len(p) == 0 {
+		return nil, ErrInvalidClientMessage
+	}
+
+	switch grog.MessageType(p[0]) {
+	case grog.EMPTY_MSG:
+		if !client.Version.AtLeast(heartbeatVersion) || len(p) != 1 {
+			return nil, ErrInvalidClientMessage
+		}
+		return nil, nil
+	case grog.STATUS_MSG:
+		return parseClientStatus(p[1:], client, id)
+	case grog.QUEUE_MSG:
+		msg, err := grog.ParseClientQueue(p[1:])
+		if err != nil {
+			return nil, ErrInvalidClientMessage
+		}
+		return msg, nil
+	case grog.READY_MSG:
+		if !client.Version.AtLeast(readyVersion) {
+			return nil, ErrInvalidClientMessage
+		}
+		msg, err := grog.ParseClientReady(p[1:])
+		if err != nil {
+			return nil, ErrInvalidClientMessage
+		}
+		return msg, nil
+	default:
+		return nil, ErrInvalidClientMessage
 	}
 }
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+var ErrInvalidHeartbeat error = errors.New("invalid heartbeat")
+
+// Silence before a connection is dropped in rooms without heartbeats
+const IDLE_TIMEOUT = 15 * time.Minute
+
+// Silence before a connection is dropped, the room's eviction window when it has heartbeats
+func readTimeout(room *grog.Room) time.Duration {
+	if room.Heartbeat.Enabled() {
+		return room.Heartbeat.EvictAfter
+	}
+	return IDLE_TIMEOUT
+}
+
+// Parse a heartbeat policy of the form interval[,stale=DURATION][,evict=DURATION], 0 disables heartbeats.
+// Members are stale after two silent intervals and evicted after four unless set.
+func ParseHeartbeat(spec string) (grog.Heartbeat, error) {
+	var policy grog.Heartbeat
+
+	parts := strings.Split(spec, ",")
+	interval, err := time.ParseDuration(parts[0])
+	if err != nil || interval < 0 {
+		return policy, fmt.Errorf("%w: invalid interval %q", ErrInvalidHeartbeat, parts[0])
+	} else if interval == 0 {
+		if len(parts) > 1 {
+			return policy, fmt.Errorf("%w: disabled heartbeats take no options", ErrInvalidHeartbeat)
+		}
+		return policy, nil
+	}
+	policy = grog.Heartbeat{Interval: interval, StaleAfter: 2 * interval, EvictAfter: 4 * interval}
+
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return policy, fmt.Errorf("%w: invalid %s duration %q", ErrInvalidHeartbeat, key, value)
+		}
+		switch key {
+		case "stale":
+			policy.StaleAfter = d
+		case "evict":
+			policy.EvictAfter = d
+		default:
+			return policy, fmt.Errorf("%w: unknown option %q", ErrInvalidHeartbeat, key)
+		}
+	}
+	if policy.StaleAfter < interval || policy.EvictAfter <= policy.StaleAfter {
+		return policy, fmt.Errorf("%w: stale must be at least the interval and evict longer than stale", ErrInvalidHeartbeat)
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// Check if token is the token permitted to moderate every room
+func (m *RoomManager) isModerator(token string) bool {
+	return m.ModeratorToken != "" &&
+		subtle.ConstantTimeCompare([]byte(m.ModeratorToken), []byte(token)) == 1
+}
+
+// Get the room of a moderation request, writing an error response unless it
+// is authorized by the moderator token or the resume token of the room's host
+func moderatedRoom(w http.ResponseWriter, r *http.Request, logger *slog.Logger) (*grog.Room, bool) {
+	room, ok := Rooms.Lookup(r.PathValue("roomName"))
+	if !ok {
+		http.Error(w, "Unknown room", http.StatusNotFound)
+		return nil, false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing moderator token", http.StatusUnauthorized)
+		return nil, false
+	} else if !Rooms.isModerator(token) && !room.IsHost(token) {
+		logger.Warn("Unauthorized moderation request",
+			slog.String("roomName", room.Name),
+			slog.String("addr", r.RemoteAddr),
+		)
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return nil, false
+	}
+
+	return room, true
+}
+
+// Parse the id of the member a moderation request applies to
+func memberId(w http.ResponseWriter, r *http.Request) (uint16, bool) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 16)
+	if err != nil {
+		http.Error(w, "Invalid member id", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint16(id), true
+}
+
+// Parse a ban from the name, ip, uid and persistent parameters
+func parseBan(w http.ResponseWriter, r *http.Request) (grog.Ban, bool) {
+	ban := grog.Ban{
+		Name:       r.FormValue("name"),
+		Persistent: r.Form.Has("persistent"),
+	}
+	if s := r.FormValue("ip"); s != "" {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			http.Error(w, "Invalid ip", http.StatusBadRequest)
+			return ban, false
+		}
+		ban.IP = ip.String()
+	}
+	if s := r.FormValue("uid"); s != "" {
+		uid, err := lookupUser(s)
+		if err != nil {
+			http.Error(w, "Unknown user", http.StatusBadRequest)
+			return ban, false
+		}
+		ban.Uid = &uid
+	}
+
+	if ban.Empty() {
+		http.Error(w, "A ban needs a name, ip or uid", http.StatusBadRequest)
+		return ban, false
+	}
+	return ban, true
+}
+
+// Disconnect a member with an optional reason
+func kickHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := moderatedRoom(w, r, logger)
+		if !ok {
+			return
+		}
+		id, ok := memberId(w, r)
+		if !ok {
+			return
+		}
+
+		if err := room.Kick(id, r.FormValue("reason")); err == grog.ErrNotMember {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Ignore a member's statuses with POST, stop ignoring them with DELETE
+func muteHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := moderatedRoom(w, r, logger)
+		if !ok {
+			return
+		}
+		id, ok := memberId(w, r)
+		if !ok {
+			return
+		}
+
+		if err := room.Mute(id, r.Method == http.MethodPost); err == grog.ErrNotMember {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logger.Info("Member mute changed",
+			slog.String("roomName", room.Name),
+			slog.Int("id", int(id)),
+			slog.Bool("muted", r.Method == http.MethodPost),
+		)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Ban clients with POST, lift a ban with DELETE
+func banHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := moderatedRoom(w, r, logger)
+		if !ok {
+			return
+		}
+		ban, ok := parseBan(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			room.Ban(ban)
+		} else if !room.Unban(ban) {
+			http.Error(w, "Unknown ban", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
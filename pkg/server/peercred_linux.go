@@ -0,0 +1,36 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// Read the credentials of the process on the other end of conn
+func peerCred(conn *net.UnixConn) (*grog.PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	} else if credErr != nil {
+		return nil, credErr
+	}
+
+	return &grog.PeerCred{
+		Pid:    ucred.Pid,
+		Uid:    ucred.Uid,
+		Gid:    ucred.Gid,
+		Groups: userGroups(ucred.Uid),
+	}, nil
+}
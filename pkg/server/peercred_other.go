@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+func peerCred(conn *net.UnixConn) (*grog.PeerCred, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpappel/grog_barrel/pkg/grog"
+	"github.com/jpappel/grog_barrel/pkg/util"
+)
+
+var ErrServerShutdown error = errors.New("Server shutting down")
+
+// last version of the v1 protocol, its clients are still served v1 messages
+var legacyVersion = util.SemVer{Major: 1, Minor: 7, Patch: 0}
+
+// first version to recieve resume messages
+var resumeVersion = util.SemVer{Major: 1, Minor: 6, Patch: 0}
+
+// first version to recieve the number of spectators in announcements
+var spectatorVersion = util.SemVer{Major: 1, Minor: 7, Patch: 0}
+
+// first version to recieve the muted members in announcements
+var mutedVersion = util.SemVer{Major: 2, Minor: 1, Patch: 0}
+
+// first version to share the room's queue, its clients send typed messages
+var queueVersion = util.SemVer{Major: 2, Minor: 2, Patch: 0}
+
+// first version to take part in ready checks
+var readyVersion = grog.ReadyVersion
+
+// first version to be paused while a member is loading
+var pauseVersion = util.SemVer{Major: 2, Minor: 4, Patch: 0}
+
+// first version to recieve status deltas, its clientStatuses acknowledge them
+var deltaVersion = util.SemVer{Major: 2, Minor: 5, Patch: 0}
+
+// first version to send heartbeats and recieve the stale members in announcements
+var heartbeatVersion = util.SemVer{Major: 2, Minor: 6, Patch: 0}
+
+// Creates, persists and closes the rooms shared by every transport
+type RoomManager struct {
+	rooms     map[string]*grog.Room
+	acls      map[string]grog.ACL
+	pauses    map[string]grog.AutoPause
+	ticks     map[string]grog.TickRate
+	recordDir string
+	closing   bool
+	lock      sync.Mutex
+	// optional, persists rooms so they can be restored after a restart
+	Store SnapshotStore
+	// optional, shares rooms with other instances. Set before any room is created.
+	Backend grog.Backend
+	// optional, recieves the events of rooms created after it is set
+	Webhooks *Webhooks
+	// optional, permits moderating every room. Hosts can always moderate their room.
+	ModeratorToken string
+	// tick rate of rooms without one set by SetTickRate
+	DefaultTickRate grog.TickRate
+	// heartbeat policy of rooms created after it is set
+	Heartbeat grog.Heartbeat
+}
+
+var Rooms = NewRoomManager()
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms:     make(map[string]*grog.Room),
+		acls:      make(map[string]grog.ACL),
+		pauses:    make(map[string]grog.AutoPause),
+		ticks:     make(map[string]grog.TickRate),
+		Heartbeat: grog.DefaultHeartbeat,
+	}
+}
+
+// Record every room created after the call to a file in dir
+func (m *RoomManager) SetRecordDir(dir string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.recordDir = dir
+}
+
+// Restrict a room to the users and groups in acl.
+// Only applies to rooms created after the call.
+func (m *RoomManager) SetACL(name string, acl grog.ACL) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.acls[name] = acl
+}
+
+// Pause a room while a member is loading according to policy.
+// Only applies to rooms created after the call.
+func (m *RoomManager) SetAutoPause(name string, policy grog.AutoPause) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pauses[name] = policy
+}
+
+// Rebuild a room's status at rate instead of DefaultTickRate.
+// Only applies to rooms created after the call.
+func (m *RoomManager) SetTickRate(name string, rate grog.TickRate) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ticks[name] = rate
+}
+
+// Add an existing room, replacing any room with the same name
+func (m *RoomManager) Register(room *grog.Room) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rooms[room.Name] = room
+}
+
+// Create a recorder for a room in recordDir
+func (m *RoomManager) newRecorder(name string) (*grog.Recorder, error) {
+	filename := fmt.Sprintf("%s-%s.grogrec",
+		url.PathEscape(name), time.Now().Format("20060102T150405"))
+	f, err := os.OpenFile(filepath.Join(m.recordDir, filename),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return grog.NewRecorder(f, name)
+}
+
+// Create a room with the configured ACL, auto pause, tick rate, heartbeat and recorder, must hold the lock
+func (m *RoomManager) newRoom(name string, logger *slog.Logger) *grog.Room {
+	room := grog.NewRoom(name, logger)
+	room.ACL = m.acls[name]
+	room.AutoPause = m.pauses[name]
+	room.TickRate = m.DefaultTickRate
+	if rate, ok := m.ticks[name]; ok {
+		room.TickRate = rate
+	}
+	room.Heartbeat = m.Heartbeat
+	if m.Backend != nil {
+		room.Backend = m.Backend
+	}
+	if m.Webhooks != nil {
+		m.Webhooks.Watch(room)
+	}
+	if m.recordDir != "" {
+		recorder, err := m.newRecorder(name)
+		if err != nil {
+			logger.Error("Unable to record room",
+				slog.String("roomName", name),
+				slog.String("err", err.Error()),
+			)
+		}
+		room.Recorder = recorder
+	}
+	m.rooms[name] = room
+
+	return room
+}
+
+// Get a room by name, creating it if it does not exist.
+// Fails with ErrServerShutdown once Shutdown has been called.
+func (m *RoomManager) Get(name string, logger *slog.Logger) (*grog.Room, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closing {
+		return nil, ErrServerShutdown
+	}
+
+	room, ok := m.rooms[name]
+	if !ok {
+		room = m.newRoom(name, logger)
+	}
+
+	return room, nil
+}
+
+// Get a room by name without creating it
+func (m *RoomManager) Lookup(name string) (*grog.Room, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	room, ok := m.rooms[name]
+	return room, ok
+}
+
+// Save every room that has members, held ids, persistent bans or a queue to the store
+func (m *RoomManager) Save() error {
+	if m.Store == nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	snapshots := make([]grog.RoomSnapshot, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		snapshot := room.Snapshot()
+		if len(snapshot.Members) > 0 || !snapshot.ACL.Empty() || len(snapshot.Bans) > 0 || len(snapshot.Queue) > 0 {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	m.lock.Unlock()
+
+	return m.Store.Save(snapshots)
+}
+
+// Recreate the rooms in the store, holding their members' ids for them to resume.
+// ACLs set with SetACL take precedence over stored ones.
+func (m *RoomManager) Restore(logger *slog.Logger) error {
+	if m.Store == nil {
+		return nil
+	}
+	snapshots, err := m.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, snapshot := range snapshots {
+		room, ok := m.rooms[snapshot.Name]
+		if !ok {
+			room = m.newRoom(snapshot.Name, logger)
+		}
+		if _, ok := m.acls[snapshot.Name]; !ok {
+			room.ACL = snapshot.ACL
+		}
+		room.Restore(snapshot)
+		logger.Info("Restored room",
+			slog.String("roomName", snapshot.Name),
+			slog.Int("members", len(snapshot.Members)),
+		)
+	}
+
+	return nil
+}
+
+// Save the rooms every interval until ctx is done
+func (m *RoomManager) RunSnapshots(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Save(); err != nil {
+				logger.Error("Failed to save room snapshot", slog.String("err", err.Error()))
+			}
+		}
+	}
+}
+
+// Stop accepting joins, close every room and wait for their members to leave.
+// The rooms are saved once their members have left.
+func (m *RoomManager) Shutdown(ctx context.Context) error {
+	m.lock.Lock()
+	m.closing = true
+	open := make([]*grog.Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		open = append(open, room)
+	}
+	m.lock.Unlock()
+
+	for _, room := range open {
+		room.Close()
+	}
+	// every recorder is closed even when a room fails to finish in time
+	var err error
+	for _, room := range open {
+		if waitErr := room.Wait(ctx); waitErr != nil && err == nil {
+			err = waitErr
+		}
+		if room.Recorder != nil {
+			if closeErr := room.Recorder.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	if saveErr := m.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Join a room, resuming the id held for token when it is still valid
+func joinRoom(room *grog.Room, client grog.Client, token string, logger *slog.Logger) (uint16, error) {
+	if token != "" {
+		id, err := room.Resume(client, token)
+		if err != grog.ErrInvalidResumeToken {
+			return id, err
+		}
+		logger.Info("Invalid resume token, joining as a new member")
+	}
+	return room.Join(client)
+}
+
+// The room's announcement in the client's protocol,
+// without the fields added after the client's version.
+func announceFrame(room *grog.Room, client grog.Client) []byte {
+	if !client.Legacy() && !client.Version.AtLeast(mutedVersion) {
+		return room.Messages.UnmutedAnnouncements()
+	} else if !client.Legacy() && !client.Version.AtLeast(heartbeatVersion) {
+		return room.Messages.UnstaleAnnouncements()
+	} else if !client.Legacy() {
+		return room.Messages.Announcements()
+	}
+	announcement := room.Messages.LegacyAnnouncements()
+	if !client.Version.AtLeast(spectatorVersion) {
+		return announcement[:len(announcement)-2]
+	}
+	return announcement
+}
+
+// A connection's position in the room's status sequence
+type deltaState struct {
+	ack      uint32 // last sequence the client acknowledged
+	implicit bool   // the client never acknowledges, sent deltas are assumed applied
+	sent     int    // deltas sent since the last keyframe
+}
+
+// The room's status in the client's protocol.
+// Clients since v2.5 are sent the statuses changed since their acknowledged sequence.
+func statusFrame(room *grog.Room, client grog.Client, delta *deltaState) []byte {
+	if client.Legacy() {
+		return room.Messages.LegacyStatus()
+	} else if !client.Version.AtLeast(deltaVersion) {
+		return room.Messages.Status()
+	}
+
+	msg := room.StatusDelta(delta.ack, delta.sent >= grog.KEYFRAME_INTERVAL)
+	if msg.Keyframe() {
+		delta.sent = 0
+	} else {
+		delta.sent++
+	}
+	if delta.implicit {
+		delta.ack = msg.Seq
+	}
+	return msg.WriteBytes([]byte{byte(grog.DELTA_MSG)})
+}
+
+// The room's status prepared once for web socket clients before v2.5
+func preparedStatus(room *grog.Room, client grog.Client) *websocket.PreparedMessage {
+	if client.Legacy() {
+		return room.Messages.PreparedLegacyStatus()
+	}
+	return room.Messages.PreparedStatus()
+}
+
+// The room's queue if the client supports it, nil otherwise.
+// lastQueue is updated to the version of the returned queue.
+func queueFrame(room *grog.Room, client grog.Client, lastQueue *int) []byte {
+	if !client.Version.AtLeast(queueVersion) {
+		return nil
+	}
+	var updates bool
+	if *lastQueue, updates = room.CheckQueue(*lastQueue); !updates {
+		return nil
+	}
+	return room.QueueFrame()
+}
+
+// The room's ready check or countdown if the client supports it, nil otherwise.
+// lastReady is updated to the version of the returned check.
+func readyFrame(room *grog.Room, client grog.Client, lastReady *int) []byte {
+	if !client.Version.AtLeast(readyVersion) {
+		return nil
+	}
+	var updates bool
+	if *lastReady, updates = room.CheckReady(*lastReady); !updates {
+		return nil
+	}
+	return room.ReadyFrame()
+}
+
+// The room's auto pause if the client supports it, nil otherwise.
+// lastPause is updated to the version of the returned pause.
+func pauseFrame(room *grog.Room, client grog.Client, lastPause *int) []byte {
+	if !client.Version.AtLeast(pauseVersion) {
+		return nil
+	}
+	var updates bool
+	if *lastPause, updates = room.CheckPause(*lastPause); !updates {
+		return nil
+	}
+	return room.PauseFrame()
+}
+
+// Versions of the room's queue, ready check and pause last sent to a connection
+type sentState struct {
+	queue int
+	ready int
+	pause int
+}
+
+// Write the room's queue, ready check and pause when they changed since they were last sent
+func writeState(room *grog.Room, client grog.Client, sent *sentState, write func([]byte) error) error {
+	frames := [...][]byte{
+		queueFrame(room, client, &sent.queue),
+		readyFrame(room, client, &sent.ready),
+		pauseFrame(room, client, &sent.pause),
+	}
+	for _, frame := range frames {
+		if frame == nil {
+			continue
+		}
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The error sent to a kicked member
+func kickMessage(reason string) string {
+	if reason == "" {
+		return grog.ErrKicked.Error()
+	}
+	return grog.ErrKicked.Error() + ": " + reason
+}
+
+// Build the resume message for a member, nil if their client predates it
+func resumeFrame(room *grog.Room, id uint16, client grog.Client) []byte {
+	if !client.Version.AtLeast(resumeVersion) {
+		return nil
+	}
+	msg := grog.ResumeMessage{Token: room.Token(id)}
+	return msg.WriteBytes([]byte{byte(grog.RESUME_MSG)})
+}
@@ -1,10 +1,10 @@
 package server
 
 import (
-	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jpappel/grog_barrel/pkg/grog"
@@ -16,9 +16,28 @@ var ServerVersion = util.ServerVersion
 var tmpl *template.Template
 var upgrader = websocket.Upgrader{}
 
-var rooms map[string]*grog.Room
+// Build an errorMessage frame
+func errorFrame(msg string) []byte {
+	buf := make([]byte, 0, 1+len(msg))
+	buf = append(buf, byte(grog.ERROR_MSG))
+	return append(buf, msg...)
+}
+
+// Check if a room has been closed
+func closed(room *grog.Room) bool {
+	select {
+	case <-room.Done():
+		return true
+	default:
+		return false
+	}
+}
 
 func home(w http.ResponseWriter, r *http.Request) {
+	if tmpl == nil {
+		http.Error(w, "Templates unavailable", http.StatusInternalServerError)
+		return
+	}
 	tmpl.Execute(w, nil)
 }
 
@@ -38,7 +57,7 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 		driver := WsDriver{c, logger}
 
 		client, err := driver.ParseClient()
-		if err == ErrIncompatibleVersion || err == ErrInvalidClientName {
+		if err == ErrIncompatibleVersion || err == ErrInvalidClientName || err == ErrInvalidClientAnnounce {
 			driver.WriteError(err.Error())
 			return
 		} else if err != nil {
@@ -55,17 +74,33 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 
 		roomName := r.PathValue("roomName")
 
-		room, ok := rooms[roomName]
-		if !ok {
-			rooms[roomName] = grog.NewRoom(roomName, logger)
-			room = rooms[roomName]
+		room, err := Rooms.Get(roomName, logger)
+		if err != nil {
+			driver.WriteError(err.Error())
+			return
 		}
 
-		id, err := room.Join(client)
-		if err == grog.ErrRoomFull {
+		spectator := r.URL.Query().Has("spectate")
+		interval := parseInterval(r.URL.Query().Get("interval"))
+		var id uint16
+		if spectator {
+			err = room.Spectate(client)
+		} else {
+			id, err = joinRoom(room, client, r.URL.Query().Get("resume"), logger)
+		}
+		if err == grog.ErrRoomClosed {
+			driver.WriteError(ErrServerShutdown.Error())
+			return
+		} else if err == grog.ErrRoomFull {
 			logger.Debug("Room is full")
 			driver.WriteError("Room is full")
 			return
+		} else if err == grog.ErrPermissionDenied {
+			driver.WriteError("Permission denied")
+			return
+		} else if err == grog.ErrBanned {
+			driver.WriteError(err.Error())
+			return
 		} else if err != nil {
 			logger.Error("Unexpected error occured while joining",
 				slog.String("roomName", roomName),
@@ -74,6 +109,16 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 			driver.WriteError("Internal Server Error")
 			return
 		}
+		if interval > 0 {
+			defer room.RequestTick(interval)()
+		}
+		if spectator {
+			defer room.LeaveSpectator()
+			logger = logger.With(slog.String("roomName", roomName))
+			logger.Info("Spectator Joined Room")
+			spectate(driver, room, client, interval, logger)
+			return
+		}
 		defer room.Leave(id)
 
 		roomInfo := slog.Group("roomInfo",
@@ -83,19 +128,70 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 		logger = logger.With(roomInfo)
 		logger.Info("User Joined Room")
 
+		if frame := resumeFrame(room, id, client); frame != nil {
+			if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				logger.Error("Error while writting resume", slog.String("error", err.Error()))
+				return
+			}
+		}
+
+		// members are pinged every heartbeat interval, their pongs are heartbeats
+		var pings <-chan time.Time
+		if room.Heartbeat.Enabled() {
+			ticker := time.NewTicker(room.Heartbeat.Interval)
+			defer ticker.Stop()
+			pings = ticker.C
+			c.SetPongHandler(func(string) error {
+				room.Seen(id)
+				return nil
+			})
+		}
+
+		left := make(chan struct{})
+		defer close(left)
+		kickReason := make(chan string, 1)
+		kicked := room.Kicked(id)
+		go func() {
+			for {
+				select {
+				case <-room.Done():
+					// unblock the pending read, the handler then notifies the client
+					c.SetReadDeadline(time.Now())
+					return
+				case reason := <-kicked:
+					kickReason <- reason
+					c.SetReadDeadline(time.Now())
+					return
+				case <-pings:
+					c.WriteControl(websocket.PingMessage, nil, time.Now().Add(1*time.Second))
+				case <-left:
+					return
+				}
+			}
+		}()
+
 		lastAnnouncement := 0
+		var sent sentState
+		var delta deltaState
+		writeBinary := func(p []byte) error { return c.WriteMessage(websocket.BinaryMessage, p) }
 		updates := false
 
 		for {
 			lastAnnouncement, updates = room.Check(lastAnnouncement)
 			if updates {
-				if err := c.WritePreparedMessage(room.Messages.PreparedAnnounce); err != nil {
+				if err := c.WriteMessage(websocket.BinaryMessage, announceFrame(room, client)); err != nil {
 					logger.Error("Error while writting announcement",
 						slog.String("error", err.Error()),
 					)
 					break
 				}
 			}
+			if err := writeState(room, client, &sent, writeBinary); err != nil {
+				logger.Error("Error while writting room state",
+					slog.String("error", err.Error()),
+				)
+				break
+			}
 
 			_, message, err := c.ReadMessage()
 			if websocket.IsCloseError(err,
@@ -103,6 +199,14 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 				websocket.CloseNormalClosure,
 				websocket.CloseNoStatusReceived) {
 				break
+			} else if err != nil && closed(room) {
+				logger.Info("Room closed, disconnecting client")
+				driver.WriteShutdown()
+				break
+			} else if err != nil && len(kickReason) > 0 {
+				logger.Info("Kicked from room, disconnecting client")
+				driver.WriteError(kickMessage(<-kickReason))
+				break
 			} else if err != nil {
 				logger.Error("Error while reading message",
 					slog.Any("error", err),
@@ -110,14 +214,38 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 				break
 			}
 
-			msg := parseStatusMessage(message, id)
+			room.Seen(id)
+
+			parsed, err := parseClientMessage(message, client, id)
+			if err != nil {
+				logger.Warn("Invalid client message", slog.Int("size", len(message)))
+				driver.WriteError(err.Error())
+				break
+			} else if parsed == nil {
+				// heartbeats have no reply
+				continue
+			}
+			if change, ok := parsed.(grog.ClientQueueMessage); ok {
+				if err := room.UpdateQueue(client, id, change); err != nil {
+					logger.Debug("Ignoring queue change", slog.String("err", err.Error()))
+				}
+				continue
+			}
+			if ready, ok := parsed.(grog.ClientReadyMessage); ok {
+				if err := room.UpdateReady(client, id, ready); err != nil {
+					logger.Debug("Ignoring ready check operation", slog.String("err", err.Error()))
+				}
+				continue
+			}
+			msg := parsed.(grog.ClientStatusAckMessage)
+			delta.ack = msg.Ack
 
 			logger.Debug("recieved message",
 				slog.String("content", msg.String()),
 			)
-			room.Update(client, msg)
+			room.Update(client, msg.ClientStatusMessage)
 
-			if err := c.WritePreparedMessage(room.Messages.PreparedStatus); err != nil {
+			if err := writeStatus(c, room, client, &delta); err != nil {
 				logger.Error("Error while writting",
 					slog.String("error", err.Error()),
 				)
@@ -129,23 +257,119 @@ func barrel(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// Write the room's status in the client's protocol, prepared once for clients before v2.5
+func writeStatus(c *websocket.Conn, room *grog.Room, client grog.Client, delta *deltaState) error {
+	if client.Version.AtLeast(deltaVersion) {
+		return c.WriteMessage(websocket.BinaryMessage, statusFrame(room, client, delta))
+	}
+	return c.WritePreparedMessage(preparedStatus(room, client))
+}
+
+// Send announcements and a status every interval to a spectator until it disconnects or the room closes
+func spectate(driver WsDriver, room *grog.Room, client grog.Client, interval time.Duration, logger *slog.Logger) {
+	c := driver.conn
+
+	// spectators are pinged like members and dropped once silent for the eviction window
+	if room.Heartbeat.Enabled() {
+		c.SetReadDeadline(time.Now().Add(room.Heartbeat.EvictAfter))
+		c.SetPongHandler(func(string) error {
+			return c.SetReadDeadline(time.Now().Add(room.Heartbeat.EvictAfter))
+		})
+		pings := time.NewTicker(room.Heartbeat.Interval)
+		defer pings.Stop()
+		left := make(chan struct{})
+		defer close(left)
+		go func() {
+			for {
+				select {
+				case <-pings.C:
+					c.WriteControl(websocket.PingMessage, nil, time.Now().Add(1*time.Second))
+				case <-left:
+					return
+				}
+			}
+		}()
+	}
+
+	// spectators never send statuses, reading only detects the connection closing
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			err = ErrSpectatorStatus
+		}
+		readErr <- err
+	}()
+
+	ticker := time.NewTicker(grog.ClampTick(interval))
+	defer ticker.Stop()
+
+	lastAnnouncement := 0
+	var sent sentState
+	delta := deltaState{implicit: true}
+	writeBinary := func(p []byte) error { return c.WriteMessage(websocket.BinaryMessage, p) }
+	updates := false
+	for {
+		lastAnnouncement, updates = room.Check(lastAnnouncement)
+		if updates {
+			if err := c.WriteMessage(websocket.BinaryMessage, announceFrame(room, client)); err != nil {
+				logger.Error("Error while writting announcement", slog.String("error", err.Error()))
+				return
+			}
+		}
+		if err := writeState(room, client, &sent, writeBinary); err != nil {
+			logger.Error("Error while writting room state", slog.String("error", err.Error()))
+			return
+		}
+		if err := writeStatus(c, room, client, &delta); err != nil {
+			logger.Error("Error while writting status", slog.String("error", err.Error()))
+			return
+		}
+
+		select {
+		case err := <-readErr:
+			if err == ErrSpectatorStatus {
+				logger.Warn("Spectator sent a clientStatus")
+				driver.WriteError(err.Error())
+			}
+			logger.Info("Closing web socket connection")
+			return
+		case <-room.Done():
+			logger.Info("Room closed, disconnecting spectator")
+			driver.WriteShutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func New(l *slog.Logger) *http.ServeMux {
+	// templates are relative to the working directory,
+	// the protocol endpoints are still served when they are missing
+	if tmpl == nil {
+		var err error
+		tmpl, err = template.ParseFiles("templates/index.html")
+		if err != nil {
+			l.Error("Unable to parse templates", slog.String("err", err.Error()))
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/barrel/{roomName}", http.HandlerFunc(barrel(l)))
+	mux.HandleFunc("POST /barrel/{roomName}/session", sseJoin(l))
+	mux.HandleFunc("DELETE /barrel/{roomName}/session", sseLeave)
+	mux.HandleFunc("POST /barrel/{roomName}/status", sseStatus(l))
+	mux.HandleFunc("POST /barrel/{roomName}/queue", sseQueue(l))
+	mux.HandleFunc("POST /barrel/{roomName}/ready", sseReady(l))
+	mux.HandleFunc("POST /barrel/{roomName}/heartbeat", sseHeartbeat)
+	mux.HandleFunc("GET /barrel/{roomName}/events", sseEvents(l))
+	mux.HandleFunc("POST /barrel/{roomName}/kick", kickHandler(l))
+	mux.HandleFunc("POST /barrel/{roomName}/mute", muteHandler(l))
+	mux.HandleFunc("DELETE /barrel/{roomName}/mute", muteHandler(l))
+	mux.HandleFunc("POST /barrel/{roomName}/ban", banHandler(l))
+	mux.HandleFunc("DELETE /barrel/{roomName}/ban", banHandler(l))
 	mux.HandleFunc("/client.js", script)
 	mux.HandleFunc("/", home)
 
 	return mux
 }
-
-func init() {
-	rooms = make(map[string]*grog.Room)
-
-	// parse templates
-	var err error
-	tmpl, err = template.ParseFiles("templates/index.html")
-	if err != nil {
-		fmt.Println("Unable to parse templates")
-		panic(err)
-	}
-}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// Persists room snapshots between server restarts
+type SnapshotStore interface {
+	Save([]grog.RoomSnapshot) error
+	// Load the last saved snapshots, nil if none were saved
+	Load() ([]grog.RoomSnapshot, error)
+}
+
+// Stores snapshots as a json file
+type FileStore struct {
+	Path string
+}
+
+func (s FileStore) Save(snapshots []grog.RoomSnapshot) error {
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+
+	// replace the file atomically so a crash never leaves a partial snapshot
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.Path)
+}
+
+func (s FileStore) Load() ([]grog.RoomSnapshot, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshots []grog.RoomSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
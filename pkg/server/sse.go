@@ -0,0 +1,471 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// how long a session may go without an open event stream, a dropped stream may reattach within it
+const sessionTimeout = 30 * time.Second
+
+// A client using the server sent events transport
+type session struct {
+	id        string
+	client    grog.Client
+	room      *grog.Room
+	roomId    uint16
+	spectator bool          // recieves statuses every interval and cannot send them
+	resume    []byte        // resume message sent when the event stream opens
+	kicked    <-chan string // nil for spectators
+	interval  time.Duration // requested update interval, 0 for the default
+	ack       atomic.Uint32 // status sequence last acknowledged by a member
+	release   func()        // releases the requested interval
+	updates   chan struct{}
+	attached  atomic.Bool // an event stream is open
+	streams   chan bool   // recieves true when an event stream opens and false when it closes
+	done      chan struct{}
+	once      sync.Once
+}
+
+var sessions = struct {
+	m map[string]*session
+	sync.Mutex
+}{m: make(map[string]*session)}
+
+func newSessionId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func getSession(r *http.Request) (*session, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.m[r.URL.Query().Get("session")]
+	if !ok || s.room.Name != r.PathValue("roomName") {
+		return nil, false
+	}
+	return s, true
+}
+
+// Leave the room and forget the session
+func (s *session) close() {
+	s.once.Do(func() {
+		sessions.Lock()
+		delete(sessions.m, s.id)
+		sessions.Unlock()
+
+		close(s.done)
+		if s.release != nil {
+			s.release()
+		}
+		if s.spectator {
+			s.room.LeaveSpectator()
+		} else {
+			s.room.Leave(s.roomId)
+		}
+	})
+}
+
+// Tell the session's watcher that an event stream opened or closed
+func (s *session) signal(attached bool) {
+	select {
+	case s.streams <- attached:
+	case <-s.done:
+	}
+}
+
+// Close the session once it has gone sessionTimeout without an event stream.
+// While a stream is open it handles kicks and the room closing.
+func (s *session) watch(logger *slog.Logger) {
+	timer := time.NewTimer(sessionTimeout)
+	defer timer.Stop()
+
+	kicked, roomDone := s.kicked, s.room.Done()
+	for {
+		select {
+		case attached := <-s.streams:
+			if attached {
+				timer.Stop()
+				kicked, roomDone = nil, nil
+			} else {
+				timer.Reset(sessionTimeout)
+				kicked, roomDone = s.kicked, s.room.Done()
+			}
+		case <-s.done:
+			return
+		case <-roomDone:
+			s.close()
+			return
+		case <-kicked:
+			logger.Info("Kicked without an event stream")
+			s.close()
+			return
+		case <-timer.C:
+			logger.Info("Session went without an event stream")
+			s.close()
+			return
+		}
+	}
+}
+
+// Write a frame as a server sent event
+func writeEvent(w io.Writer, frame []byte) error {
+	_, err := fmt.Fprintf(w, "data: %s\n\n", base64.StdEncoding.EncodeToString(frame))
+	return err
+}
+
+// Create a session from a clientAnnounce and join the room
+func sseJoin(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		message, err := io.ReadAll(io.LimitReader(r.Body, 259))
+		if err != nil {
+			http.Error(w, "Unable to read clientAnnounce", http.StatusBadRequest)
+			return
+		}
+
+		id := newSessionId()
+		client, err := parseClient(message, r.RemoteAddr+"/"+id, logger)
+		if err == ErrIncompatibleVersion || err == ErrInvalidClientName || err == ErrInvalidClientAnnounce {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		roomName := r.PathValue("roomName")
+		logger = logger.With(slog.Group("client",
+			slog.String("version", client.Version.String()),
+			slog.String("name", client.Name),
+			slog.String("addr", client.Addr),
+		))
+		room, err := Rooms.Get(roomName, logger)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		spectator := r.URL.Query().Has("spectate")
+		var roomId uint16
+		if spectator {
+			err = room.Spectate(client)
+		} else {
+			roomId, err = joinRoom(room, client, r.URL.Query().Get("resume"), logger)
+		}
+		if err == grog.ErrRoomClosed {
+			http.Error(w, ErrServerShutdown.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err == grog.ErrRoomFull {
+			http.Error(w, "Room is full", http.StatusServiceUnavailable)
+			return
+		} else if err == grog.ErrPermissionDenied {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		} else if err == grog.ErrBanned {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			logger.Error("Unexpected error occured while joining",
+				slog.String("roomName", roomName),
+				slog.String("err", err.Error()),
+			)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s := &session{
+			id:        id,
+			client:    client,
+			room:      room,
+			roomId:    roomId,
+			spectator: spectator,
+			interval:  parseInterval(r.URL.Query().Get("interval")),
+			updates:   make(chan struct{}, 1),
+			streams:   make(chan bool),
+			done:      make(chan struct{}),
+		}
+		if s.interval > 0 {
+			s.release = room.RequestTick(s.interval)
+		}
+		if !spectator {
+			s.resume = resumeFrame(room, roomId, client)
+			s.kicked = room.Kicked(roomId)
+		}
+		sessions.Lock()
+		sessions.m[id] = s
+		sessions.Unlock()
+
+		go s.watch(logger)
+
+		if spectator {
+			logger.Info("Spectator Joined Room", slog.String("roomName", roomName))
+		} else {
+			logger.Info("User Joined Room", slog.Group("roomInfo",
+				slog.String("roomName", roomName),
+				slog.Int("clientRoomId", int(roomId)),
+			))
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, id)
+	}
+}
+
+// Explicitly end a session
+func sseLeave(w http.ResponseWriter, r *http.Request) {
+	s, ok := getSession(r)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	s.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Record a heartbeat for a session with nothing else to send
+func sseHeartbeat(w http.ResponseWriter, r *http.Request) {
+	s, ok := getSession(r)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	} else if s.spectator {
+		http.Error(w, ErrSpectatorStatus.Error(), http.StatusForbidden)
+		return
+	}
+	s.room.Seen(s.roomId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Read a clientStatus for a session
+func sseStatus(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := getSession(r)
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		} else if s.spectator {
+			http.Error(w, ErrSpectatorStatus.Error(), http.StatusForbidden)
+			return
+		}
+
+		message, err := io.ReadAll(io.LimitReader(r.Body, 8))
+		if err != nil {
+			http.Error(w, "Unable to read clientStatus", http.StatusBadRequest)
+			return
+		}
+		s.room.Seen(s.roomId)
+		msg, err := parseClientStatus(message, s.client, s.roomId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Debug("recieved message",
+			slog.String("session", s.id),
+			slog.String("content", msg.String()),
+		)
+		s.ack.Store(msg.Ack)
+		s.room.Update(s.client, msg.ClientStatusMessage)
+
+		select {
+		case s.updates <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Read a change to the queue for a session, the body is a queue message without its type
+func sseQueue(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := getSession(r)
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		} else if s.spectator {
+			http.Error(w, ErrSpectatorStatus.Error(), http.StatusForbidden)
+			return
+		} else if !s.client.Version.AtLeast(queueVersion) {
+			http.Error(w, ErrIncompatibleVersion.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// an added item is at most 65793 bytes
+		message, err := io.ReadAll(io.LimitReader(r.Body, 65800))
+		if err != nil {
+			http.Error(w, "Unable to read queue message", http.StatusBadRequest)
+			return
+		}
+		s.room.Seen(s.roomId)
+		msg, err := grog.ParseClientQueue(message)
+		if err != nil {
+			http.Error(w, ErrInvalidClientMessage.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.room.UpdateQueue(s.client, s.roomId, msg); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Debug("Queue changed", slog.String("session", s.id), slog.String("op", msg.Op.String()))
+
+		select {
+		case s.updates <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Read a ready check operation for a session, the body is the operation's byte
+func sseReady(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := getSession(r)
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		} else if s.spectator {
+			http.Error(w, ErrSpectatorStatus.Error(), http.StatusForbidden)
+			return
+		} else if !s.client.Version.AtLeast(readyVersion) {
+			http.Error(w, ErrIncompatibleVersion.Error(), http.StatusBadRequest)
+			return
+		}
+
+		message, err := io.ReadAll(io.LimitReader(r.Body, 8))
+		if err != nil {
+			http.Error(w, "Unable to read ready message", http.StatusBadRequest)
+			return
+		}
+		s.room.Seen(s.roomId)
+		msg, err := grog.ParseClientReady(message)
+		if err != nil || len(message) != 1 {
+			http.Error(w, ErrInvalidClientMessage.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.room.UpdateReady(s.client, s.roomId, msg); errors.Is(err, grog.ErrNotHost) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Debug("Ready check operation", slog.String("session", s.id), slog.String("op", msg.Op.String()))
+
+		select {
+		case s.updates <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Stream serverAnnounce, serverStatus, queue, ready check and pause messages to a session
+func sseEvents(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := getSession(r)
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+		if !s.attached.CompareAndSwap(false, true) {
+			http.Error(w, "Session already has an event stream", http.StatusConflict)
+			return
+		}
+		s.signal(true)
+		// a dropped stream leaves the session open for another to attach
+		defer func() {
+			// signalled first so the watcher never sees a new stream before this one closing
+			s.signal(false)
+			s.attached.Store(false)
+		}()
+
+		logger = logger.With(slog.String("session", s.id))
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			logger.Error("Event stream does not support flushing", slog.String("err", err.Error()))
+			return
+		}
+
+		if s.resume != nil {
+			if err := writeEvent(w, s.resume); err != nil {
+				return
+			}
+		}
+
+		// announcements are checked periodically so new members appear before any status is sent
+		ticker := time.NewTicker(grog.ClampTick(s.interval))
+		defer ticker.Stop()
+
+		lastAnnouncement := 0
+		var sent sentState
+		delta := deltaState{implicit: s.spectator}
+		writeSSE := func(p []byte) error { return writeEvent(w, p) }
+		updates := false
+		for {
+			sendStatus := false
+			select {
+			case <-r.Context().Done():
+				logger.Info("Closing event stream")
+				return
+			case <-s.done:
+				return
+			case <-s.room.Done():
+				logger.Info("Room closed, ending event stream")
+				writeEvent(w, errorFrame(ErrServerShutdown.Error()))
+				rc.Flush()
+				s.close()
+				return
+			case reason := <-s.kicked:
+				logger.Info("Kicked from room, ending event stream")
+				writeEvent(w, errorFrame(kickMessage(reason)))
+				rc.Flush()
+				s.close()
+				return
+			case <-ticker.C:
+				sendStatus = s.spectator
+			case <-s.updates:
+				sendStatus = true
+			}
+
+			lastAnnouncement, updates = s.room.Check(lastAnnouncement)
+			if updates {
+				if err := writeEvent(w, announceFrame(s.room, s.client)); err != nil {
+					logger.Error("Error while writting announcement", slog.String("err", err.Error()))
+					return
+				}
+			}
+			if err := writeState(s.room, s.client, &sent, writeSSE); err != nil {
+				logger.Error("Error while writting room state", slog.String("err", err.Error()))
+				return
+			}
+			if sendStatus {
+				if !s.spectator {
+					delta.ack = s.ack.Load()
+				}
+				if err := writeEvent(w, statusFrame(s.room, s.client, &delta)); err != nil {
+					logger.Error("Error while writting status", slog.String("err", err.Error()))
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
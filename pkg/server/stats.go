@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Snapshot of the server's rooms and runtime allocation statistics
+type Stats struct {
+	Rooms       int    `json:"rooms"`
+	Connections int    `json:"connections"`
+	Spectators  int    `json:"spectators"`
+	Goroutines  int    `json:"goroutines"`
+	TotalAlloc  uint64 `json:"totalAlloc"`
+	Mallocs     uint64 `json:"mallocs"`
+	HeapInuse   uint64 `json:"heapInuse"`
+	NumGC       uint32 `json:"numGC"`
+	PauseTotal  uint64 `json:"pauseTotalNs"`
+}
+
+func ReadStats() Stats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := Stats{
+		Goroutines: runtime.NumGoroutine(),
+		TotalAlloc: mem.TotalAlloc,
+		Mallocs:    mem.Mallocs,
+		HeapInuse:  mem.HeapInuse,
+		NumGC:      mem.NumGC,
+		PauseTotal: mem.PauseTotalNs,
+	}
+
+	Rooms.lock.Lock()
+	stats.Rooms = len(Rooms.rooms)
+	for _, room := range Rooms.rooms {
+		stats.Connections += int(room.Connections.Load())
+		stats.Spectators += int(room.Spectators.Load())
+	}
+	Rooms.lock.Unlock()
+
+	return stats
+}
+
+// Serve Stats as json
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReadStats())
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+var ErrInvalidTickRate error = errors.New("invalid tick rate")
+
+// Parse a tick rate of the form interval[,idle=DURATION].
+// An idle duration makes the rate adaptive, backing off to it while every member is paused.
+func ParseTickRate(spec string) (grog.TickRate, error) {
+	var rate grog.TickRate
+
+	parts := strings.Split(spec, ",")
+	interval, err := time.ParseDuration(parts[0])
+	if err != nil || interval < grog.MIN_TICK {
+		return rate, fmt.Errorf("%w: interval must be at least %s", ErrInvalidTickRate, grog.MIN_TICK)
+	}
+	rate.Interval = interval
+
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "idle":
+			idle, err := time.ParseDuration(value)
+			if err != nil || idle <= interval {
+				return rate, fmt.Errorf("%w: idle must be longer than the interval", ErrInvalidTickRate)
+			}
+			rate.Idle = idle
+		default:
+			return rate, fmt.Errorf("%w: unknown option %q", ErrInvalidTickRate, key)
+		}
+	}
+
+	return rate, nil
+}
+
+// Parse a room's tick rate of the form room=interval[,idle=DURATION]
+func ParseRoomTickRate(spec string) (string, grog.TickRate, error) {
+	name, rate, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return "", grog.TickRate{}, ErrInvalidTickRate
+	}
+	tickRate, err := ParseTickRate(rate)
+	return name, tickRate, err
+}
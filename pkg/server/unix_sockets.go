@@ -1,7 +1,10 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,34 +12,40 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jpappel/grog_barrel/pkg/grog"
 )
 
 type ClientRoom struct {
-	Client grog.Client
-	Room   *grog.Room
+	Client    grog.Client
+	Room      *grog.Room
+	Token     string // resume token, empty for new members
+	Spectator bool
+	Interval  time.Duration // requested update interval, 0 for the default
 }
 
 type UnixDriver struct {
-	conn    *net.UnixConn
-	logger  *slog.Logger
-	baseDir string
+	conn        *net.UnixConn
+	logger      *slog.Logger
+	baseDir     string
+	roomDirMode fs.FileMode
 }
 
 type SockServer struct {
 	shutdown chan struct{}
 	baseDir  string
 	logger   *slog.Logger
+	// permissions of the per room socket directories
+	RoomDirMode fs.FileMode
+	// pre-opened listener for new connections, bound to baseDir/join.sock when nil
+	Listener *net.UnixListener
 }
 
 func (d UnixDriver) WriteError(msg string) error {
-	buf := make([]byte, 0, 1+len(msg))
-	buf = append(buf, byte(grog.ERROR_MSG))
-	buf = append(buf, msg...)
-
-	_, err := d.conn.Write(buf)
+	_, err := d.conn.Write(errorFrame(msg))
 	return err
 }
 
@@ -59,34 +68,60 @@ func (d UnixDriver) ParseClient() (grog.Client, error) {
 
 	clientAddr := d.conn.LocalAddr().String()
 	client, err := parseClient(buf, clientAddr, d.logger)
+	if err != nil {
+		return client, err
+	}
 
-	return client, err
+	client.Cred, err = peerCred(d.conn)
+	if err != nil {
+		d.logger.Warn("Unable to read peer credentials", slog.String("err", err.Error()))
+	}
+
+	return client, nil
 }
 
-// Read a room name from a connection and attempt to return the corresponding room
-func (d UnixDriver) ParseRoom() (*grog.Room, error) {
-	buf := make([]byte, 256)
+// Read a room name from a connection and attempt to return the corresponding room.
+// The name may be followed by NUL separated options, a resume token, spectate or interval=MS.
+func (d UnixDriver) ParseRoom() (ClientRoom, error) {
+	buf := make([]byte, 256+1+grog.RESUME_TOKEN_LEN+len("\x00spectate")+len("\x00interval=65535"))
 	n, err := d.conn.Read(buf)
 	if err != nil {
-		return nil, err
-	} else if n > 256 {
-		return nil, ErrInvalidRoomName
+		return ClientRoom{}, err
 	}
 	buf = buf[:n]
 
-	name := string(buf)
-	room, ok := rooms[name]
-	if !ok {
-		rooms[name] = grog.NewRoom(name, d.logger)
-		room = rooms[name]
+	var clientRoom ClientRoom
+	name, options, _ := strings.Cut(string(buf), "\x00")
+	for _, option := range strings.Split(options, "\x00") {
+		if option == "spectate" {
+			clientRoom.Spectator = true
+		} else if ms, ok := strings.CutPrefix(option, "interval="); ok {
+			clientRoom.Interval = parseInterval(ms)
+		} else {
+			clientRoom.Token = option
+		}
+	}
+	// room names are directories under the base directory
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.Contains(name, "/") {
+		return ClientRoom{}, ErrInvalidRoomName
+	}
+	clientRoom.Room, err = Rooms.Get(name, d.logger)
+	if err != nil {
+		return ClientRoom{}, err
 	}
 
-	// NOTE: file mode could be a potential security concern
-	if err := os.Mkdir(d.baseDir+"/"+name, 0775); err != nil && !errors.Is(err, fs.ErrExist) {
-		return nil, err
+	dir := d.baseDir + "/" + name
+	if err := os.Mkdir(dir, d.roomDirMode); errors.Is(err, fs.ErrExist) {
+		return clientRoom, nil
+	} else if err != nil {
+		return ClientRoom{}, err
+	}
+	// mkdir is subject to the umask
+	if err := os.Chmod(dir, d.roomDirMode); err != nil {
+		return ClientRoom{}, err
 	}
 
-	return room, nil
+	return clientRoom, nil
 }
 
 func handleNewConn(d UnixDriver, clientRooms chan<- ClientRoom, more chan<- bool) {
@@ -101,7 +136,7 @@ func handleNewConn(d UnixDriver, clientRooms chan<- ClientRoom, more chan<- bool
 	if err == io.EOF {
 		d.WriteError("Unexpected end of message")
 		return
-	} else if err == ErrIncompatibleVersion || err == ErrInvalidClientName {
+	} else if err == ErrIncompatibleVersion || err == ErrInvalidClientName || err == ErrInvalidClientAnnounce {
 		d.WriteError("Invalid client: " + err.Error())
 		return
 	} else if errors.Is(err, os.ErrDeadlineExceeded) {
@@ -120,7 +155,7 @@ func handleNewConn(d UnixDriver, clientRooms chan<- ClientRoom, more chan<- bool
 	d.WriteEmpty()
 
 	d.conn.SetDeadline(time.Now().Add(50 * time.Second))
-	room, err := d.ParseRoom()
+	clientRoom, err := d.ParseRoom()
 	if err == io.EOF {
 		d.WriteError("Unexpected end of message")
 		return
@@ -134,13 +169,19 @@ func handleNewConn(d UnixDriver, clientRooms chan<- ClientRoom, more chan<- bool
 		d.logger.Warn("Error occured while parsing room", slog.String("err", errStr))
 		return
 	}
+	room := clientRoom.Room
+	if !room.ACL.Permits(client) {
+		d.WriteError(grog.ErrPermissionDenied.Error())
+		d.logger.Info("Client not permitted to join room", slog.String("roomName", room.Name))
+		return
+	}
 	client.Addr = d.baseDir + "/" + room.Name + "/" + client.Name
-	clientRooms <- ClientRoom{client, room}
+	clientRoom.Client = client
+	clientRooms <- clientRoom
 
 	d.conn.SetDeadline(time.Now().Add(150 * time.Second))
 	if _, err := d.conn.Write([]byte(client.Addr)); err != nil {
-		d.logger.Error("Error sending client addr")
-		panic(err)
+		d.logger.Error("Error sending client addr", slog.String("err", err.Error()))
 	}
 }
 
@@ -149,30 +190,32 @@ func (s *SockServer) listenNewConns(ctx context.Context,
 	clientRooms chan<- ClientRoom,
 ) {
 	more := make(chan bool, 1)
-	go func() {
-		more <- true
-	}()
-	defer close(more)
+	more <- true
 
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			return
 		case <-more:
-			conn, err := ln.AcceptUnix()
-			if err != nil {
-				// TODO: handle error
-				break
-			}
-			s.logger.Info("New connection", slog.String("addr", conn.RemoteAddr().String()))
+		}
 
-			driver := UnixDriver{conn, s.logger, s.baseDir}
-			go handleNewConn(driver, clientRooms, more)
+		conn, err := ln.AcceptUnix()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			s.logger.Error("Error accepting new connection", slog.String("err", err.Error()))
+			more <- true
+			continue
 		}
+		s.logger.Info("New connection", slog.String("addr", conn.RemoteAddr().String()))
+
+		driver := UnixDriver{conn, s.logger, s.baseDir, s.RoomDirMode}
+		go handleNewConn(driver, clientRooms, more)
 	}
 }
 
-func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room, logger *slog.Logger) {
+func handleClientConn(ctx context.Context, clientRoom ClientRoom, logger *slog.Logger) {
+	client, room := clientRoom.Client, clientRoom.Room
 	addr := net.UnixAddr{Name: client.Addr, Net: "Unix"}
 	socketCtx, cancelSocket := context.WithCancel(ctx)
 	logger = logger.With(slog.String("addr", client.Addr))
@@ -181,7 +224,8 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 		logger.Error("Failed to listen for client connection",
 			slog.String("err", err.Error()),
 		)
-		panic(err)
+		cancelSocket()
+		return
 	}
 	ln.SetUnlinkOnClose(true)
 	go func() {
@@ -197,37 +241,109 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 	if errors.Is(err, os.ErrDeadlineExceeded) {
 		logger.Warn("Timed out while waiting for client connection")
 		return
+	} else if errors.Is(err, net.ErrClosed) || socketCtx.Err() != nil {
+		// the server is shutting down
+		return
 	} else if err != nil {
 		logger.Error("Error occured while accepting client connection",
 			slog.String("err", err.Error()),
 		)
-		panic(err)
+		return
 	}
 	defer conn.Close()
 	defer logger.Info("Closing connection")
 
-	id, err := room.Join(client)
-	if err != nil {
+	// the client socket is reachable by anyone with access to the room directory
+	if client.Cred != nil {
+		cred, err := peerCred(conn)
+		if err != nil || cred.Uid != client.Cred.Uid {
+			logger.Warn("Client socket connected by a different user")
+			return
+		}
+	}
+
+	var id uint16
+	if clientRoom.Spectator {
+		err = room.Spectate(client)
+	} else {
+		id, err = joinRoom(room, client, clientRoom.Token, logger)
+	}
+	if err == grog.ErrRoomClosed {
+		conn.Write(errorFrame(ErrServerShutdown.Error()))
+		return
+	} else if err == grog.ErrRoomFull || err == grog.ErrPermissionDenied || err == grog.ErrBanned {
+		conn.Write(errorFrame(err.Error()))
+		return
+	} else if err != nil {
 		logger.Error("Failed to join room", slog.String("err", err.Error()))
-		panic(err)
+		conn.Write(errorFrame(err.Error()))
+		return
+	}
+	if clientRoom.Interval > 0 {
+		defer room.RequestTick(clientRoom.Interval)()
+	}
+	if clientRoom.Spectator {
+		defer room.LeaveSpectator()
+		logger.Info("Spectator Joined Room")
+		spectateUnix(conn, client, room, clientRoom.Interval, logger)
+		return
 	}
 	defer room.Leave(id)
 
+	left := make(chan struct{})
+	defer close(left)
+	kicked := make(chan struct{}, 1)
+	go func() {
+		select {
+		case <-room.Done():
+			logger.Info("Room closed, disconnecting client")
+			conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+			conn.Write(errorFrame(ErrServerShutdown.Error()))
+			// unblock the pending read of a clientStatus
+			conn.SetReadDeadline(time.Now())
+		case reason := <-room.Kicked(id):
+			logger.Info("Kicked from room, disconnecting client")
+			conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+			conn.Write(errorFrame(kickMessage(reason)))
+			kicked <- struct{}{}
+			conn.SetReadDeadline(time.Now())
+		case <-left:
+		}
+	}()
+
 	logger = logger.With(slog.Group("client",
 		slog.Int("id", int(id)),
 		slog.String("name", client.Name),
 	))
+
+	if frame := resumeFrame(room, id, client); frame != nil {
+		if _, err := conn.Write(frame); err != nil {
+			logger.Error("Failed to send resume", slog.String("err", err.Error()))
+			return
+		}
+	}
 	lastAnnouncement := 0
+	var sent sentState
+	var delta deltaState
+	writeConn := func(p []byte) error {
+		_, err := conn.Write(p)
+		return err
+	}
 	updates := false
 
 	buf := make([]byte, 8)
+	// clients since v2.2 send typed messages of varying length
+	var reader *bufio.Reader
+	if client.Version.AtLeast(queueVersion) {
+		reader = bufio.NewReader(conn)
+	}
 
 	// poll until first room has built a new announcement
 	for range 5 {
 		lastAnnouncement, updates = room.Check(lastAnnouncement)
 		if updates {
 			// FIXME: bufer has length of 1 instead of correct amount
-			announcement := room.Messages.Announcements()
+			announcement := announceFrame(room, client)
 			logger.Debug("Sending first serverAnnounce", slog.Int("len", len(announcement)))
 			if _, err := conn.Write(announcement); err != nil {
 				logger.Error("Failed to send first serverAnnounce",
@@ -252,7 +368,7 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 			slog.Bool("updates", updates),
 		)
 		if updates {
-			announcement := room.Messages.Announcements()
+			announcement := announceFrame(room, client)
 			logger.Debug("Sending serverAnnounce", slog.Int("len", len(announcement)))
 			if _, err := conn.Write(announcement); err != nil {
 				// TODO: log error
@@ -260,15 +376,31 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 			}
 			updates = false
 		}
+		if err := writeState(room, client, &sent, writeConn); err != nil {
+			logger.Error("Failed to send room state", slog.String("err", err.Error()))
+			break
+		}
 
-		conn.SetDeadline(time.Now().Add(15 * time.Minute))
+		conn.SetDeadline(time.Now().Add(readTimeout(room)))
 		logger.Debug("Waiting on clientStatus")
-		n, err := conn.Read(buf)
-		if n != 3 {
-			logger.Warn("Incorrect read size for clientStatus", slog.Int("size", n))
-			// TODO: write error to client
+		var message []byte
+		var err error
+		if reader != nil {
+			message, err = readClientFrame(reader, client)
+		} else {
+			var n int
+			n, err = conn.Read(buf)
+			buf = buf[:n]
+			message = buf
+		}
+		if err == io.EOF || closed(room) || len(kicked) > 0 {
+			break
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Info("Client silent for too long, disconnecting client")
 			break
-		} else if err == io.EOF {
+		} else if err == ErrInvalidClientMessage || (reader == nil && len(message) != 3) {
+			logger.Warn("Incorrect read size for clientStatus", slog.Int("size", len(message)))
+			// TODO: write error to client
 			break
 		} else if err != nil {
 			logger.Error("Error while reading client status",
@@ -276,12 +408,33 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 			)
 			break
 		}
-		buf = buf[:n]
 
-		msg := parseStatusMessage(buf, id)
-		room.Update(client, msg)
+		room.Seen(id)
 
-		status := room.Messages.Status()
+		parsed, err := parseClientMessage(message, client, id)
+		if err != nil {
+			break
+		} else if parsed == nil {
+			// heartbeats have no reply
+			continue
+		}
+		if change, ok := parsed.(grog.ClientQueueMessage); ok {
+			if err := room.UpdateQueue(client, id, change); err != nil {
+				logger.Debug("Ignoring queue change", slog.String("err", err.Error()))
+			}
+			continue
+		}
+		if ready, ok := parsed.(grog.ClientReadyMessage); ok {
+			if err := room.UpdateReady(client, id, ready); err != nil {
+				logger.Debug("Ignoring ready check operation", slog.String("err", err.Error()))
+			}
+			continue
+		}
+		msg := parsed.(grog.ClientStatusAckMessage)
+		delta.ack = msg.Ack
+		room.Update(client, msg.ClientStatusMessage)
+
+		status := statusFrame(room, client, &delta)
 		logger.Debug("status", slog.Int("len", len(status)))
 		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
 		// FIXME: double check for short writes
@@ -295,35 +448,173 @@ func handleClientConn(ctx context.Context, client grog.Client, room *grog.Room,
 	}
 }
 
+// Read a typed message sent by a client since v2.2
+func readClientFrame(r *bufio.Reader, client grog.Client) ([]byte, error) {
+	msgType, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	frame := []byte{msgType}
+
+	switch grog.MessageType(msgType) {
+	case grog.EMPTY_MSG:
+		return frame, nil
+	case grog.STATUS_MSG:
+		// followed by the acknowledged status sequence since v2.5
+		if client.Version.AtLeast(deltaVersion) {
+			return readN(r, frame, 7)
+		}
+		return readN(r, frame, 3)
+	case grog.QUEUE_MSG:
+		if frame, err = readN(r, frame, 1); err != nil {
+			return nil, err
+		}
+		switch grog.QueueOp(frame[1]) {
+		case grog.QUEUE_ADD:
+			// duration and title length
+			if frame, err = readN(r, frame, 3); err != nil {
+				return nil, err
+			}
+			if frame, err = readN(r, frame, int(frame[len(frame)-1])+2); err != nil {
+				return nil, err
+			}
+			return readN(r, frame, int(binary.BigEndian.Uint16(frame[len(frame)-2:])))
+		case grog.QUEUE_REMOVE:
+			return readN(r, frame, 2)
+		case grog.QUEUE_MOVE:
+			return readN(r, frame, 4)
+		case grog.QUEUE_ADVANCE:
+			return frame, nil
+		}
+	case grog.READY_MSG:
+		return readN(r, frame, 1)
+	}
+	return nil, ErrInvalidClientMessage
+}
+
+// Append the next n bytes of r to frame
+func readN(r *bufio.Reader, frame []byte, n int) ([]byte, error) {
+	start := len(frame)
+	frame = append(frame, make([]byte, n)...)
+	_, err := io.ReadFull(r, frame[start:])
+	return frame, err
+}
+
+// Send announcements and a status every interval to a spectator until it disconnects or the room closes
+func spectateUnix(conn *net.UnixConn, client grog.Client, room *grog.Room, interval time.Duration, logger *slog.Logger) {
+	// spectators never send statuses, reading detects the connection closing.
+	// Spectators since v2.6 send heartbeats and are dropped once silent for too long.
+	heartbeats := client.Version.AtLeast(heartbeatVersion)
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 8)
+		for {
+			if heartbeats {
+				conn.SetReadDeadline(time.Now().Add(readTimeout(room)))
+			}
+			n, err := conn.Read(buf)
+			if err == nil && heartbeats && bytes.Count(buf[:n], []byte{byte(grog.EMPTY_MSG)}) == n {
+				continue
+			} else if err == nil {
+				err = ErrSpectatorStatus
+			}
+			readErr <- err
+			return
+		}
+	}()
+
+	ticker := time.NewTicker(grog.ClampTick(interval))
+	defer ticker.Stop()
+
+	lastAnnouncement := 0
+	var sent sentState
+	delta := deltaState{implicit: true}
+	writeConn := func(p []byte) error {
+		_, err := conn.Write(p)
+		return err
+	}
+	updates := false
+	for {
+		conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+		lastAnnouncement, updates = room.Check(lastAnnouncement)
+		if updates {
+			if _, err := conn.Write(announceFrame(room, client)); err != nil {
+				logger.Error("Failed to send serverAnnounce", slog.String("err", err.Error()))
+				return
+			}
+		}
+		if err := writeState(room, client, &sent, writeConn); err != nil {
+			logger.Error("Failed to send room state", slog.String("err", err.Error()))
+			return
+		}
+		if _, err := conn.Write(statusFrame(room, client, &delta)); err != nil {
+			logger.Error("Failed to send serverStatus", slog.String("err", err.Error()))
+			return
+		}
+
+		select {
+		case err := <-readErr:
+			if err == ErrSpectatorStatus {
+				logger.Warn("Spectator sent a clientStatus")
+				conn.Write(errorFrame(err.Error()))
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Info("Spectator silent for too long, disconnecting spectator")
+			}
+			return
+		case <-room.Done():
+			logger.Info("Room closed, disconnecting spectator")
+			conn.Write(errorFrame(ErrServerShutdown.Error()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handle client connections until ctx is done, then wait for them to close
 func listenClients(ctx context.Context, clientRooms <-chan ClientRoom, logger *slog.Logger) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			return
 		case clientRoom := <-clientRooms:
-			go handleClientConn(ctx, clientRoom.Client, clientRoom.Room, logger)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleClientConn(ctx, clientRoom, logger)
+			}()
 		}
 	}
 }
 
 func NewSockServer(baseDir string, logger *slog.Logger) *SockServer {
 	srv := &SockServer{
-		baseDir: baseDir,
-		logger:  logger,
+		baseDir:     baseDir,
+		logger:      logger,
+		RoomDirMode: 0775,
 	}
 
 	return srv
 }
 
+// Serve socket clients until ctx is done.
+// Returns once the join socket and every client socket are closed.
 func (s *SockServer) Run(ctx context.Context) {
-	ln, err := net.ListenUnix("unix",
-		&net.UnixAddr{Name: s.baseDir + "/join.sock", Net: "Unix"},
-	)
-	if err != nil {
-		s.logger.Error("error opening new connection socket",
-			slog.String("newConnAddr", ln.Addr().String()),
+	ln := s.Listener
+	if ln == nil {
+		var err error
+		ln, err = net.ListenUnix("unix",
+			&net.UnixAddr{Name: s.baseDir + "/join.sock", Net: "Unix"},
 		)
-		panic(err)
+		if err != nil {
+			s.logger.Error("error opening new connection socket",
+				slog.String("newConnAddr", s.baseDir+"/join.sock"),
+				slog.String("err", err.Error()),
+			)
+			return
+		}
 	}
 	defer ln.Close()
 	s.logger.Info("Opened socket for new connections",
@@ -336,8 +627,14 @@ func (s *SockServer) Run(ctx context.Context) {
 	s.logger.Info("Listening for new connections on socket",
 		slog.String("sockAddr", ln.Addr().String()),
 	)
-	defer close(clientRooms)
+
+	// stop accepting connections before waiting on the connected clients
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
 
 	s.logger.Info("Listening for new socket clients")
 	listenClients(ctx, clientRooms, s.logger)
+	s.logger.Info("Socket server stopped")
 }
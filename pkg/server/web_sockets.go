@@ -13,15 +13,31 @@ type WsDriver struct {
 	logger *slog.Logger
 }
 
+// Send an error and close the connection.
+// The error is sent as a data frame first since most clients reject its close code.
 func (d WsDriver) WriteError(msg string) error {
-	buf := make([]byte, 0, 1+len(msg))
-	buf = append(buf, byte(grog.ERROR_MSG))
-	buf = append(buf, msg...)
+	buf := errorFrame(msg)
 
 	deadline := time.Now().Add(1 * time.Second)
+	d.conn.SetWriteDeadline(deadline)
+	if err := d.conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+		return err
+	}
 	return d.conn.WriteControl(websocket.CloseMessage, buf, deadline)
 }
 
+// Notify the client that the server is shutting down and close the connection.
+// The error is sent as a data frame since browsers reject error close codes.
+func (d WsDriver) WriteShutdown() error {
+	d.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	if err := d.conn.WriteMessage(websocket.BinaryMessage, errorFrame(ErrServerShutdown.Error())); err != nil {
+		return err
+	}
+	return d.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(1*time.Second))
+}
+
 func (d WsDriver) ParseClient() (grog.Client, error) {
 	addr := d.conn.RemoteAddr().String()
 	_, message, err := d.conn.ReadMessage()
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpappel/grog_barrel/pkg/grog"
+)
+
+// number of deliveries kept in the delivery log
+const DELIVERY_LOG_SIZE = 256
+
+var ErrInvalidWebhook error = errors.New("invalid webhook")
+
+// Endpoint that recieves room events as json
+type Webhook struct {
+	URL string
+	// key for the HMAC-SHA256 of the body, sent as X-Grogbarrel-Signature: sha256=HEX
+	Secret string
+	// events to send, every event except member.status when empty
+	Events []grog.EventKind
+}
+
+// An attempt to deliver an event to a webhook
+type Delivery struct {
+	Id       string         `json:"id"`
+	Event    grog.EventKind `json:"event"`
+	Room     string         `json:"room"`
+	URL      string         `json:"url"`
+	Attempt  int            `json:"attempt"`
+	Status   int            `json:"status,omitempty"`
+	Err      string         `json:"error,omitempty"`
+	Time     time.Time      `json:"time"`
+	Duration time.Duration  `json:"duration"`
+}
+
+type webhookJob struct {
+	hook  *Webhook
+	id    string
+	event grog.Event
+	body  []byte
+}
+
+// Delivers room events to webhooks, retrying failed deliveries with backoff
+type Webhooks struct {
+	hooks  []Webhook
+	queue  chan webhookJob
+	client *http.Client
+	logger *slog.Logger
+
+	// attempts before a delivery is abandoned
+	MaxAttempts int
+	// delay before the first retry, doubled for each following one
+	Backoff time.Duration
+	Workers int
+
+	deliveries []Delivery
+	logLock    sync.Mutex
+}
+
+// Parse a webhook of the form url[,secret=SECRET][,events=EVENT+EVENT...].
+// Options are separated by commas, so a secret cannot contain one.
+func ParseWebhook(spec string) (Webhook, error) {
+	parts := strings.Split(spec, ",")
+	u, err := url.Parse(parts[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return Webhook{}, fmt.Errorf("%w: url must be http or https", ErrInvalidWebhook)
+	}
+
+	hook := Webhook{URL: parts[0]}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "secret":
+			hook.Secret = value
+		case "events":
+			for _, event := range strings.Split(value, "+") {
+				if !slices.Contains(grog.EventKinds, grog.EventKind(event)) {
+					return Webhook{}, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+				}
+				hook.Events = append(hook.Events, grog.EventKind(event))
+			}
+		default:
+			return Webhook{}, fmt.Errorf("%w: unknown option %q", ErrInvalidWebhook, key)
+		}
+	}
+
+	return hook, nil
+}
+
+func NewWebhooks(hooks []Webhook, logger *slog.Logger) *Webhooks {
+	return &Webhooks{
+		hooks:       hooks,
+		queue:       make(chan webhookJob, 1024),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger.With(slog.String("component", "webhooks")),
+		MaxAttempts: 5,
+		Backoff:     1 * time.Second,
+		Workers:     4,
+		deliveries:  make([]Delivery, 0, DELIVERY_LOG_SIZE),
+	}
+}
+
+// Deliver a room's events while it has members.
+// The subscription is released once the room empties and renewed when it reopens.
+func (w *Webhooks) Watch(room *grog.Room) {
+	room.SubscribeWhileOpen(64, grog.DROP_NEWEST, func(sub *grog.Subscription) {
+		for event := range sub.C {
+			w.Notify(event)
+		}
+	})
+}
+
+// Queue an event for every webhook subscribed to it.
+// Events are dropped when the queue is full.
+func (w *Webhooks) Notify(event grog.Event) {
+	var body []byte
+	for i := range w.hooks {
+		hook := &w.hooks[i]
+		if len(hook.Events) == 0 && event.Kind == grog.STATUS_EVENT {
+			continue
+		} else if len(hook.Events) > 0 && !slices.Contains(hook.Events, event.Kind) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				w.logger.Error("Failed to encode event", slog.String("err", err.Error()))
+				return
+			}
+		}
+
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		select {
+		case w.queue <- webhookJob{hook, hex.EncodeToString(buf), event, body}:
+		default:
+			w.logger.Warn("Webhook queue full, dropping event",
+				slog.String("event", string(event.Kind)),
+				slog.String("url", hook.URL),
+			)
+		}
+	}
+}
+
+// Deliver queued events until ctx is done
+func (w *Webhooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range w.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-w.queue:
+					w.deliver(ctx, job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Attempt a delivery until it succeeds, fails permanently or runs out of attempts
+func (w *Webhooks) deliver(ctx context.Context, job webhookJob) {
+	backoff := w.Backoff
+	for attempt := 1; attempt <= w.MaxAttempts; attempt++ {
+		delivery, retry := w.attempt(ctx, job, attempt)
+		w.log(delivery)
+		if !retry || attempt == w.MaxAttempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Post an event once, reporting whether a failure is worth retrying
+func (w *Webhooks) attempt(ctx context.Context, job webhookJob, attempt int) (Delivery, bool) {
+	delivery := Delivery{
+		Id:      job.id,
+		Event:   job.event.Kind,
+		Room:    job.event.Room,
+		URL:     job.hook.URL,
+		Attempt: attempt,
+		Time:    time.Now(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		delivery.Err = err.Error()
+		return delivery, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "grogbarrel/"+ServerVersion.String())
+	req.Header.Set("X-Grogbarrel-Event", string(job.event.Kind))
+	req.Header.Set("X-Grogbarrel-Delivery", job.id)
+	if job.hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(job.hook.Secret))
+		mac.Write(job.body)
+		req.Header.Set("X-Grogbarrel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	delivery.Duration = time.Since(delivery.Time)
+	if err != nil {
+		delivery.Err = err.Error()
+		return delivery, true
+	}
+	resp.Body.Close()
+	delivery.Status = resp.StatusCode
+
+	switch {
+	case resp.StatusCode < 300:
+		return delivery, false
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		delivery.Err = resp.Status
+		return delivery, true
+	default:
+		delivery.Err = resp.Status
+		return delivery, false
+	}
+}
+
+// Add a delivery to the log, dropping the oldest once full
+func (w *Webhooks) log(delivery Delivery) {
+	attrs := []any{
+		slog.String("id", delivery.Id),
+		slog.String("event", string(delivery.Event)),
+		slog.String("url", delivery.URL),
+		slog.Int("attempt", delivery.Attempt),
+		slog.Int("status", delivery.Status),
+	}
+	if delivery.Err != "" {
+		w.logger.Warn("Webhook delivery failed", append(attrs, slog.String("err", delivery.Err))...)
+	} else {
+		w.logger.Debug("Webhook delivered", attrs...)
+	}
+
+	w.logLock.Lock()
+	defer w.logLock.Unlock()
+	if len(w.deliveries) == DELIVERY_LOG_SIZE {
+		w.deliveries = slices.Delete(w.deliveries, 0, 1)
+	}
+	w.deliveries = append(w.deliveries, delivery)
+}
+
+// Recent deliveries, oldest first
+func (w *Webhooks) Deliveries() []Delivery {
+	w.logLock.Lock()
+	defer w.logLock.Unlock()
+	return slices.Clone(w.deliveries)
+}
+
+// Serve the delivery log as json
+func (w *Webhooks) DeliveriesHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(w.Deliveries())
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// A listener passed by systemd socket activation
+type ActivatedListener struct {
+	Name     string // from LISTEN_FDNAMES, empty when unnamed
+	Listener net.Listener
+}
+
+// Collect listeners passed by systemd socket activation.
+//
+// Returns nil when the process was not socket activated.
+// The activation environment variables are unset so they are not inherited by children.
+func ActivationListeners() ([]ActivatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make([]ActivatedListener, 0, nfds)
+	for i := range nfds {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		// FileListener dups the descriptor
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Listener.Close()
+			}
+			return nil, err
+		}
+
+		listeners = append(listeners, ActivatedListener{name, ln})
+	}
+
+	return listeners, nil
+}
@@ -8,7 +8,7 @@ type SemVer struct {
 	Patch byte
 }
 
-var ServerVersion = SemVer{Major: 1, Minor: 5, Patch: 0}
+var ServerVersion = SemVer{Major: 2, Minor: 6, Patch: 0}
 
 func (s SemVer) String() string {
 	return fmt.Sprintf("v%d.%d.%d", s.Major, s.Minor, s.Patch)
@@ -21,3 +21,13 @@ func (s SemVer) Eq(other SemVer) bool {
 func (s SemVer) Compatible(other SemVer) bool {
 	return s.Major == other.Major && s.Minor >= other.Minor
 }
+
+// Check if s is the same version as other or a later one
+func (s SemVer) AtLeast(other SemVer) bool {
+	if s.Major != other.Major {
+		return s.Major > other.Major
+	} else if s.Minor != other.Minor {
+		return s.Minor > other.Minor
+	}
+	return s.Patch >= other.Patch
+}